@@ -0,0 +1,65 @@
+package analyzer
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"strings"
+	"unicode"
+)
+
+// 不需要词典的CJK二元分词器
+//
+// 连续的中日韩文字切分为相互重叠的二元组（只有一个字时输出单字），比如“中国人口”切分为
+// “中国”、“国人”和“人口”；连续的字母和数字作为一个词并转为小写；其它字符作为分隔符丢弃。
+type BigramAnalyzer struct {
+}
+
+func (analyzer BigramAnalyzer) Analyze(text string) (tokens []types.AnalyzedToken) {
+	// 当前连续CJK文字中每个字的首字节位置
+	var run []int
+	flushRun := func(end int) {
+		if len(run) == 1 {
+			tokens = append(tokens, types.AnalyzedToken{Text: text[run[0]:end], Start: run[0], End: end})
+		}
+		for i := 0; i+1 < len(run); i++ {
+			bigramEnd := end
+			if i+2 < len(run) {
+				bigramEnd = run[i+2]
+			}
+			tokens = append(tokens, types.AnalyzedToken{Text: text[run[i]:bigramEnd], Start: run[i], End: bigramEnd})
+		}
+		run = run[:0]
+	}
+
+	// 当前连续字母数字的首字节位置，-1表示不在词中
+	wordStart := -1
+	flushWord := func(end int) {
+		if wordStart >= 0 {
+			tokens = append(tokens, types.AnalyzedToken{Text: strings.ToLower(text[wordStart:end]), Start: wordStart, End: end})
+		}
+		wordStart = -1
+	}
+
+	for position, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord(position)
+			run = append(run, position)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushRun(position)
+			if wordStart < 0 {
+				wordStart = position
+			}
+		default:
+			flushRun(position)
+			flushWord(position)
+		}
+	}
+	flushRun(len(text))
+	flushWord(len(text))
+	return
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
@@ -0,0 +1,23 @@
+package analyzer
+
+import (
+	"fmt"
+	"github.com/Jarlene/wukong/types"
+	"github.com/Jarlene/wukong/utils"
+	"testing"
+)
+
+func tokensToString(tokens []types.AnalyzedToken) (output string) {
+	for _, token := range tokens {
+		output += fmt.Sprintf("%s/%d/%d ", token.Text, token.Start, token.End)
+	}
+	return
+}
+
+func TestBigramAnalyzer(t *testing.T) {
+	var analyzer BigramAnalyzer
+	utils.Expect(t, "中国/0/6 国人/3/9 人口/6/12 ", tokensToString(analyzer.Analyze("中国人口")))
+	utils.Expect(t, "百/0/3 go/4/6 1/7/8 ", tokensToString(analyzer.Analyze("百 Go,1")))
+	utils.Expect(t, "百度/0/6 ios7/6/10 发布/10/16 ", tokensToString(analyzer.Analyze("百度iOS7发布")))
+	utils.Expect(t, "", tokensToString(analyzer.Analyze("，。 ")))
+}
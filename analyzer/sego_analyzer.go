@@ -0,0 +1,31 @@
+package analyzer
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"github.com/huichen/sego"
+)
+
+// 基于sego词典分词的分词器，引擎默认使用
+type SegoAnalyzer struct {
+	segmenter sego.Segmenter
+}
+
+// 载入半角逗号分隔的字典文件，具体用法见sego.Segmenter.LoadDictionary函数的注释
+func NewSegoAnalyzer(dictionaries string) *SegoAnalyzer {
+	analyzer := &SegoAnalyzer{}
+	analyzer.segmenter.LoadDictionary(dictionaries)
+	return analyzer
+}
+
+func (analyzer *SegoAnalyzer) Analyze(text string) []types.AnalyzedToken {
+	segments := analyzer.segmenter.Segment([]byte(text))
+	tokens := make([]types.AnalyzedToken, len(segments))
+	for i, segment := range segments {
+		tokens[i] = types.AnalyzedToken{
+			Text:  segment.Token().Text(),
+			Start: segment.Start(),
+			End:   segment.End(),
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Jarlene/wukong/types"
+	"math"
+	"sort"
+)
+
+// 一个聚合请求在一个shard中的统计状态
+type aggregator struct {
+	request types.AggregationRequest
+	result  types.Aggregation
+	buckets map[types.AttributeValue]int
+}
+
+// 为各聚合请求建立统计状态
+func newAggregators(requests []types.AggregationRequest) []*aggregator {
+	if len(requests) == 0 {
+		return nil
+	}
+	aggregators := make([]*aggregator, len(requests))
+	for i, request := range requests {
+		aggregators[i] = &aggregator{
+			request: request,
+			result:  types.Aggregation{Attribute: request.Attribute},
+		}
+		if request.Interval > 0 || request.DateInterval > 0 {
+			aggregators[i].buckets = make(map[types.AttributeValue]int)
+		}
+	}
+	return aggregators
+}
+
+// 统计一个满足条件的文档
+func (a *aggregator) add(state *docState) {
+	value, found := state.attributes[a.request.Attribute]
+	if !found {
+		return
+	}
+	result := &a.result
+	if result.Count == 0 || value.Compare(result.Min) < 0 {
+		result.Min = value
+	}
+	if result.Count == 0 || value.Compare(result.Max) > 0 {
+		result.Max = value
+	}
+	result.Count++
+	result.Sum += value.Float64()
+	if a.buckets != nil {
+		a.buckets[bucketKey(a.request, value)]++
+	}
+}
+
+// 属性值所在桶的下界
+func bucketKey(request types.AggregationRequest, value types.AttributeValue) types.AttributeValue {
+	if request.DateInterval > 0 {
+		nanos := value.Int
+		if value.IsFloat {
+			nanos = int64(value.Float)
+		}
+		interval := int64(request.DateInterval)
+		key := nanos / interval * interval
+		if nanos < 0 && key != nanos {
+			key -= interval
+		}
+		return types.AttributeValue{Int: key}
+	}
+	return types.AttributeValue{IsFloat: true, Float: math.Floor(value.Float64()/request.Interval) * request.Interval}
+}
+
+// 返回一个shard的统计结果，桶按下界从小到大排列
+func (a *aggregator) finish() types.Aggregation {
+	result := a.result
+	if result.Count > 0 {
+		result.Avg = result.Sum / float64(result.Count)
+	}
+	if a.buckets != nil {
+		result.Buckets = make([]types.Bucket, 0, len(a.buckets))
+		for key, numDocs := range a.buckets {
+			result.Buckets = append(result.Buckets, types.Bucket{Key: key, NumDocs: numDocs})
+		}
+		sort.Sort(types.Buckets(result.Buckets))
+	}
+	return result
+}
+
+func finishAggregators(aggregators []*aggregator) []types.Aggregation {
+	if aggregators == nil {
+		return nil
+	}
+	result := make([]types.Aggregation, len(aggregators))
+	for i, a := range aggregators {
+		result[i] = a.finish()
+	}
+	return result
+}
+
+// 合并各shard的聚合结果：文档数、总和与各桶的文档数相加，重新计算平均值
+func MergeAggregations(requests []types.AggregationRequest, shardAggregations [][]types.Aggregation) []types.Aggregation {
+	if len(requests) == 0 {
+		return nil
+	}
+	result := make([]types.Aggregation, len(requests))
+	for i, request := range requests {
+		merged := types.Aggregation{Attribute: request.Attribute}
+		var buckets map[types.AttributeValue]int
+		if request.Interval > 0 || request.DateInterval > 0 {
+			buckets = make(map[types.AttributeValue]int)
+		}
+		for _, shard := range shardAggregations {
+			if i >= len(shard) || shard[i].Count == 0 {
+				continue
+			}
+			aggregation := shard[i]
+			if merged.Count == 0 || aggregation.Min.Compare(merged.Min) < 0 {
+				merged.Min = aggregation.Min
+			}
+			if merged.Count == 0 || aggregation.Max.Compare(merged.Max) > 0 {
+				merged.Max = aggregation.Max
+			}
+			merged.Count += aggregation.Count
+			merged.Sum += aggregation.Sum
+			for _, bucket := range aggregation.Buckets {
+				buckets[bucket.Key] += bucket.NumDocs
+			}
+		}
+		if merged.Count > 0 {
+			merged.Avg = merged.Sum / float64(merged.Count)
+		}
+		if buckets != nil {
+			merged.Buckets = make([]types.Bucket, 0, len(buckets))
+			for key, numDocs := range buckets {
+				merged.Buckets = append(merged.Buckets, types.Bucket{Key: key, NumDocs: numDocs})
+			}
+			sort.Sort(types.Buckets(merged.Buckets))
+		}
+		result[i] = merged
+	}
+	return result
+}
+
+var errAggregationAttribute = errors.New("聚合的属性名不能为空")
+
+// 检查聚合请求，属性名为空、桶宽度为负数或者同时设置了Interval和DateInterval时返回错误
+func ValidateAggregations(requests []types.AggregationRequest) error {
+	for _, request := range requests {
+		if request.Attribute == "" {
+			return errAggregationAttribute
+		}
+		if request.Interval < 0 || math.IsNaN(request.Interval) || math.IsInf(request.Interval, 0) || request.DateInterval < 0 {
+			return fmt.Errorf("属性%s的聚合桶宽度不正确", request.Attribute)
+		}
+		if request.Interval > 0 && request.DateInterval > 0 {
+			return fmt.Errorf("属性%s的聚合不能同时设置Interval和DateInterval", request.Attribute)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"github.com/Jarlene/wukong/types"
+)
+
+// 返回文档的数值属性
+func (indexer *Indexer) Attribute(docId uint64, name string) (value types.AttributeValue, found bool) {
+	if state := indexer.currentDocs().get(docId); state != nil {
+		value, found = state.attributes[name]
+	}
+	return
+}
+
+// 转换了边界的范围条件
+type rangeFilter struct {
+	attribute                  string
+	min, max                   *types.AttributeValue
+	exclusiveMin, exclusiveMax bool
+}
+
+// 转换范围条件的边界，边界的类型不支持时返回错误
+func compileFilters(filters []types.RangeFilter) ([]rangeFilter, error) {
+	compiled := make([]rangeFilter, len(filters))
+	for i, filter := range filters {
+		min, err := filterBound(filter.Attribute, filter.Min)
+		if err != nil {
+			return nil, err
+		}
+		max, err := filterBound(filter.Attribute, filter.Max)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = rangeFilter{
+			attribute:    filter.Attribute,
+			min:          min,
+			max:          max,
+			exclusiveMin: filter.ExclusiveMin,
+			exclusiveMax: filter.ExclusiveMax,
+		}
+	}
+	return compiled, nil
+}
+
+// 转换范围条件的一个边界，bound为nil时返回nil
+func filterBound(attribute string, bound interface{}) (*types.AttributeValue, error) {
+	if bound == nil {
+		return nil, nil
+	}
+	value, ok := types.NewAttributeValue(bound)
+	if !ok {
+		return nil, fmt.Errorf("属性%s的范围条件类型不支持: %T", attribute, bound)
+	}
+	return &value, nil
+}
+
+// 文档是否满足全部范围条件
+func matchFilters(state *docState, filters []rangeFilter) bool {
+	for i := range filters {
+		filter := &filters[i]
+		value, found := state.attributes[filter.attribute]
+		if !found {
+			return false
+		}
+		if filter.min != nil {
+			if c := value.Compare(*filter.min); c < 0 || (c == 0 && filter.exclusiveMin) {
+				return false
+			}
+		}
+		if filter.max != nil {
+			if c := value.Compare(*filter.max); c > 0 || (c == 0 && filter.exclusiveMax) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 检查范围条件的边界类型，不支持时返回错误
+func ValidateFilters(filters []types.RangeFilter) error {
+	for _, filter := range filters {
+		for _, bound := range []interface{}{filter.Min, filter.Max} {
+			if _, err := filterBound(filter.Attribute, bound); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,69 +2,104 @@ package core
 
 import (
 	"github.com/Jarlene/wukong/types"
-	"sync"
+	"sort"
 )
 
-// 文档信息[shard][id]info
-var DocInfoGroup = make(map[int]*types.DocInfosShard)
-var docInfosGroupRWMutex sync.RWMutex
-
-func AddDocInfosShard(shard int) {
-	docInfosGroupRWMutex.Lock()
-	defer docInfosGroupRWMutex.Unlock()
-	if _, found := DocInfoGroup[shard]; !found {
-		DocInfoGroup[shard] = &types.DocInfosShard{
-			DocInfos: make(map[uint64]*types.DocInfo),
-		}
+// 新建一个空的文档信息表
+func NewDocInfosShard() *types.DocInfosShard {
+	return &types.DocInfosShard{
+		DocInfos: make(map[uint64]*types.DocInfo),
 	}
 }
 
-func AddDocInfo(shard int, docId uint64, docinfo *types.DocInfo) {
-	docInfosGroupRWMutex.Lock()
-	defer docInfosGroupRWMutex.Unlock()
-	if _, ok := DocInfoGroup[shard]; !ok {
-		DocInfoGroup[shard] = &types.DocInfosShard{
-			DocInfos: make(map[uint64]*types.DocInfo),
-		}
+// 新建一个空的反向索引表
+func NewInvertedIndexShard() *types.InvertedIndexShard {
+	return &types.InvertedIndexShard{}
+}
+
+// 直接载入一个文档的信息，用于从持久存储恢复
+// 载入完成后需调用Reconcile使反向索引和文档信息保持一致
+func (indexer *Indexer) LoadDocInfo(docId uint64, docInfo *types.DocInfo) {
+	indexer.DocInfosShard.Lock()
+	defer indexer.DocInfosShard.Unlock()
+	if _, found := indexer.DocInfosShard.DocInfos[docId]; !found {
+		indexer.DocInfosShard.NumDocuments++
 	}
-	DocInfoGroup[shard].DocInfos[docId] = docinfo
-	DocInfoGroup[shard].NumDocuments++
+	// 数值属性和地理坐标属性在Reconcile时移到文档状态表中，不留在文档信息中
+	loaded := *docInfo
+	indexer.DocInfosShard.DocInfos[docId] = &loaded
 }
 
-// func IsDocExist(docId uint64) bool {
-// 	docInfosGroupRWMutex.RLock()
-// 	defer docInfosGroupRWMutex.RUnlock()
-// 	for _, docInfosShard := range DocInfoGroup {
-// 		_, found := docInfosShard.DocInfos[docId]
-// 		if found {
-// 			return true
-// 		}
-// 	}
-// 	return false
-// }
+// 直接载入一个搜索键的反向索引行，用于从持久存储恢复
+// 载入完成后需调用Reconcile使反向索引和文档信息保持一致
+func (indexer *Indexer) LoadKeywordIndices(keyword string, keywordIndices *types.KeywordIndices) {
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+	if indexer.loaded == nil {
+		indexer.loaded = make(map[string]*types.PostingList)
+	}
+	indexer.loaded[keyword] = compressPostings(keywordIndices, nil)
+}
 
-// 反向索引表([shard][关键词]反向索引表)
-var InvertedIndexGroup = make(map[int]*types.InvertedIndexShard)
-var invertedIndexGroupRWMutex sync.RWMutex
+// 返回搜索键的反向索引中DocId在[lowerBound, upperBound)范围内的有效索引项，upperBound为0时不设上界
+// 只解压各段中和范围有关的块。搜索键不包含任何文档时found为false
+func (indexer *Indexer) Postings(keyword string, lowerBound, upperBound uint64) (indices *types.KeywordIndices, found bool) {
+	indexer.InvertedIndexShard.RLock()
+	view := indexer.newIndexView(map[string]bool{keyword: true})
+	indexer.InvertedIndexShard.RUnlock()
+	term := view.term(keyword)
+	if term == nil {
+		return nil, false
+	}
 
-func AddInvertedIndexShard(shard int) {
-	invertedIndexGroupRWMutex.Lock()
-	defer invertedIndexGroupRWMutex.Unlock()
-	if _, found := InvertedIndexGroup[shard]; !found {
-		InvertedIndexGroup[shard] = &types.InvertedIndexShard{
-			InvertedIndex: make(map[string]*types.KeywordIndices),
+	indices = new(types.KeywordIndices)
+	sorted := true
+	for k, list := range term.lists {
+		for i := findPostingBlock(list, lowerBound); i < len(list.Blocks); i++ {
+			if upperBound != 0 && list.FirstDocIds[i] >= upperBound {
+				break
+			}
+			block := decodePostingBlock(list, i, true)
+			for j, docId := range block.DocIds {
+				if docId < lowerBound || (upperBound != 0 && docId >= upperBound) ||
+					!view.docs.isLive(term.segments[k], docId) {
+					continue
+				}
+				if n := len(indices.DocIds); n > 0 && indices.DocIds[n-1] > docId {
+					sorted = false
+				}
+				indices.DocIds = append(indices.DocIds, docId)
+				if len(block.Frequencies) > 0 {
+					indices.Frequencies = append(indices.Frequencies, block.Frequencies[j])
+				}
+				if len(block.Locations) > 0 {
+					indices.Locations = append(indices.Locations, block.Locations[j])
+					indices.Positions = append(indices.Positions, block.Positions[j])
+				}
+			}
 		}
 	}
+	if !sorted {
+		sort.Sort(indicesByDocId{indices})
+	}
+	return indices, true
 }
 
-func AddKeywordIndices(shard int, keyword string, keywordIndices *types.KeywordIndices) {
-	invertedIndexGroupRWMutex.Lock()
-	defer invertedIndexGroupRWMutex.Unlock()
-	if _, ok := InvertedIndexGroup[shard]; !ok {
-		InvertedIndexGroup[shard] = &types.InvertedIndexShard{
-			InvertedIndex: make(map[string]*types.KeywordIndices),
+// 估计反向索引占用的内存字节数，以及不压缩时需要的字节数。缓冲区同时保存未压缩和压缩的形式
+func (indexer *Indexer) PostingsSize() (compressed, uncompressed int) {
+	indexer.InvertedIndexShard.RLock()
+	defer indexer.InvertedIndexShard.RUnlock()
+	for _, seg := range indexer.segments {
+		for _, list := range seg.index {
+			c, u := postingsSize(list)
+			compressed += c
+			uncompressed += u
 		}
 	}
-	InvertedIndexGroup[shard].InvertedIndex[keyword] = keywordIndices
-	InvertedIndexGroup[shard].TotalTokenLength++
+	for _, list := range indexer.buffer.compressed {
+		c, u := postingsSize(list)
+		compressed += c + u
+		uncompressed += u
+	}
+	return
 }
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"sort"
+	"strings"
+)
+
+// 搜索键词典：按字节序排列的全部搜索键，和反向索引表一起维护，用于前缀查找
+//
+// 新加入的搜索键先记入newKeywords，查找时再排序并合并到keywords中；
+// 不再包含任何文档的搜索键在查找时跳过，下次合并时清除。受InvertedIndexShard的锁保护
+type dictionary struct {
+	keywords    []string
+	newKeywords []string
+	// 是否有搜索键不再包含任何文档
+	stale bool
+}
+
+// 记录一个新出现的搜索键，调用者需持有反向索引表的写锁
+func (indexer *Indexer) addToDictionary(keyword string) {
+	indexer.dictionary.newKeywords = append(indexer.dictionary.newKeywords, keyword)
+}
+
+// 将新出现的搜索键合并到词典中，并清除不再包含任何文档的搜索键，调用者需持有反向索引表的写锁
+func (indexer *Indexer) mergeDictionary() {
+	dict := &indexer.dictionary
+	sort.Strings(dict.newKeywords)
+	merged := make([]string, 0, len(dict.keywords)+len(dict.newKeywords))
+	i, j := 0, 0
+	for i < len(dict.keywords) || j < len(dict.newKeywords) {
+		var keyword string
+		if j == len(dict.newKeywords) || (i < len(dict.keywords) && dict.keywords[i] < dict.newKeywords[j]) {
+			keyword = dict.keywords[i]
+			i++
+		} else {
+			keyword = dict.newKeywords[j]
+			j++
+		}
+
+		// 删除后重新加入的搜索键会出现两次
+		if len(merged) > 0 && merged[len(merged)-1] == keyword {
+			continue
+		}
+		if dict.stale && indexer.docFreqs[keyword] == 0 {
+			continue
+		}
+		merged = append(merged, keyword)
+	}
+	dict.keywords = merged
+	dict.newKeywords = nil
+	dict.stale = false
+}
+
+// 查找以prefix开头的搜索键，返回搜索键及包含它的（未删除的）文档数，按字节序排列
+// 只在具名字段中查找的搜索键（见types.FieldToken）仅当prefix包含字段名和分隔符时返回
+// 标签搜索键（见types.LabelToken）仅当prefix以types.LabelPrefix开头时返回
+func (indexer *Indexer) Suggest(prefix string) []types.Suggestion {
+	if indexer.initialized == false {
+		return nil
+	}
+
+	// 词典有变化时需要写锁来合并
+	indexer.InvertedIndexShard.RLock()
+	if len(indexer.dictionary.newKeywords) > 0 || indexer.dictionary.stale {
+		indexer.InvertedIndexShard.RUnlock()
+		indexer.InvertedIndexShard.Lock()
+		defer indexer.InvertedIndexShard.Unlock()
+		indexer.mergeDictionary()
+	} else {
+		defer indexer.InvertedIndexShard.RUnlock()
+	}
+
+	var suggestions []types.Suggestion
+	keywords := indexer.dictionary.keywords
+	fieldScoped := strings.Contains(prefix, types.FieldSeparator)
+	labelScoped := strings.HasPrefix(prefix, types.LabelPrefix)
+	for i := sort.SearchStrings(keywords, prefix); i < len(keywords) && strings.HasPrefix(keywords[i], prefix); i++ {
+		if (!fieldScoped && strings.Contains(keywords[i], types.FieldSeparator)) ||
+			(!labelScoped && strings.HasPrefix(keywords[i], types.LabelPrefix)) {
+			continue
+		}
+		if numDocs := indexer.docFreqs[keywords[i]]; numDocs > 0 {
+			suggestions = append(suggestions, types.Suggestion{Text: keywords[i], NumDocs: numDocs})
+		}
+	}
+	return suggestions
+}
+
+// 修改搜索键的文档数并相应地维护词典，调用者需持有反向索引表的写锁
+func (indexer *Indexer) updateDocFreq(keyword string, delta int) {
+	if delta == 0 {
+		return
+	}
+	before := indexer.docFreqs[keyword]
+	after := before + delta
+	if after > 0 {
+		indexer.docFreqs[keyword] = after
+		if before == 0 {
+			indexer.addToDictionary(keyword)
+		}
+		return
+	}
+	delete(indexer.docFreqs, keyword)
+	indexer.dictionary.stale = true
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"math/bits"
+)
+
+// 文档状态表：查找时需要的每个文档的状态，按DocId的散列值组织为32叉的前缀树
+//
+// 表不可修改，加入和删除文档时只复制从根到文档所在分支的路径，得到新的表，旧的表仍然有效。
+// 持有写入锁的一方修改后在反向索引表的写锁下发布新的表（Indexer.docs），
+// 查找时和段列表、缓冲区一起在读锁下取得，此后读取文档状态不需要任何锁。
+
+// 每层使用的散列值位数
+const docTableBits = 5
+
+// 一个文档的状态，加入表后不再修改
+type docState struct {
+	// 文档当前版本的序号
+	seq uint64
+
+	tokenLength       float32
+	fieldTokenLengths map[string]float32
+	attributes        map[string]types.AttributeValue
+	geoPoints         map[string]types.GeoPoint
+}
+
+type docTable struct {
+	root *docNode
+	size int
+}
+
+// 前缀树的节点，bitmap的第i位表示第i个分支是否存在，children按分支的序号排列
+type docNode struct {
+	bitmap   uint32
+	children []docEntry
+}
+
+// 一个分支：node不为nil时为子节点，否则为一个文档
+type docEntry struct {
+	node  *docNode
+	docId uint64
+	state *docState
+}
+
+// DocId的散列值（splitmix64的最后一步，是一一映射），使连续或者间隔固定的DocId均匀分布在各分支中
+func docHash(docId uint64) uint64 {
+	x := docId
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// 散列值在第shift位开始的分支对应的位
+func docBranch(hash uint64, shift uint) uint32 {
+	return 1 << (hash >> shift & (1<<docTableBits - 1))
+}
+
+// 返回文档的状态，文档不存在时返回nil
+func (table *docTable) get(docId uint64) *docState {
+	hash := docHash(docId)
+	node := table.root
+	for shift := uint(0); node != nil; shift += docTableBits {
+		bit := docBranch(hash, shift)
+		if node.bitmap&bit == 0 {
+			return nil
+		}
+		entry := &node.children[bits.OnesCount32(node.bitmap&(bit-1))]
+		if entry.node == nil {
+			if entry.docId == docId {
+				return entry.state
+			}
+			return nil
+		}
+		node = entry.node
+	}
+	return nil
+}
+
+// 返回设置了文档状态的新表
+func (table *docTable) set(docId uint64, state *docState) *docTable {
+	root, added := table.root.set(docHash(docId), 0, docId, state)
+	result := &docTable{root: root, size: table.size}
+	if added {
+		result.size++
+	}
+	return result
+}
+
+// 返回删除了文档的新表，文档不存在时返回原表
+func (table *docTable) remove(docId uint64) *docTable {
+	root, removed := table.root.remove(docHash(docId), 0, docId)
+	if !removed {
+		return table
+	}
+	return &docTable{root: root, size: table.size - 1}
+}
+
+// 复制节点并设置文档状态，node可以为nil。added表示文档原来不存在
+func (node *docNode) set(hash uint64, shift uint, docId uint64, state *docState) (copied *docNode, added bool) {
+	if node == nil {
+		node = new(docNode)
+	}
+	bit := docBranch(hash, shift)
+	index := bits.OnesCount32(node.bitmap & (bit - 1))
+	if node.bitmap&bit == 0 {
+		copied = &docNode{bitmap: node.bitmap | bit, children: make([]docEntry, len(node.children)+1)}
+		copy(copied.children, node.children[:index])
+		copied.children[index] = docEntry{docId: docId, state: state}
+		copy(copied.children[index+1:], node.children[index:])
+		return copied, true
+	}
+
+	copied = &docNode{bitmap: node.bitmap, children: append([]docEntry{}, node.children...)}
+	entry := &copied.children[index]
+	switch {
+	case entry.node != nil:
+		entry.node, added = entry.node.set(hash, shift+docTableBits, docId, state)
+	case entry.docId == docId:
+		entry.state = state
+	default:
+		// 两个文档在这一层落在同一分支，向下一层分开。散列值各不相同，最多到第64位一定分开
+		child, _ := (*docNode)(nil).set(docHash(entry.docId), shift+docTableBits, entry.docId, entry.state)
+		child, _ = child.set(hash, shift+docTableBits, docId, state)
+		*entry = docEntry{node: child}
+		added = true
+	}
+	return copied, added
+}
+
+// 复制节点并删除文档，删除后为空的节点返回nil，只剩一个文档的子节点并入上一层
+func (node *docNode) remove(hash uint64, shift uint, docId uint64) (copied *docNode, removed bool) {
+	if node == nil {
+		return nil, false
+	}
+	bit := docBranch(hash, shift)
+	if node.bitmap&bit == 0 {
+		return node, false
+	}
+	index := bits.OnesCount32(node.bitmap & (bit - 1))
+	entry := node.children[index]
+	if entry.node != nil {
+		child, removed := entry.node.remove(hash, shift+docTableBits, docId)
+		if !removed {
+			return node, false
+		}
+		if child != nil {
+			copied = &docNode{bitmap: node.bitmap, children: append([]docEntry{}, node.children...)}
+			if len(child.children) == 1 && child.children[0].node == nil {
+				copied.children[index] = child.children[0]
+			} else {
+				copied.children[index] = docEntry{node: child}
+			}
+			return copied, true
+		}
+	} else if entry.docId != docId {
+		return node, false
+	}
+
+	if len(node.children) == 1 {
+		return nil, true
+	}
+	copied = &docNode{bitmap: node.bitmap &^ bit, children: make([]docEntry, 0, len(node.children)-1)}
+	copied.children = append(append(copied.children, node.children[:index]...), node.children[index+1:]...)
+	return copied, true
+}
+
+// 文档在段中的索引项是否有效
+func (table *docTable) isLive(seg *segment, docId uint64) bool {
+	state := table.get(docId)
+	return state != nil && state.seq >= seg.minSeq && state.seq <= seg.maxSeq
+}
+
+// 文档的关键词长度
+func (table *docTable) tokenLength(docId uint64) float32 {
+	if state := table.get(docId); state != nil {
+		return state.tokenLength
+	}
+	return 0
+}
+
+// 当前的文档状态表
+func (indexer *Indexer) currentDocs() *docTable {
+	indexer.InvertedIndexShard.RLock()
+	defer indexer.InvertedIndexShard.RUnlock()
+	return indexer.docs
+}
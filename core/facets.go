@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/Jarlene/wukong/types"
+	"sort"
+	"strings"
+)
+
+var errFacetPrefix = errors.New("分面统计的前缀不能为空")
+
+// 检查分面统计请求，前缀为空时返回错误
+func ValidateFacets(facets []types.FacetRequest) error {
+	for _, facet := range facets {
+		if facet.Prefix == "" {
+			return errFacetPrefix
+		}
+	}
+	return nil
+}
+
+// 找出各分面请求统计的标签搜索键（见types.LabelToken）并加入terms，调用者需持有反向索引表的读锁
+// 词典中尚未合并的搜索键逐个检查，因此不需要写锁
+func (indexer *Indexer) facetKeywords(facets []types.FacetRequest, terms map[string]bool) [][]string {
+	if len(facets) == 0 {
+		return nil
+	}
+	dict := &indexer.dictionary
+	result := make([][]string, len(facets))
+	for i, facet := range facets {
+		prefix := types.LabelToken(facet.Prefix)
+		found := make(map[string]bool)
+		add := func(keyword string) {
+			if found[keyword] || indexer.docFreqs[keyword] == 0 {
+				return
+			}
+			found[keyword] = true
+			result[i] = append(result[i], keyword)
+			terms[keyword] = true
+		}
+		keywords := dict.keywords
+		for j := sort.SearchStrings(keywords, prefix); j < len(keywords) && strings.HasPrefix(keywords[j], prefix); j++ {
+			add(keywords[j])
+		}
+		for _, keyword := range dict.newKeywords {
+			if strings.HasPrefix(keyword, prefix) {
+				add(keyword)
+			}
+		}
+	}
+	return result
+}
+
+// 统计matchedDocIds（按DocId从小到大排列）中包含各标签的文档数，keywords为facetKeywords的返回值
+// 每个标签的反向索引行和matchedDocIds同时按DocId顺序遍历，每块只解压一次
+// 结果未截断，由调用者合并各shard后再取前TopN个
+func countFacets(ctx context.Context, view *indexView, matchedDocIds []uint64,
+	facets []types.FacetRequest, keywords [][]string) ([]types.Facet, error) {
+	if len(facets) == 0 {
+		return nil, nil
+	}
+	result := make([]types.Facet, len(facets))
+	for i, facet := range facets {
+		result[i].Prefix = facet.Prefix
+		if len(matchedDocIds) == 0 {
+			continue
+		}
+		for _, keyword := range keywords[i] {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			numDocs := countIntersection(view.newDocIdIterator(view.term(keyword)), matchedDocIds)
+			if numDocs > 0 {
+				label := strings.TrimPrefix(keyword, types.LabelPrefix)
+				result[i].Counts = append(result[i].Counts, types.FacetCount{Label: label, NumDocs: numDocs})
+			}
+		}
+		sort.Sort(types.FacetCounts(result[i].Counts))
+	}
+	return result, nil
+}
+
+// 迭代器和docIds（按从小到大排列）中共同的文档数，任何一方遍历完即结束
+func countIntersection(iterator *docIdIterator, docIds []uint64) int {
+	numDocs, j := 0, 0
+	for docId, ok := iterator.next(); ok && j < len(docIds); docId, ok = iterator.next() {
+		for j < len(docIds) && docIds[j] < docId {
+			j++
+		}
+		if j < len(docIds) && docIds[j] == docId {
+			numDocs++
+			j++
+		}
+	}
+	return numDocs
+}
+
+// 合并各shard的分面统计结果，对同一个标签的文档数求和，再按各请求的TopN截断
+func MergeFacets(facets []types.FacetRequest, shardFacets [][]types.Facet) []types.Facet {
+	if len(facets) == 0 {
+		return nil
+	}
+	result := make([]types.Facet, len(facets))
+	for i, facet := range facets {
+		numDocs := make(map[string]int)
+		for _, shard := range shardFacets {
+			if i >= len(shard) {
+				continue
+			}
+			for _, count := range shard[i].Counts {
+				numDocs[count.Label] += count.NumDocs
+			}
+		}
+		counts := make(types.FacetCounts, 0, len(numDocs))
+		for label, num := range numDocs {
+			counts = append(counts, types.FacetCount{Label: label, NumDocs: num})
+		}
+		sort.Sort(counts)
+		if facet.TopN > 0 && len(counts) > facet.TopN {
+			counts = counts[:facet.TopN]
+		}
+		result[i] = types.Facet{Prefix: facet.Prefix, Counts: counts}
+	}
+	return result
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"sort"
+)
+
+// 用BM25F为文档评分时需要的字段统计和游标
+//
+// 不限字段的关键词在各具名字段中的词频按字段的权重和长度归一化后相加，剩余的词频属于Content；
+// 只在一个字段中查找的关键词只计算该字段
+type fieldScorer struct {
+	// 索引中的具名字段，按名称排序
+	names []string
+
+	// 各字段的权重和平均关键词长度，最后一个为Content
+	boosts     []float32
+	avgLengths []float32
+
+	// cursors[i][j]为第i个关键词在第j个字段中的游标，只在一个字段中查找的关键词为nil
+	cursors [][]*termCursor
+}
+
+// 调整各具名字段的总关键词长度，sign为1时加上lengths、为-1时减去，调用者需持有反向索引表的写锁
+func (indexer *Indexer) addFieldTokenLengths(lengths map[string]float32, sign float32) {
+	if len(lengths) == 0 {
+		return
+	}
+	totals := indexer.InvertedIndexShard.FieldTokenLengths
+	if totals == nil {
+		totals = make(map[string]float32)
+		indexer.InvertedIndexShard.FieldTokenLengths = totals
+	}
+	for field, length := range lengths {
+		totals[field] += sign * length
+		if totals[field] <= 0 {
+			delete(totals, field)
+		}
+	}
+}
+
+// 在terms中加入不限字段的关键词在各具名字段中的搜索键，返回各字段总关键词长度的副本
+// 索引中没有具名字段或者不计算BM25时返回nil。调用者需持有反向索引表的读锁
+func (indexer *Indexer) addFieldTerms(tokens []string, terms map[string]bool) map[string]float32 {
+	if len(indexer.InvertedIndexShard.FieldTokenLengths) == 0 || indexer.initOptions.IndexType == types.DocIdsIndex {
+		return nil
+	}
+	fieldLengths := make(map[string]float32, len(indexer.InvertedIndexShard.FieldTokenLengths))
+	for field, length := range indexer.InvertedIndexShard.FieldTokenLengths {
+		fieldLengths[field] = length
+	}
+	for _, token := range tokens {
+		if field, _ := types.SplitFieldToken(token); field != "" {
+			continue
+		}
+		for field := range fieldLengths {
+			terms[types.FieldToken(field, token)] = true
+		}
+	}
+	return fieldLengths
+}
+
+// fieldLengths为addFieldTerms的返回值，为nil时返回nil
+func (indexer *Indexer) newFieldScorer(view *indexView, tokens []string,
+	fieldLengths map[string]float32, totalTokenLength float32) *fieldScorer {
+	if fieldLengths == nil {
+		return nil
+	}
+	numDocuments := float32(view.docs.size)
+	scorer := new(fieldScorer)
+	for field := range fieldLengths {
+		scorer.names = append(scorer.names, field)
+	}
+	sort.Strings(scorer.names)
+	contentLength := totalTokenLength
+	for _, field := range scorer.names {
+		scorer.boosts = append(scorer.boosts, indexer.fieldBoost(field))
+		scorer.avgLengths = append(scorer.avgLengths, fieldLengths[field]/numDocuments)
+		contentLength -= fieldLengths[field]
+	}
+	scorer.boosts = append(scorer.boosts, indexer.fieldBoost(""))
+	scorer.avgLengths = append(scorer.avgLengths, contentLength/numDocuments)
+
+	scorer.cursors = make([][]*termCursor, len(tokens))
+	for i, token := range tokens {
+		if field, _ := types.SplitFieldToken(token); field != "" {
+			continue
+		}
+		scorer.cursors[i] = make([]*termCursor, len(scorer.names))
+		for j, field := range scorer.names {
+			scorer.cursors[i][j] = view.newTermCursor(view.term(types.FieldToken(field, token)), true)
+		}
+	}
+	return scorer
+}
+
+// 字段在BM25F中的权重，空字符串为Content
+func (indexer *Indexer) fieldBoost(field string) float32 {
+	if boost, found := indexer.initOptions.FieldBoosts[field]; found {
+		return boost
+	}
+	return 1
+}
+
+// 第j个字段中的词频按权重和字段长度归一化的结果
+func (scorer *fieldScorer) weight(b float32, j int, frequency, length float32) float32 {
+	if frequency <= 0 {
+		return 0
+	}
+	if scorer.avgLengths[j] <= 0 {
+		return scorer.boosts[j] * frequency
+	}
+	return scorer.boosts[j] * frequency / (1 - b + b*length/scorer.avgLengths[j])
+}
+
+// 第i个关键词对文档BM25F的贡献，frequency为该搜索键的词频，state为文档在快照中的状态
+func (scorer *fieldScorer) bm25(view *indexView, state *docState, docId uint64, i int, token string, numDocs int, frequency float32) float32 {
+	indexer := view.indexer
+	params := indexer.initOptions.BM25Parameters
+	if numDocs <= 0 || frequency <= 0 || params == nil {
+		return 0
+	}
+
+	var weighted float32
+	if scorer.cursors[i] == nil {
+		// 只在一个字段中查找
+		field, _ := types.SplitFieldToken(token)
+		j := sort.SearchStrings(scorer.names, field)
+		if j == len(scorer.names) || scorer.names[j] != field {
+			return 0
+		}
+		weighted = scorer.weight(params.B, j, frequency, state.fieldTokenLengths[field])
+	} else {
+		contentLength := state.tokenLength
+		for j, cursor := range scorer.cursors[i] {
+			fieldLength := state.fieldTokenLengths[scorer.names[j]]
+			contentLength -= fieldLength
+			if segmentCursor, position, found := cursor.seek(docId); found {
+				fieldFrequency := indexer.termFrequency(segmentCursor, position)
+				weighted += scorer.weight(params.B, j, fieldFrequency, fieldLength)
+				frequency -= fieldFrequency
+			}
+		}
+		weighted += scorer.weight(params.B, len(scorer.names), frequency, contentLength)
+	}
+	if weighted <= 0 {
+		return 0
+	}
+	return view.idf(numDocs) * weighted * (params.K1 + 1) / (params.K1 + weighted)
+}
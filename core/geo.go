@@ -0,0 +1,202 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Jarlene/wukong/types"
+	"math"
+	"sort"
+)
+
+// 网格的边长（度），约11公里
+const geoCellDegrees = 0.1
+
+// 范围覆盖的网格超过这个数时不用网格预先筛选，只逐个文档精确计算
+const maxGeoCells = 1 << 12
+
+// 经纬度网格中的一格
+type geoCell struct {
+	lat, lon int32
+}
+
+func cellOf(point types.GeoPoint) geoCell {
+	return geoCell{
+		lat: int32(math.Floor(point.Lat / geoCellDegrees)),
+		lon: int32(math.Floor(point.Lon / geoCellDegrees)),
+	}
+}
+
+// 一个地理坐标属性的列：按网格分组的文档，用于预先筛选候选文档，文档的坐标在文档状态表中
+type geoColumn map[geoCell]map[uint64]bool
+
+// 按文档原来的坐标old和现在的坐标points更新各列的网格，调用者需持有写入锁和反向索引表的写锁
+func (indexer *Indexer) updateGeoCells(docId uint64, old, points map[string]types.GeoPoint) {
+	for name, point := range old {
+		if newPoint, found := points[name]; found && cellOf(newPoint) == cellOf(point) {
+			continue
+		}
+		column := indexer.geoCells[name]
+		cell := cellOf(point)
+		delete(column[cell], docId)
+		if len(column[cell]) == 0 {
+			delete(column, cell)
+		}
+		if len(column) == 0 {
+			delete(indexer.geoCells, name)
+		}
+	}
+	for name, point := range points {
+		if oldPoint, found := old[name]; found && cellOf(oldPoint) == cellOf(point) {
+			continue
+		}
+		column, found := indexer.geoCells[name]
+		if !found {
+			column = make(geoColumn)
+			indexer.geoCells[name] = column
+		}
+		cell := cellOf(point)
+		if column[cell] == nil {
+			column[cell] = make(map[uint64]bool)
+		}
+		column[cell][docId] = true
+	}
+}
+
+// 返回文档的地理坐标属性
+func (indexer *Indexer) GeoPoint(docId uint64, name string) (point types.GeoPoint, found bool) {
+	if state := indexer.currentDocs().get(docId); state != nil {
+		point, found = state.geoPoints[name]
+	}
+	return
+}
+
+// 文档到distanceSort.Center的距离（米），没有该属性时为正无穷
+func (state *docState) distance(distanceSort *types.DistanceSort) float64 {
+	if point, found := state.geoPoints[distanceSort.Attribute]; found {
+		return point.Distance(distanceSort.Center)
+	}
+	return math.Inf(1)
+}
+
+// 转换后的地理范围条件
+type geoFilter struct {
+	attribute string
+	box       *types.GeoBox
+	center    *types.GeoPoint
+	radius    float64
+}
+
+// 转换地理范围条件，并用网格找出可能满足全部条件的候选文档，按DocId从小到大排列
+// 范围覆盖的网格过多时candidates为nil，表示不预先筛选。调用者需持有反向索引表的读锁
+func (indexer *Indexer) compileGeoFilters(filters []types.GeoFilter) (compiled []geoFilter, candidates []uint64) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	compiled = make([]geoFilter, len(filters))
+	for i, filter := range filters {
+		compiled[i] = geoFilter{
+			attribute: filter.Attribute,
+			box:       filter.Box,
+			center:    filter.Center,
+			radius:    filter.Radius,
+		}
+		column, found := indexer.geoCells[filter.Attribute]
+		if !found {
+			// 没有文档包含该属性
+			candidates = []uint64{}
+			continue
+		}
+		if docIds, ok := compiled[i].cellCandidates(column); ok && (candidates == nil || len(docIds) < len(candidates)) {
+			candidates = docIds
+		}
+	}
+	return
+}
+
+// 范围覆盖的网格中的文档，按DocId从小到大排列。网格过多时ok为false
+func (filter *geoFilter) cellCandidates(column geoColumn) (docIds []uint64, ok bool) {
+	box, ok := filter.boundingBox()
+	if !ok {
+		return nil, false
+	}
+	min, max := cellOf(box.Min), cellOf(box.Max)
+	if int64(max.lat-min.lat+1)*int64(max.lon-min.lon+1) > maxGeoCells {
+		return nil, false
+	}
+	docIds = []uint64{}
+	for lat := min.lat; lat <= max.lat; lat++ {
+		for lon := min.lon; lon <= max.lon; lon++ {
+			for docId := range column[geoCell{lat, lon}] {
+				docIds = append(docIds, docId)
+			}
+		}
+	}
+	sort.Sort(docIdsAscending(docIds))
+	return docIds, true
+}
+
+// 包含范围的经纬度矩形，圆形范围跨越极点或者180度经线时ok为false
+func (filter *geoFilter) boundingBox() (box types.GeoBox, ok bool) {
+	if filter.box != nil {
+		box = *filter.box
+	} else {
+		box = types.GeoBox{Min: types.GeoPoint{Lat: -90, Lon: -180}, Max: types.GeoPoint{Lat: 90, Lon: 180}}
+	}
+	if filter.center != nil {
+		dLat := filter.radius / types.EarthRadius * 180 / math.Pi
+		minLat, maxLat := filter.center.Lat-dLat, filter.center.Lat+dLat
+		if minLat <= -90 || maxLat >= 90 {
+			return box, filter.box != nil
+		}
+		dLon := dLat / math.Cos(math.Max(math.Abs(minLat), math.Abs(maxLat))*math.Pi/180)
+		minLon, maxLon := filter.center.Lon-dLon, filter.center.Lon+dLon
+		if minLon < -180 || maxLon > 180 {
+			return box, filter.box != nil
+		}
+		box.Min.Lat, box.Max.Lat = math.Max(box.Min.Lat, minLat), math.Min(box.Max.Lat, maxLat)
+		box.Min.Lon, box.Max.Lon = math.Max(box.Min.Lon, minLon), math.Min(box.Max.Lon, maxLon)
+		return box, true
+	}
+	return box, filter.box != nil
+}
+
+// 文档是否满足全部地理范围条件
+func matchGeoFilters(state *docState, filters []geoFilter) bool {
+	for i := range filters {
+		filter := &filters[i]
+		point, found := state.geoPoints[filter.attribute]
+		if !found {
+			return false
+		}
+		if filter.box != nil && !filter.box.Contains(point) {
+			return false
+		}
+		if filter.center != nil && point.Distance(*filter.center) > filter.radius {
+			return false
+		}
+	}
+	return true
+}
+
+var errGeoFilterAttribute = errors.New("地理范围条件的属性名不能为空")
+
+// 检查地理范围条件和距离排序的坐标，属性名为空、坐标超出范围、矩形的边界颠倒或者半径为负数时返回错误
+func ValidateGeoFilters(filters []types.GeoFilter, distanceSort *types.DistanceSort) error {
+	for _, filter := range filters {
+		if filter.Attribute == "" {
+			return errGeoFilterAttribute
+		}
+		if box := filter.Box; box != nil {
+			if !box.Min.Valid() || !box.Max.Valid() || box.Min.Lat > box.Max.Lat || box.Min.Lon > box.Max.Lon {
+				return fmt.Errorf("属性%s的矩形范围不正确: %v", filter.Attribute, *box)
+			}
+		}
+		if filter.Center != nil && (!filter.Center.Valid() || filter.Radius < 0 || math.IsNaN(filter.Radius)) {
+			return fmt.Errorf("属性%s的圆形范围不正确: %v %v", filter.Attribute, *filter.Center, filter.Radius)
+		}
+	}
+	if distanceSort != nil && !distanceSort.Center.Valid() {
+		return fmt.Errorf("属性%s的距离排序中心不正确: %v", distanceSort.Attribute, distanceSort.Center)
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/Jarlene/wukong/types"
 	"github.com/Jarlene/wukong/utils"
 	"log"
 	"math"
+	"sort"
+	"sync"
 )
 
 // 索引器
@@ -14,270 +19,492 @@ type Indexer struct {
 	initialized bool
 	// 文档信息
 	*types.DocInfosShard
-	// 反向索引
+	// 反向索引的统计和锁，反向索引本身见segments.go
 	*types.InvertedIndexShard
+
+	// 写入锁：加入、删除文档和压缩等修改操作依次进行，查找不需要这个锁
+	writeLock sync.Mutex
+	// 合并锁：后台合并和压缩不同时进行
+	mergeLock sync.Mutex
+	mergeChan chan bool
+
+	// 缓冲区和索引段，受InvertedIndexShard的锁保护，段列表只整体替换
+	buffer        *indexBuffer
+	segments      []*segment
+	maxBufferDocs int
+	// 各搜索键的（未删除的）文档数，受InvertedIndexShard的锁保护
+	docFreqs map[string]int
+	// 文档状态表，见doc_table.go。受InvertedIndexShard的锁保护，只有持有写入锁的一方发布新的表
+	docs    *docTable
+	nextSeq uint64
+	// 从持久存储载入、尚未调用Reconcile的反向索引行，受写入锁保护
+	loaded map[string]*types.PostingList
+
+	// 已删除但尚未从持久存储中清除的文档，受写入锁保护
+	removedDocs map[uint64]bool
+	// 正向索引：文档包含的搜索键，用于更新文档时清除旧记录，受写入锁保护
+	docKeywords map[uint64][]string
+	// 搜索键词典，受InvertedIndexShard的锁保护
+	dictionary dictionary
+	// 按属性名分列保存的地理坐标所在的网格，受InvertedIndexShard的锁保护，只有持有写入锁的一方修改
+	geoCells map[string]geoColumn
 }
 
-// 初始化索引器
+// 查找和排序时每处理这么多文档检查一次ctx是否已被取消
+const contextCheckInterval = 256
+
+var ErrIndexerInitialized = errors.New("索引器不能初始化两次")
+
+// 初始化索引器，出错时退出程序
 func (indexer *Indexer) Init(shard int, options types.IndexerInitOptions) {
+	if err := indexer.Open(shard, options); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 初始化索引器，重复初始化或者索引类型不正确时返回错误
+func (indexer *Indexer) Open(shard int, options types.IndexerInitOptions) error {
 	if indexer.initialized == true {
-		log.Fatal("索引器不能初始化两次")
+		return ErrIndexerInitialized
+	}
+	switch options.IndexType {
+	case types.DocIdsIndex, types.FrequenciesIndex, types.LocationsIndex:
+	default:
+		return fmt.Errorf("索引类型不正确: %d", options.IndexType)
 	}
 	indexer.initialized = true
 
 	indexer.shard = shard
 
-	AddDocInfosShard(shard)
-	indexer.DocInfosShard = DocInfoGroup[shard]
-
-	AddInvertedIndexShard(shard)
-	indexer.InvertedIndexShard = InvertedIndexGroup[shard]
+	// 每个索引器拥有独立的文档信息和反向索引，排序器通过Ranker.Init共享文档信息
+	indexer.DocInfosShard = NewDocInfosShard()
+	indexer.InvertedIndexShard = NewInvertedIndexShard()
 
 	indexer.initOptions = options
+	indexer.nextSeq = 1
+	indexer.buffer = newIndexBuffer(indexer.nextSeq)
+	indexer.maxBufferDocs = defaultMaxBufferDocs
+	indexer.docFreqs = make(map[string]int)
+	indexer.docs = new(docTable)
+	indexer.removedDocs = make(map[uint64]bool)
+	indexer.docKeywords = make(map[uint64][]string)
+	indexer.geoCells = make(map[string]geoColumn)
+
+	indexer.mergeChan = make(chan bool, 1)
+	go indexer.mergeWorker(indexer.mergeChan)
+	return nil
+}
+
+// 停止后台合并协程，可以重复调用
+func (indexer *Indexer) Close() {
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+
+	// 之后freezeBuffer向nil通道发送时直接跳过
+	if indexer.mergeChan != nil {
+		close(indexer.mergeChan)
+		indexer.mergeChan = nil
+	}
 }
 
 // 向反向索引表中加入一个文档
-func (indexer *Indexer) AddDocument(document *types.DocumentIndex, dealDocInfoChan chan<- bool) (addInvertedIndex map[string]*types.KeywordIndices) {
+// 返回被修改的搜索键，值为false的搜索键已不包含任何文档
+func (indexer *Indexer) AddDocument(document *types.DocumentIndex, dealDocInfoChan chan<- bool) (changed map[string]bool) {
 	if indexer.initialized == false {
 		log.Fatal("索引器尚未初始化")
 	}
 
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+
+	docId := document.DocId
+	oldState := indexer.docs.get(docId)
+	oldKeywords := indexer.docKeywords[docId]
+	seq := indexer.nextSeq
+	indexer.nextSeq++
+
+	// 各搜索键文档数的变化：文档已经存在时旧文档中的搜索键减一，新文档中的搜索键加一
+	deltas := make(map[string]int)
+	if oldState != nil {
+		for _, keyword := range oldKeywords {
+			deltas[keyword]--
+		}
+	}
+	keywords := make([]string, len(document.Keywords))
+	for i, keyword := range document.Keywords {
+		keywords[i] = keyword.Text
+		deltas[keyword.Text]++
+	}
+	state := &docState{
+		seq:               seq,
+		tokenLength:       document.TokenLength,
+		fieldTokenLengths: document.FieldTokenLengths,
+		attributes:        document.Attributes,
+		geoPoints:         document.GeoPoints,
+	}
+
 	indexer.InvertedIndexShard.Lock()
-	defer indexer.InvertedIndexShard.Unlock()
+	var oldGeoPoints map[string]types.GeoPoint
+	if oldState != nil {
+		indexer.InvertedIndexShard.TotalTokenLength -= oldState.tokenLength
+		indexer.addFieldTokenLengths(oldState.fieldTokenLengths, -1)
+		if oldState.seq >= indexer.buffer.minSeq {
+			indexer.removeFromBuffer(docId, oldKeywords)
+		}
+		oldGeoPoints = oldState.geoPoints
+	}
+	indexer.buffer.docs[docId] = document.TokenLength
+	var positions [][]int
+	if indexer.initOptions.IndexType == types.LocationsIndex {
+		positions = KeywordPositions(document.Keywords)
+	}
+	for i := range document.Keywords {
+		var keywordPositions []int
+		if positions != nil {
+			keywordPositions = positions[i]
+		}
+		indexer.insertIntoBuffer(docId, &document.Keywords[i], keywordPositions)
+	}
+	indexer.InvertedIndexShard.TotalTokenLength += document.TokenLength
+	indexer.addFieldTokenLengths(document.FieldTokenLengths, 1)
+
+	for keyword, delta := range deltas {
+		indexer.updateDocFreq(keyword, delta)
+	}
+
+	// 新文档从此时起代替旧文档
+	indexer.docs = indexer.docs.set(docId, state)
+	indexer.updateGeoCells(docId, oldGeoPoints, document.GeoPoints)
 
-	// 更新文档总数及关键词总长度
+	// 旧文档中有而新文档中没有的搜索键也需要从持久存储中清除旧记录
+	changed = make(map[string]bool)
+	for _, keyword := range oldKeywords {
+		changed[keyword] = indexer.docFreqs[keyword] > 0
+	}
+	for _, keyword := range keywords {
+		changed[keyword] = true
+	}
+	indexer.InvertedIndexShard.Unlock()
+
+	// 更新文档信息
 	indexer.DocInfosShard.Lock()
-	if _, found := indexer.DocInfosShard.DocInfos[document.DocId]; !found {
-		indexer.DocInfosShard.DocInfos[document.DocId] = new(types.DocInfo)
+	if _, found := indexer.DocInfosShard.DocInfos[docId]; !found {
+		indexer.DocInfosShard.DocInfos[docId] = new(types.DocInfo)
 		indexer.DocInfosShard.NumDocuments++
 	}
-	if document.TokenLength != 0 {
-		originalLength := indexer.DocInfosShard.DocInfos[document.DocId].TokenLengths
-		indexer.DocInfosShard.DocInfos[document.DocId].TokenLengths = float32(document.TokenLength)
-		indexer.InvertedIndexShard.TotalTokenLength += document.TokenLength - originalLength
-	}
+	indexer.DocInfosShard.DocInfos[docId].TokenLengths = float32(document.TokenLength)
+	indexer.DocInfosShard.DocInfos[docId].FieldTokenLengths = document.FieldTokenLengths
 	indexer.DocInfosShard.Unlock()
 	close(dealDocInfoChan)
 
-	// docIdIsNew := true
-	foundKeyword := false
-	addInvertedIndex = make(map[string]*types.KeywordIndices)
-	for _, keyword := range document.Keywords {
-		addInvertedIndex[keyword.Text], foundKeyword = indexer.InvertedIndexShard.InvertedIndex[keyword.Text]
-		if !foundKeyword {
-			addInvertedIndex[keyword.Text] = new(types.KeywordIndices)
-		}
-		indices := addInvertedIndex[keyword.Text]
-
-		if !foundKeyword {
-			// 如果没找到该搜索键则加入
-			switch indexer.initOptions.IndexType {
-			case types.LocationsIndex:
-				indices.Locations = [][]int{keyword.Starts}
-			case types.FrequenciesIndex:
-				indices.Frequencies = []float32{keyword.Frequency}
-			}
-			indices.DocIds = []uint64{document.DocId}
-			indexer.InvertedIndexShard.InvertedIndex[keyword.Text] = indices
-			continue
-		}
+	// 更新正向索引
+	indexer.docKeywords[docId] = keywords
+	delete(indexer.removedDocs, docId)
 
-		// 查找应该插入的位置
-		position, found := indexer.searchIndex(
-			indices, 0, indexer.getIndexLength(indices)-1, document.DocId)
-		if found {
-			// docIdIsNew = false
-
-			// 覆盖已有的索引项
-			switch indexer.initOptions.IndexType {
-			case types.LocationsIndex:
-				indices.Locations[position] = keyword.Starts
-			case types.FrequenciesIndex:
-				indices.Frequencies[position] = keyword.Frequency
+	if len(indexer.buffer.docs) >= indexer.maxBufferDocs {
+		indexer.freezeBuffer()
+	}
+	return
+}
+
+// 将各搜索键的起始字节位置换算为关键词序号，短语查询按序号计算间隔
+//
+// 同一字段的搜索键（不限字段的搜索键为一组）中全部位置去重排序后，第 k 个位置的序号为 k，
+// 因此不进入索引的停用词不占序号。相邻位置相隔不少于types.FieldLocationGap字节时属于不同的字段，
+// 序号也相隔types.FieldLocationGap，使短语查询不跨越字段。
+func KeywordPositions(keywords []types.KeywordIndex) [][]int {
+	fieldStarts := make(map[string][]int)
+	for i := range keywords {
+		field, _ := types.SplitFieldToken(keywords[i].Text)
+		fieldStarts[field] = append(fieldStarts[field], keywords[i].Starts...)
+	}
+	fieldPositions := make(map[string]map[int]int, len(fieldStarts))
+	for field, starts := range fieldStarts {
+		sort.Ints(starts)
+		positions := make(map[int]int, len(starts))
+		position := 0
+		for i, start := range starts {
+			if i > 0 && start != starts[i-1] {
+				if start-starts[i-1] >= types.FieldLocationGap {
+					position += types.FieldLocationGap
+				} else {
+					position++
+				}
 			}
-			continue
+			positions[start] = position
 		}
+		fieldPositions[field] = positions
+	}
 
-		// 当索引不存在时，插入新索引项
-		switch indexer.initOptions.IndexType {
-		case types.LocationsIndex:
-			indices.Locations = append(indices.Locations, []int{})
-			copy(indices.Locations[position+1:], indices.Locations[position:])
-			indices.Locations[position] = keyword.Starts
-		case types.FrequenciesIndex:
-			indices.Frequencies = append(indices.Frequencies, float32(0))
-			copy(indices.Frequencies[position+1:], indices.Frequencies[position:])
-			indices.Frequencies[position] = keyword.Frequency
+	result := make([][]int, len(keywords))
+	for i := range keywords {
+		field, _ := types.SplitFieldToken(keywords[i].Text)
+		result[i] = make([]int, len(keywords[i].Starts))
+		for j, start := range keywords[i].Starts {
+			result[i][j] = fieldPositions[field][start]
 		}
-		indices.DocIds = append(indices.DocIds, 0)
-		copy(indices.DocIds[position+1:], indices.DocIds[position:])
-		indices.DocIds[position] = document.DocId
 	}
-	return
+	return result
 }
 
 // 查找包含全部搜索键(AND操作)的文档
 // 当docIds不为nil时仅从docIds指定的文档中查找
 func (indexer *Indexer) Lookup(
 	tokens []string, labels []string, docIds map[uint64]bool, countDocsOnly bool) (docs []types.IndexedDocument, numDocs int) {
-	if indexer.initialized == false {
-		log.Fatal("索引器尚未初始化")
+	query := types.Query{Operator: types.QueryAnd}
+	for _, token := range tokens {
+		query.Children = append(query.Children, types.TermQuery(token))
 	}
+	return indexer.LookupQuery(&query, labels, docIds, countDocsOnly)
+}
 
-	indexer.DocInfosShard.RLock()
-	defer indexer.DocInfosShard.RUnlock()
+// 查找满足布尔查询树的文档，labels中的标签和查询树求交集
+// 当docIds不为nil时仅从docIds指定的文档中查找
+// 返回文档的BM25和紧邻距离只根据查询树中匹配到的关键词计算，
+// TokenSnippetLocations和TokenLocations与query.Tokens()一一对应，未匹配的关键词位置为-1和nil，
+// 位置的含义见types.IndexedDocument.TokenLocations
+func (indexer *Indexer) LookupQuery(
+	query *types.Query, labels []string, docIds map[uint64]bool, countDocsOnly bool) (docs []types.IndexedDocument, numDocs int) {
+	docs, numDocs, _, _, _ = indexer.LookupContext(context.Background(), query, labels, docIds,
+		types.LookupOptions{CountDocsOnly: countDocsOnly})
+	return
+}
 
-	if indexer.DocInfosShard.NumDocuments == 0 {
-		return
+// 和LookupQuery相同，但在ctx被取消或者超时时中止查找，此时返回nil和ctx.Err()
+// options为附加条件（范围条件的边界类型不支持时返回错误）以及分面统计（前缀为空时返回错误）、聚合和距离计算，见types.LookupOptions。
+// facetCounts和aggregated分别和options.Facets、options.Aggregations一一对应，合并各shard的结果见MergeFacets和MergeAggregations
+// 有地理范围条件时先用网格找出候选文档，和满足查询树的文档求交集后再精确计算
+func (indexer *Indexer) LookupContext(ctx context.Context, query *types.Query, labels []string,
+	docIds map[uint64]bool, options types.LookupOptions) (docs []types.IndexedDocument, numDocs int,
+	facetCounts []types.Facet, aggregated []types.Aggregation, err error) {
+	filters, facets, countDocsOnly := options.Filters, options.Facets, options.CountDocsOnly
+	if indexer.initialized == false {
+		log.Fatal("索引器尚未初始化")
+	}
+	if err := ValidateFacets(facets); err != nil {
+		return nil, 0, nil, nil, err
 	}
-	numDocs = 0
 
-	// 合并关键词和标签为搜索键
-	keywords := make([]string, len(tokens)+len(labels))
-	copy(keywords, tokens)
-	copy(keywords[len(tokens):], labels)
+	// 标签作为查询树的附加条件
+	root := *query
+	if len(labels) > 0 {
+		root = types.AndQuery(*query)
+		for _, label := range labels {
+			root.Children = append(root.Children, types.TermQuery(label))
+		}
+	}
 
+	// 在反向索引表的读锁下取得快照（见indexView），地理范围条件的候选文档也在此时找出，
+	// 此后查找、过滤和评分不需要任何锁，写入者不必等待查找结束
+	tokens := query.Tokens()
+	weights := query.TokenWeights()
+	terms := queryTerms(&root, make(map[string]bool))
 	indexer.InvertedIndexShard.RLock()
+	fieldLengths := indexer.addFieldTerms(tokens, terms)
+	facetKeywords := indexer.facetKeywords(facets, terms)
+	view := indexer.newIndexView(terms)
+	totalTokenLength := indexer.InvertedIndexShard.TotalTokenLength
+	geoFilters, geoCandidates := indexer.compileGeoFilters(options.GeoFilters)
+	indexer.InvertedIndexShard.RUnlock()
 
-	table := make([]*types.KeywordIndices, len(keywords))
-	for i, keyword := range keywords {
-		indices, found := indexer.InvertedIndexShard.InvertedIndex[keyword]
-		if !found {
-			// 当反向索引表中无此搜索键时直接返回
-			indexer.InvertedIndexShard.RUnlock()
-			return
-		} else {
-			// 否则加入反向表中
-			table[i] = indices
-		}
+	aggregators := newAggregators(options.Aggregations)
+	if view.docs.size == 0 {
+		facetCounts, err = countFacets(ctx, view, nil, facets, facetKeywords)
+		return nil, 0, facetCounts, finishAggregators(aggregators), err
+	}
+	numDocs = 0
+	compiledFilters, err := compileFilters(filters)
+	if err != nil {
+		return nil, 0, nil, nil, err
 	}
 
-	// 当没有找到时直接返回
-	if len(table) == 0 {
-		indexer.InvertedIndexShard.RUnlock()
-		return
+	// 求出满足查询树的全部文档，按DocId从小到大排列
+	matchedDocIds := indexer.evaluateQuery(view, &root)
+	if geoCandidates != nil {
+		matchedDocIds = intersectDocIds(matchedDocIds, geoCandidates)
+	}
+	if len(matchedDocIds) == 0 {
+		facetCounts, err = countFacets(ctx, view, nil, facets, facetKeywords)
+		return nil, 0, facetCounts, finishAggregators(aggregators), err
 	}
 
-	// 归并查找各个搜索键出现文档的交集
-	// 从后向前查保证先输出DocId较大文档
-	indexPointers := make([]int, len(table))
-	for iTable := 0; iTable < len(table); iTable++ {
-		indexPointers[iTable] = indexer.getIndexLength(table[iTable]) - 1
+	// 参与打分的关键词及其反向索引的游标
+	cursors := make([]*termCursor, len(tokens))
+	for i, token := range tokens {
+		cursors[i] = view.newTermCursor(view.term(token), indexer.initOptions.IndexType != types.DocIdsIndex)
 	}
-	// 平均文本关键词长度，用于计算BM25
-	avgDocLength := indexer.InvertedIndexShard.TotalTokenLength / float32(indexer.DocInfosShard.NumDocuments)
-	indexer.InvertedIndexShard.RUnlock()
 
-	for ; indexPointers[0] >= 0; indexPointers[0]-- {
-		// 以第一个搜索键出现的文档作为基准，并遍历其他搜索键搜索同一文档
-		baseDocId := indexer.getDocId(table[0], indexPointers[0])
+	// 平均文本关键词长度，用于计算BM25；索引中有具名字段时计算BM25F
+	avgDocLength := totalTokenLength / float32(view.docs.size)
+	fields := indexer.newFieldScorer(view, tokens, fieldLengths, totalTokenLength)
+
+	// 满足全部条件的文档，从后向前收集，用于分面统计
+	var countedDocIds []uint64
+
+	// 从后向前输出保证先输出DocId较大文档
+	for i := len(matchedDocIds) - 1; i >= 0; i-- {
+		if (len(matchedDocIds)-1-i)%contextCheckInterval == 0 && ctx.Err() != nil {
+			return nil, 0, nil, nil, ctx.Err()
+		}
+		docId := matchedDocIds[i]
 
-		// 全局范围查找目标文档是否存在
-		if _, ok := indexer.DocInfosShard.DocInfos[baseDocId]; !ok {
-			// if !IsDocExist(baseDocId) {
-			// 文档信息中不存在反向索引文档时，跳过
-			// 该情况由不对称删除操作所造成
+		state := view.docs.get(docId)
+		if state == nil {
 			continue
 		}
 
 		if docIds != nil {
-			_, found := docIds[baseDocId]
+			_, found := docIds[docId]
 			if !found {
 				continue
 			}
 		}
-		iTable := 1
-		found := true
-		for ; iTable < len(table); iTable++ {
-			// 二分法比简单的顺序归并效率高，也有更高效率的算法，
-			// 但顺序归并也许是更好的选择，考虑到将来需要用链表重新实现
-			// 以避免反向表添加新文档时的写锁。
-			// TODO: 进一步研究不同求交集算法的速度和可扩展性。
-			position, foundBaseDocId := indexer.searchIndex(table[iTable],
-				0, indexPointers[iTable], baseDocId)
-			if foundBaseDocId {
-				indexPointers[iTable] = position
-			} else {
-				if position == 0 {
-					// 该搜索键中所有的文档ID都比baseDocId大，因此已经没有
-					// 继续查找的必要。
-					return
-				} else {
-					// 继续下一indexPointers[0]的查找
-					indexPointers[iTable] = position - 1
-					found = false
-					break
-				}
+
+		if !matchFilters(state, compiledFilters) || !matchGeoFilters(state, geoFilters) {
+			continue
+		}
+
+		if !countDocsOnly {
+			doc := view.scoreDocument(state, docId, tokens, weights, cursors, avgDocLength, fields)
+			if options.DistanceSort != nil {
+				doc.Distance = state.distance(options.DistanceSort)
 			}
+			docs = append(docs, doc)
+		}
+		if len(facets) > 0 {
+			countedDocIds = append(countedDocIds, docId)
+		}
+		for _, a := range aggregators {
+			a.add(state)
 		}
+		numDocs++
+	}
+	aggregated = finishAggregators(aggregators)
 
-		if found {
-			indexedDoc := types.IndexedDocument{}
-
-			// 当为LocationsIndex时计算关键词紧邻距离
-			if indexer.initOptions.IndexType == types.LocationsIndex {
-				// 计算有多少关键词是带有距离信息的
-				numTokensWithLocations := 0
-				for i, t := range table[:len(tokens)] {
-					if len(t.Locations[indexPointers[i]]) > 0 {
-						numTokensWithLocations++
-					}
-				}
-				if numTokensWithLocations != len(tokens) {
-					if !countDocsOnly {
-						docs = append(docs, types.IndexedDocument{
-							DocId: baseDocId,
-						})
-					}
-					numDocs++
-					break
-				}
+	if len(facets) > 0 {
+		for i, j := 0, len(countedDocIds)-1; i < j; i, j = i+1, j-1 {
+			countedDocIds[i], countedDocIds[j] = countedDocIds[j], countedDocIds[i]
+		}
+		if facetCounts, err = countFacets(ctx, view, countedDocIds, facets, facetKeywords); err != nil {
+			return nil, 0, nil, nil, err
+		}
+	}
+	return
+}
 
-				// 计算搜索键在文档中的紧邻距离
-				tokenProximity, tokenLocations := computeTokenProximity(table[:len(tokens)], indexPointers, tokens)
-				indexedDoc.TokenProximity = int32(tokenProximity)
-				indexedDoc.TokenSnippetLocations = tokenLocations
+// 计算文档的BM25和关键词紧邻距离，只有在文档中出现的关键词参与计算。fields不为nil时计算BM25F
+// weights和tokens一一对应，各关键词的BM25乘以相应的权重，为nil时权重都为1。state为文档在快照中的状态
+func (view *indexView) scoreDocument(state *docState, docId uint64, tokens []string, weights []float32,
+	cursors []*termCursor, avgDocLength float32, fields *fieldScorer) types.IndexedDocument {
+	indexer := view.indexer
+	indexedDoc := types.IndexedDocument{DocId: docId}
 
-				// 添加TokenLocations
-				indexedDoc.TokenLocations = make([][]int, len(tokens))
-				for i, t := range table[:len(tokens)] {
-					indexedDoc.TokenLocations[i] = t.Locations[indexPointers[i]]
-				}
-			}
+	// 找出文档中出现的关键词
+	var (
+		matchedTokens    []string
+		matchedTerms     []*termPostings
+		matchedCursors   []*postingCursor
+		matchedPointers  []int
+		matchedOrders    []int
+		matchedLocations [][]int
+	)
+	for i, cursor := range cursors {
+		segmentCursor, position, found := cursor.seek(docId)
+		if found {
+			// 紧邻距离按关键词本身的长度计算
+			_, text := types.SplitFieldToken(tokens[i])
+			matchedTokens = append(matchedTokens, text)
+			matchedTerms = append(matchedTerms, cursor.term)
+			matchedCursors = append(matchedCursors, segmentCursor)
+			matchedPointers = append(matchedPointers, position)
+			matchedOrders = append(matchedOrders, i)
+			matchedLocations = append(matchedLocations, segmentCursor.locations(position))
+		}
+	}
 
-			// 当为LocationsIndex或者FrequenciesIndex时计算BM25
-			if indexer.initOptions.IndexType == types.LocationsIndex ||
-				indexer.initOptions.IndexType == types.FrequenciesIndex {
-				bm25 := float32(0)
-				d := indexer.DocInfosShard.DocInfos[baseDocId].TokenLengths
-				for i, t := range table[:len(tokens)] {
-					var frequency float32
-					if indexer.initOptions.IndexType == types.LocationsIndex {
-						frequency = float32(len(t.Locations[indexPointers[i]]))
-					} else {
-						frequency = t.Frequencies[indexPointers[i]]
-					}
-
-					// 计算BM25
-					if len(t.DocIds) > 0 && frequency > 0 && indexer.initOptions.BM25Parameters != nil && avgDocLength != 0 {
-						// 带平滑的idf
-						idf := float32(math.Log2(float64(indexer.DocInfosShard.NumDocuments)/float64(len(t.DocIds)) + 1))
-						k1 := indexer.initOptions.BM25Parameters.K1
-						b := indexer.initOptions.BM25Parameters.B
-						bm25 += idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*d/avgDocLength))
-					}
+	// 当为LocationsIndex时计算关键词紧邻距离
+	if indexer.initOptions.IndexType == types.LocationsIndex && len(matchedTokens) > 0 {
+		// 计算有多少关键词是带有距离信息的
+		numTokensWithLocations := 0
+		for _, locations := range matchedLocations {
+			if len(locations) > 0 {
+				numTokensWithLocations++
+			}
+		}
+		if numTokensWithLocations == len(matchedTokens) {
+			// 计算搜索键在文档中的紧邻距离
+			tokenProximity, tokenLocations := computeTokenProximity(matchedLocations, matchedTokens)
+			indexedDoc.TokenProximity = int32(tokenProximity)
+
+			// 添加TokenSnippetLocations和TokenLocations
+			indexedDoc.TokenSnippetLocations = make([]int, len(tokens))
+			indexedDoc.TokenLocations = make([][]int, len(tokens))
+			for i := range indexedDoc.TokenSnippetLocations {
+				indexedDoc.TokenSnippetLocations[i] = -1
+			}
+			for i, order := range matchedOrders {
+				if tokenLocations[i] < types.FieldLocationStart {
+					indexedDoc.TokenSnippetLocations[order] = tokenLocations[i]
 				}
-				indexedDoc.BM25 = float32(bm25)
+				indexedDoc.TokenLocations[order] = contentLocations(matchedLocations[i])
 			}
+		}
+	}
 
-			indexedDoc.DocId = baseDocId
-			if !countDocsOnly {
-				docs = append(docs, indexedDoc)
+	// 当为LocationsIndex或者FrequenciesIndex时计算BM25
+	if indexer.initOptions.IndexType == types.LocationsIndex ||
+		indexer.initOptions.IndexType == types.FrequenciesIndex {
+		bm25 := float32(0)
+		for i, cursor := range matchedCursors {
+			frequency := indexer.termFrequency(cursor, matchedPointers[i])
+
+			// 计算BM25
+			order := matchedOrders[i]
+			var tokenBM25 float32
+			if fields != nil {
+				tokenBM25 = fields.bm25(view, state, docId, order, tokens[order], matchedTerms[i].numDocs, frequency)
+			} else {
+				tokenBM25 = view.bm25(matchedTerms[i].numDocs, frequency, state.tokenLength, avgDocLength)
+			}
+			if weights != nil {
+				tokenBM25 *= weights[order]
 			}
-			numDocs++
+			bm25 += tokenBM25
 		}
+		indexedDoc.BM25 = float32(bm25)
 	}
-	return
+	return indexedDoc
+}
+
+// 去掉不限字段的搜索键在具名字段中的位置（见types.FieldLocationStart），locations按升序排列
+func contentLocations(locations []int) []int {
+	n := sort.SearchInts(locations, types.FieldLocationStart)
+	return locations[:n:n]
+}
+
+// 一个关键词对文档BM25的贡献，numDocs为包含该关键词的文档数，d为文档的关键词长度
+// 对frequency单调递增，对d单调递减，因此也用来估计BM25的上界
+func (view *indexView) bm25(numDocs int, frequency, d, avgDocLength float32) float32 {
+	params := view.indexer.initOptions.BM25Parameters
+	if numDocs <= 0 || frequency <= 0 || params == nil || avgDocLength == 0 {
+		return 0
+	}
+	k1 := params.K1
+	b := params.B
+	return view.idf(numDocs) * frequency * (k1 + 1) / (frequency + k1*(1-b+b*d/avgDocLength))
+}
+
+// 带平滑的idf，numDocs为包含该关键词的文档数，总文档数为快照中的文档数
+func (view *indexView) idf(numDocs int) float32 {
+	return float32(math.Log2(float64(view.docs.size)/float64(numDocs) + 1))
+}
+
+// 游标当前位置的词频，LocationsIndex中为关键词出现的次数
+func (indexer *Indexer) termFrequency(cursor *postingCursor, position int) float32 {
+	if indexer.initOptions.IndexType == types.LocationsIndex {
+		return float32(len(cursor.locations(position)))
+	}
+	return cursor.frequency(position)
 }
 
 // 二分法查找indices中某文档的索引项
@@ -323,8 +550,8 @@ func (indexer *Indexer) searchIndex(
 // 	ArgMin(Sum(Abs(P_(i+1) - P_i - L_i)))
 //
 // 具体由动态规划实现，依次计算前 i 个 token 在每个出现位置的最优值。
-// 选定的 P_i 通过 tokenLocations 参数传回。
-func computeTokenProximity(table []*types.KeywordIndices, indexPointers []int, tokens []string) (
+// locations[i]为第 i 个搜索键在文档中出现的位置，选定的 P_i 通过 tokenLocations 参数传回。
+func computeTokenProximity(locations [][]int, tokens []string) (
 	minTokenProximity int, tokenLocations []int) {
 	minTokenProximity = -1
 	tokenLocations = make([]int, len(tokens))
@@ -338,14 +565,14 @@ func computeTokenProximity(table []*types.KeywordIndices, indexPointers []int, t
 	// 初始化路径数组
 	path = make([][]int, len(tokens))
 	for i := 1; i < len(path); i++ {
-		path[i] = make([]int, len(table[i].Locations[indexPointers[i]]))
+		path[i] = make([]int, len(locations[i]))
 	}
 
 	// 动态规划
-	currentLocations = table[0].Locations[indexPointers[0]]
+	currentLocations = locations[0]
 	currentMinValues = make([]int, len(currentLocations))
 	for i := 1; i < len(tokens); i++ {
-		nextLocations = table[i].Locations[indexPointers[i]]
+		nextLocations = locations[i]
 		nextMinValues = make([]int, len(nextLocations))
 		for j, _ := range nextMinValues {
 			nextMinValues[j] = -1
@@ -397,7 +624,7 @@ func computeTokenProximity(table []*types.KeywordIndices, indexPointers []int, t
 		if i != len(tokens)-1 {
 			cursor = path[i+1][cursor]
 		}
-		tokenLocations[i] = table[i].Locations[indexPointers[i]][cursor]
+		tokenLocations[i] = locations[i][cursor]
 	}
 	return
 }
@@ -412,9 +639,165 @@ func (indexer *Indexer) getIndexLength(ti *types.KeywordIndices) int {
 	return len(ti.DocIds)
 }
 
-// 删除某个文档（反向索引的删除太复杂故而不做，只在排序器中删除文档即可）
-func (indexer *Indexer) RemoveDoc(docId uint64) {
+// 删除某个文档
+// 文档的索引项随即失效，段中的记录在合并或者调用Compact时清除
+// 文档信息由排序器删除，因此必须在Ranker.RemoveDoc之前调用
+// 返回文档所在的搜索键，值为false的搜索键已不包含任何文档；文档不存在时返回nil
+func (indexer *Indexer) RemoveDoc(docId uint64) (changed map[string]bool) {
 	if indexer.initialized == false {
-		log.Fatal("排序器尚未初始化")
+		log.Fatal("索引器尚未初始化")
+	}
+
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+
+	state := indexer.docs.get(docId)
+	if state == nil {
+		return nil
+	}
+	keywords := indexer.docKeywords[docId]
+
+	indexer.InvertedIndexShard.Lock()
+	indexer.InvertedIndexShard.TotalTokenLength -= state.tokenLength
+	indexer.addFieldTokenLengths(state.fieldTokenLengths, -1)
+	changed = make(map[string]bool, len(keywords))
+	for _, keyword := range keywords {
+		indexer.updateDocFreq(keyword, -1)
+		changed[keyword] = indexer.docFreqs[keyword] > 0
+	}
+	if state.seq >= indexer.buffer.minSeq {
+		indexer.removeFromBuffer(docId, keywords)
+	}
+	indexer.docs = indexer.docs.remove(docId)
+	indexer.updateGeoCells(docId, state.geoPoints, nil)
+	indexer.InvertedIndexShard.Unlock()
+	indexer.removedDocs[docId] = true
+	return
+}
+
+// 已删除但尚未调用Compact的文档数
+func (indexer *Indexer) NumRemovedDocs() int {
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+	return len(indexer.removedDocs)
+}
+
+// 将缓冲区和全部索引段合并为一个段，从中清除已删除和已被更新的文档
+// 返回已删除的文档包含的搜索键，值为false的搜索键已不包含任何文档，调用者据此清除持久存储中的记录
+func (indexer *Indexer) Compact() map[string]bool {
+	if indexer.initialized == false {
+		log.Fatal("索引器尚未初始化")
+	}
+
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+
+	changed := make(map[string]bool)
+	if len(indexer.removedDocs) == 0 {
+		return changed
+	}
+
+	indexer.freezeBuffer()
+	indexer.mergeLock.Lock()
+	indexer.InvertedIndexShard.RLock()
+	segments := indexer.segments
+	indexer.InvertedIndexShard.RUnlock()
+	if len(segments) > 0 {
+		indexer.replaceSegments(segments, indexer.mergeSegments(segments))
+	}
+	indexer.mergeLock.Unlock()
+
+	indexer.InvertedIndexShard.RLock()
+	for docId := range indexer.removedDocs {
+		for _, keyword := range indexer.docKeywords[docId] {
+			changed[keyword] = indexer.docFreqs[keyword] > 0
+		}
+		delete(indexer.docKeywords, docId)
+	}
+	indexer.InvertedIndexShard.RUnlock()
+	indexer.removedDocs = make(map[uint64]bool)
+	return changed
+}
+
+// 使反向索引和文档信息保持一致，用于从持久存储恢复之后：
+// 将载入的反向索引行作为一个索引段，按照文档信息重新计算关键词总长度，重建正向索引，
+// 并将没有文档信息的文档标记为删除
+func (indexer *Indexer) Reconcile() {
+	if indexer.initialized == false {
+		log.Fatal("索引器尚未初始化")
+	}
+
+	indexer.writeLock.Lock()
+	defer indexer.writeLock.Unlock()
+
+	// 缓冲区中的文档序号在载入的段之前
+	indexer.freezeBuffer()
+	seq := indexer.nextSeq
+	indexer.nextSeq++
+
+	// 从持久存储载入的文档加入文档状态表，属性从文档信息中移到文档状态中
+	docs := indexer.docs
+	loadedGeoPoints := make(map[uint64]map[string]types.GeoPoint)
+	var totalTokenLength float32
+	fieldTokenLengths := make(map[string]float32)
+	indexer.DocInfosShard.Lock()
+	for docId, docInfo := range indexer.DocInfosShard.DocInfos {
+		totalTokenLength += docInfo.TokenLengths
+		for field, length := range docInfo.FieldTokenLengths {
+			fieldTokenLengths[field] += length
+		}
+		if docs.get(docId) == nil {
+			docs = docs.set(docId, &docState{
+				seq:               seq,
+				tokenLength:       docInfo.TokenLengths,
+				fieldTokenLengths: docInfo.FieldTokenLengths,
+				attributes:        docInfo.Attributes,
+				geoPoints:         docInfo.GeoPoints,
+			})
+			if docInfo.GeoPoints != nil {
+				loadedGeoPoints[docId] = docInfo.GeoPoints
+			}
+		}
+		docInfo.Attributes = nil
+		docInfo.GeoPoints = nil
+	}
+	indexer.DocInfosShard.Unlock()
+
+	seg := &segment{index: indexer.loaded, minSeq: seq, maxSeq: seq}
+	if seg.index == nil {
+		seg.index = make(map[string]*types.PostingList)
+	}
+	deltas := make(map[string]int)
+	for keyword, list := range seg.index {
+		seg.numPostings += list.NumDocs
+		setMinTokenLengths(list, docs.tokenLength)
+		for _, docId := range decompressDocIds(list) {
+			if docs.isLive(seg, docId) {
+				deltas[keyword]++
+			} else if docs.get(docId) == nil {
+				indexer.removedDocs[docId] = true
+			} else {
+				continue
+			}
+			indexer.docKeywords[docId] = append(indexer.docKeywords[docId], keyword)
+		}
+	}
+	indexer.loaded = nil
+
+	indexer.InvertedIndexShard.Lock()
+	indexer.docs = docs
+	for docId, points := range loadedGeoPoints {
+		indexer.updateGeoCells(docId, nil, points)
+	}
+	indexer.InvertedIndexShard.TotalTokenLength = totalTokenLength
+	indexer.InvertedIndexShard.FieldTokenLengths = nil
+	indexer.addFieldTokenLengths(fieldTokenLengths, 1)
+	for keyword, delta := range deltas {
+		indexer.updateDocFreq(keyword, delta)
+	}
+	if len(seg.index) > 0 {
+		indexer.segments = append(append([]*segment{}, indexer.segments...), seg)
 	}
+	indexer.buffer = newIndexBuffer(indexer.nextSeq)
+	indexer.InvertedIndexShard.Unlock()
 }
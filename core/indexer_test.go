@@ -1,9 +1,15 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	"github.com/Jarlene/wukong/types"
 	"github.com/Jarlene/wukong/utils"
+	"math/rand"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
 func TestAddKeywords(t *testing.T) {
@@ -58,7 +64,8 @@ func TestAddKeywords(t *testing.T) {
 		make(chan<- bool),
 	)
 
-	utils.Expect(t, "1 2 7 ", indicesToString(&indexer, "token1"))
+	// 文档1和2重新加入时只含token2，token1中的旧记录被清除
+	utils.Expect(t, "7 ", indicesToString(&indexer, "token1"))
 	utils.Expect(t, "0 1 2 3 ", indicesToString(&indexer, "token2"))
 }
 
@@ -433,4 +440,927 @@ func TestLookupWithLocations(t *testing.T) {
 
 	docs, _ := indexer.Lookup([]string{"token2", "token3"}, []string{}, nil, false)
 	utils.Expect(t, "[[0 21] [28]]", docs[0].TokenLocations)
+
+	// 已取消的ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	query := types.AndQuery(types.TermQuery("token2"))
+	docs, numDocs, _, _, err := indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{})
+	utils.Expect(t, "0", len(docs))
+	utils.Expect(t, "0", numDocs)
+	utils.Expect(t, "context canceled", err)
+}
+
+func TestLookupQuery(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(10, types.IndexerInitOptions{IndexType: types.LocationsIndex})
+	// doc0 = "token2 token3"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 0,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0}},
+			{"token3", 0, []int{7}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc1 = "token1 token2 token3"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token2", 0, []int{7}},
+			{"token3", 0, []int{14}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc2 = "token1 token2"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 2,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token2", 0, []int{7}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc3 = "token2"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 3,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc7 = "token1 token3"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 7,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token3", 0, []int{7}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc9 = "token3"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 9,
+		Keywords: []types.KeywordIndex{
+			{"token3", 0, []int{0}},
+		},
+	},
+		make(chan<- bool),
+	)
+
+	query := types.OrQuery(types.TermQuery("token1"), types.TermQuery("token4"))
+	utils.Expect(t, "[7 0 [0 -1]] [2 0 [0 -1]] [1 0 [0 -1]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.AndQuery(types.TermQuery("token2"), types.NotQuery(types.TermQuery("token1")))
+	utils.Expect(t, "[3 0 [0]] [0 0 [0]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.AndQuery(
+		types.OrQuery(types.TermQuery("token1"), types.TermQuery("token3")),
+		types.NotQuery(types.TermQuery("token2")))
+	utils.Expect(t, "[9 0 [-1 0]] [7 1 [0 7]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.OrQuery(types.TermQuery("token2"), types.TermQuery("token3"))
+	utils.Expect(t, "[7 0 [-1 7]] [2 0 [7 -1]] [1 1 [7 14]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{"token1"}, nil, false)))
+
+	query = types.NotQuery(types.TermQuery("token1"))
+	utils.Expect(t, "", indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+}
+
+func TestLookupPhrase(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(11, types.IndexerInitOptions{IndexType: types.LocationsIndex})
+	// doc0 = "token2 token4 token4 token2 token3 token4"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 0,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0, 21}},
+			{"token3", 0, []int{28}},
+			{"token4", 0, []int{7, 14, 35}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc1 = "token3token2"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{6}},
+			{"token3", 0, []int{0}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc2 = "token2token3"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 2,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0}},
+			{"token3", 0, []int{6}},
+		},
+	},
+		make(chan<- bool),
+	)
+
+	// 间隔按关键词序号计算，关键词之间的空格不计入
+	query := types.PhraseQuery(0, types.TermQuery("token2"), types.TermQuery("token3"))
+	utils.Expect(t, "[2 0 [0 6]] [0 1 [21 28]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.PhraseQuery(0, types.TermQuery("token4"), types.TermQuery("token3"))
+	utils.Expect(t, "", indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.PhraseQuery(1, types.TermQuery("token4"), types.TermQuery("token3"))
+	utils.Expect(t, "[0 8 [14 28]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.PhraseQuery(0, types.TermQuery("token4"), types.TermQuery("token2"), types.TermQuery("token3"))
+	utils.Expect(t, "[0 2 [14 21 28]] ",
+		indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+
+	query = types.PhraseQuery(100, types.TermQuery("token3"), types.TermQuery("token4"), types.TermQuery("token2"))
+	utils.Expect(t, "", indexedDocsToString(indexer.LookupQuery(&query, []string{}, nil, false)))
+}
+
+func TestRemoveDoc(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(12, types.IndexerInitOptions{IndexType: types.FrequenciesIndex})
+	// doc1 = "token1 token2"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       1,
+		TokenLength: 2,
+		Keywords: []types.KeywordIndex{
+			{"token1", 1, []int{}},
+			{"token2", 1, []int{}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc2 = "token2 token3 token3"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       2,
+		TokenLength: 3,
+		Keywords: []types.KeywordIndex{
+			{"token2", 1, []int{}},
+			{"token3", 2, []int{}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc3 = "token1"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       3,
+		TokenLength: 1,
+		Keywords: []types.KeywordIndex{
+			{"token1", 1, []int{}},
+		},
+	},
+		make(chan<- bool),
+	)
+	utils.Expect(t, "6", indexer.TotalTokenLength)
+
+	indexer.RemoveDoc(2)
+	indexer.RemoveDoc(2)
+	indexer.RemoveDoc(4)
+	utils.Expect(t, "1", indexer.NumRemovedDocs())
+	utils.Expect(t, "3", indexer.TotalTokenLength)
+	utils.Expect(t, "[1 0 []] ",
+		indexedDocsToString(indexer.Lookup([]string{"token2"}, []string{}, nil, false)))
+	utils.Expect(t, "", indexedDocsToString(indexer.Lookup([]string{"token3"}, []string{}, nil, false)))
+
+	changed := indexer.Compact()
+	utils.Expect(t, "0", indexer.NumRemovedDocs())
+	utils.Expect(t, "2", len(changed))
+	utils.Expect(t, "false", changed["token3"])
+	utils.Expect(t, "true", changed["token2"])
+	utils.Expect(t, "1 3 ", indicesToString(&indexer, "token1"))
+	utils.Expect(t, "1 ", indicesToString(&indexer, "token2"))
+	_, found := indexer.Postings("token3", 0, 0)
+	utils.Expect(t, "false", found)
+
+	// 删除后重新加入
+	indexer.RemoveDoc(1)
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       1,
+		TokenLength: 1,
+		Keywords: []types.KeywordIndex{
+			{"token3", 1, []int{}},
+		},
+	},
+		make(chan<- bool),
+	)
+	utils.Expect(t, "2", indexer.TotalTokenLength)
+	utils.Expect(t, "3 ", indicesToString(&indexer, "token1"))
+	_, found = indexer.Postings("token2", 0, 0)
+	utils.Expect(t, "false", found)
+	utils.Expect(t, "[1 0 []] ",
+		indexedDocsToString(indexer.Lookup([]string{"token3"}, []string{}, nil, false)))
+}
+
+func TestUpdateDocument(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(13, types.IndexerInitOptions{IndexType: types.LocationsIndex})
+	// doc1 = "token1 token2"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       1,
+		TokenLength: 2,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token2", 0, []int{7}},
+		},
+	},
+		make(chan<- bool),
+	)
+	// doc2 = "token2"
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       2,
+		TokenLength: 1,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0}},
+		},
+	},
+		make(chan<- bool),
+	)
+
+	// doc1 = "token3 token2 token3"
+	changed := indexer.AddDocument(&types.DocumentIndex{
+		DocId:       1,
+		TokenLength: 3,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{7}},
+			{"token3", 0, []int{0, 14}},
+		},
+	},
+		make(chan<- bool),
+	)
+	utils.Expect(t, "3", len(changed))
+	utils.Expect(t, "false", changed["token1"])
+	utils.Expect(t, "4", indexer.TotalTokenLength)
+	utils.Expect(t, "2", indexer.NumDocuments)
+	utils.Expect(t, "1 2 ", indicesToString(&indexer, "token2"))
+	utils.Expect(t, "1 ", indicesToString(&indexer, "token3"))
+	utils.Expect(t, "", indexedDocsToString(indexer.Lookup([]string{"token1"}, []string{}, nil, false)))
+	utils.Expect(t, "[1 1 [7 14]] ",
+		indexedDocsToString(indexer.Lookup([]string{"token2", "token3"}, []string{}, nil, false)))
+}
+
+func TestIndexerInitErrors(t *testing.T) {
+	var indexer Indexer
+	utils.Expect(t, "true", indexer.Open(0, types.IndexerInitOptions{IndexType: 9}) != nil)
+	utils.Expect(t, "<nil>", indexer.Open(0, types.IndexerInitOptions{IndexType: types.LocationsIndex}))
+	utils.Expect(t, "true", indexer.Open(0, types.IndexerInitOptions{IndexType: types.LocationsIndex}) == ErrIndexerInitialized)
+
+	var ranker Ranker
+	_, err := ranker.AddDocument(1, nil, nil)
+	utils.Expect(t, "true", err == ErrRankerNotInitialized)
+	utils.Expect(t, "<nil>", ranker.Open(0, indexer.DocInfosShard))
+	utils.Expect(t, "true", ranker.Open(0, nil) == ErrRankerInitialized)
+}
+
+func TestSuggest(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:    1,
+		Keywords: []types.KeywordIndex{{"token1", 0, []int{}}, {"token2", 0, []int{}}, {"other", 0, []int{}}},
+	}, make(chan bool))
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:    2,
+		Keywords: []types.KeywordIndex{{"token2", 0, []int{}}},
+	}, make(chan bool))
+	utils.Expect(t, "[{token1 1} {token2 2}]", indexer.Suggest("token"))
+	utils.Expect(t, "[]", indexer.Suggest("x"))
+
+	// 已删除的文档不计入，被清空的搜索键不再返回
+	indexer.RemoveDoc(1)
+	utils.Expect(t, "[{token2 1}]", indexer.Suggest("token"))
+	indexer.Compact()
+	utils.Expect(t, "[{token2 1}]", indexer.Suggest(""))
+
+	// 删除后重新加入的搜索键只出现一次
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:    3,
+		Keywords: []types.KeywordIndex{{"token1", 0, []int{}}, {"token2", 0, []int{}}},
+	}, make(chan bool))
+	utils.Expect(t, "[{token1 1} {token2 2}]", indexer.Suggest(""))
+}
+
+func TestCompressedPostings(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.LocationsIndex})
+
+	// 倒序加入，各段中的DocId互相交错
+	indexer.maxBufferDocs = 300
+	for docId := uint64(1000); docId > 0; docId-- {
+		keywords := []types.KeywordIndex{{"all", 0, []int{int(docId % 7), 100}}}
+		if docId%3 == 0 {
+			keywords = append(keywords, types.KeywordIndex{"three", 0, []int{50}})
+		}
+		if docId%250 == 0 {
+			keywords = append(keywords, types.KeywordIndex{"rare", 0, []int{60}})
+		}
+		indexer.AddDocument(&types.DocumentIndex{DocId: docId, TokenLength: 3, Keywords: keywords}, make(chan bool))
+	}
+	list := indexer.segments[0].index["all"]
+	utils.Expect(t, "300", list.NumDocs)
+	utils.Expect(t, "3", len(list.Blocks))
+	for i := range list.Blocks {
+		if i > 0 && list.FirstDocIds[i] <= list.FirstDocIds[i-1] {
+			t.Error("块的顺序不正确")
+		}
+	}
+	indices, _ := indexer.Postings("all", 0, 0)
+	utils.Expect(t, "1000", len(indices.DocIds))
+	utils.Expect(t, "[6 100]", indices.Locations[5])
+	indices, _ = indexer.Postings("three", 10, 20)
+	utils.Expect(t, "[12 15 18]", indices.DocIds)
+	_, found := indexer.Postings("none", 0, 0)
+	utils.Expect(t, "false", found)
+
+	// 求交集时通过跳表查找
+	docs, numDocs := indexer.Lookup([]string{"all", "three", "rare"}, []string{}, nil, false)
+	utils.Expect(t, "[750 51 [1 50 60]] ", indexedDocsToString(docs, numDocs))
+	query := types.AndQuery(types.TermQuery("rare"), types.NotQuery(types.TermQuery("three")))
+	_, numDocs = indexer.LookupQuery(&query, []string{}, nil, true)
+	utils.Expect(t, "3", numDocs)
+
+	// 删除文档并压缩
+	for docId := uint64(1); docId <= 1000; docId++ {
+		if docId%2 == 0 {
+			indexer.RemoveDoc(docId)
+		}
+	}
+	changed := indexer.Compact()
+	utils.Expect(t, "false", changed["rare"])
+	utils.Expect(t, "1", len(indexer.segments))
+	utils.Expect(t, "500", indexer.segments[0].index["all"].NumDocs)
+	utils.Expect(t, "167", indexer.segments[0].index["three"].NumDocs)
+	_, numDocs = indexer.Lookup([]string{"all", "three"}, []string{}, nil, true)
+	utils.Expect(t, "167", numDocs)
+
+	compressed, uncompressed := indexer.PostingsSize()
+	utils.Expect(t, "true", compressed < uncompressed/2)
+}
+
+func TestBufferPostings(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.FrequenciesIndex})
+	indexer.maxBufferDocs = 10000
+
+	// 乱序加入和删除，缓冲区中压缩的行始终和未压缩的行一致
+	random := rand.New(rand.NewSource(2))
+	var snapshot *types.PostingList
+	var snapshotDocIds string
+	for i := 0; i < 2000; i++ {
+		docId := uint64(random.Intn(1000))
+		if random.Intn(4) == 0 {
+			indexer.RemoveDoc(docId)
+		} else {
+			indexer.AddDocument(&types.DocumentIndex{
+				DocId:       docId,
+				TokenLength: float32(docId%5 + 1),
+				Keywords:    []types.KeywordIndex{{"token", float32(docId%3 + 1), nil}},
+			}, make(chan bool))
+		}
+		if i == 1000 {
+			snapshot = indexer.buffer.compressed["token"]
+			snapshotDocIds = fmt.Sprint(decompressDocIds(snapshot))
+		}
+	}
+	list := indexer.buffer.compressed["token"]
+	indices := indexer.buffer.index["token"]
+	utils.Expect(t, "true", reflect.DeepEqual(indices, decompressPostings(list)))
+	utils.Expect(t, fmt.Sprint(len(indices.DocIds)), list.NumDocs)
+	for i := range list.Blocks {
+		if list.Blocks[i].NumDocs > 2*postingBlockSize {
+			t.Error("块中的文档数过多")
+		}
+	}
+	expected := compressPostings(indices, indexer.buffer.tokenLength)
+	utils.Expect(t, fmt.Sprint(expected.MaxFrequency), list.MaxFrequency)
+	utils.Expect(t, fmt.Sprint(expected.MinTokenLength), list.MinTokenLength)
+
+	// 之前取得的快照不受之后修改的影响
+	utils.Expect(t, snapshotDocIds, decompressDocIds(snapshot))
+}
+
+func TestSegments(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.FrequenciesIndex})
+	indexer.maxBufferDocs = 4
+
+	// 加入文档的同时查找
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				indexer.Lookup([]string{"all"}, []string{}, nil, true)
+			}
+		}
+	}()
+	for docId := uint64(1); docId <= 64; docId++ {
+		keywords := []types.KeywordIndex{{"all", 1, []int{}}}
+		if docId%2 == 0 {
+			keywords = append(keywords, types.KeywordIndex{"even", 1, []int{}})
+		}
+		indexer.AddDocument(&types.DocumentIndex{DocId: docId, TokenLength: 1, Keywords: keywords}, make(chan bool))
+	}
+	close(done)
+
+	// 更新和删除已经在段中的文档
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId: 2, TokenLength: 1, Keywords: []types.KeywordIndex{{"all", 1, []int{}}},
+	}, make(chan bool))
+	indexer.RemoveDoc(3)
+	_, numDocs := indexer.Lookup([]string{"all"}, []string{}, nil, true)
+	utils.Expect(t, "63", numDocs)
+	_, numDocs = indexer.Lookup([]string{"all", "even"}, []string{}, nil, true)
+	utils.Expect(t, "31", numDocs)
+	utils.Expect(t, "[{all 63} {even 31}]", indexer.Suggest(""))
+	indices, _ := indexer.Postings("even", 0, 10)
+	utils.Expect(t, "[4 6 8]", indices.DocIds)
+
+	// 16个段逐级合并为一个
+	for indexer.mergeOnce() {
+	}
+	utils.Expect(t, "1", len(indexer.segments))
+	utils.Expect(t, "2", indexer.segments[0].level)
+	_, numDocs = indexer.Lookup([]string{"all"}, []string{}, nil, true)
+	utils.Expect(t, "63", numDocs)
+
+	changed := indexer.Compact()
+	utils.Expect(t, "map[all:true]", changed)
+	utils.Expect(t, "1", len(indexer.segments))
+	utils.Expect(t, "63", indexer.segments[0].index["all"].NumDocs)
+	utils.Expect(t, "31", indexer.segments[0].index["even"].NumDocs)
+	indices, _ = indexer.Postings("all", 0, 5)
+	utils.Expect(t, "[1 2 4]", indices.DocIds)
+
+	// 关闭后台合并之后仍可冻结缓冲区
+	indexer.Close()
+	indexer.Close()
+	for docId := uint64(65); docId <= 72; docId++ {
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId: docId, TokenLength: 1, Keywords: []types.KeywordIndex{{"all", 1, []int{}}},
+		}, make(chan bool))
+	}
+	_, numDocs = indexer.Lookup([]string{"all"}, []string{}, nil, true)
+	utils.Expect(t, "71", numDocs)
+}
+
+func TestDocTable(t *testing.T) {
+	expected := make(map[uint64]uint64)
+	table := new(docTable)
+	for i := 0; i < 5000; i++ {
+		// DocId间隔固定以及只在高位不同的文档
+		docId := uint64(rand.Intn(1000)) << uint(rand.Intn(3)*30)
+		if rand.Intn(3) == 0 {
+			table = table.remove(docId)
+			delete(expected, docId)
+		} else {
+			table = table.set(docId, &docState{seq: uint64(i)})
+			expected[docId] = uint64(i)
+		}
+	}
+	utils.Expect(t, fmt.Sprint(len(expected)), table.size)
+	for docId, seq := range expected {
+		utils.Expect(t, fmt.Sprint(seq), table.get(docId).seq)
+	}
+
+	// 修改不影响已经取得的表
+	snapshot := table
+	for docId := range expected {
+		table = table.remove(docId)
+	}
+	utils.Expect(t, "0", table.size)
+	utils.Expect(t, "true", table.root == nil)
+	utils.Expect(t, fmt.Sprint(len(expected)), snapshot.size)
+	for docId, seq := range expected {
+		utils.Expect(t, fmt.Sprint(seq), snapshot.get(docId).seq)
+		utils.Expect(t, "true", table.get(docId) == nil)
+	}
+}
+
+func TestLookupSnapshot(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	addDocument := func(docId uint64, keyword string, price int64) {
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId:      docId,
+			Keywords:   []types.KeywordIndex{{keyword, 0, nil}},
+			Attributes: map[string]types.AttributeValue{"Price": {Int: price}},
+			GeoPoints:  map[string]types.GeoPoint{"Location": {Lat: float64(price), Lon: 0}},
+		}, make(chan bool))
+	}
+	for docId := uint64(1); docId <= 3; docId++ {
+		addDocument(docId, "a", int64(docId))
+	}
+
+	// 取得快照之后的修改不影响快照，也不需要等待用快照查找的一方
+	query := types.TermQuery("a")
+	indexer.InvertedIndexShard.RLock()
+	view := indexer.newIndexView(map[string]bool{"a": true})
+	indexer.InvertedIndexShard.RUnlock()
+	indexer.RemoveDoc(2)
+	addDocument(3, "b", 30)
+	addDocument(4, "a", 4)
+	utils.Expect(t, "[1 2 3]", indexer.evaluateQuery(view, &query))
+	utils.Expect(t, "3", view.docs.size)
+	utils.Expect(t, "{false 3 0}", view.docs.get(3).attributes["Price"])
+	docs, _ := indexer.Lookup([]string{"a"}, nil, nil, false)
+	utils.Expect(t, "[4 0 []] [1 0 []] ", indexedDocsToString(docs, 0))
+	value, _ := indexer.Attribute(3, "Price")
+	utils.Expect(t, "{false 30 0}", value)
+
+	// 修改文档的同时用范围条件、地理范围条件和聚合查找
+	done := make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				addDocument(uint64(i%8), "a", int64(i%50))
+				if i%3 == 0 {
+					indexer.RemoveDoc(uint64(i % 5))
+				}
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		_, _, _, _, err := indexer.LookupContext(context.Background(), &query, nil, nil, types.LookupOptions{
+			Filters:      []types.RangeFilter{{Attribute: "Price", Min: 10}},
+			GeoFilters:   []types.GeoFilter{{Attribute: "Location", Box: &types.GeoBox{Max: types.GeoPoint{Lat: 40, Lon: 1}}}},
+			Aggregations: []types.AggregationRequest{{Attribute: "Price", Interval: 10}},
+			DistanceSort: &types.DistanceSort{Attribute: "Location"},
+		})
+		utils.Expect(t, "<nil>", err)
+	}
+	close(done)
+}
+
+func TestLookupTopK(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{
+		IndexType:      types.FrequenciesIndex,
+		BM25Parameters: &types.BM25Parameters{K1: 2, B: 0.75},
+	})
+	indexer.maxBufferDocs = 500
+
+	// 关键词越靠后越稀有，词频和文档长度随机
+	random := rand.New(rand.NewSource(1))
+	tokens := []string{"a", "b", "c", "d", "e"}
+	addDocument := func(docId uint64) {
+		var keywords []types.KeywordIndex
+		for i, token := range tokens {
+			if random.Intn(i+2) == 0 {
+				keywords = append(keywords, types.KeywordIndex{token, float32(1 + random.Intn(5)), nil})
+			}
+		}
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId: docId, TokenLength: float32(5 + random.Intn(50)), Keywords: keywords,
+		}, make(chan bool))
+	}
+	for docId := uint64(1); docId <= 3000; docId++ {
+		addDocument(docId)
+	}
+	for indexer.mergeOnce() {
+	}
+	for docId := uint64(1); docId <= 3000; docId += 7 {
+		addDocument(docId)
+	}
+	for docId := uint64(2); docId <= 3000; docId += 11 {
+		indexer.RemoveDoc(docId)
+	}
+
+	// 和全部评分后排序的结果相同
+	ctx := context.Background()
+	for _, query := range [][]string{{"a"}, {"e", "d"}, {"a", "b", "c", "d", "e"}, {"e", "e", "x"}} {
+		for _, k := range []int{1, 10, 100} {
+			or := types.OrQuery()
+			for _, token := range query {
+				or.Children = append(or.Children, types.TermQuery(token))
+			}
+			expected, total, _, _, _ := indexer.LookupContext(ctx, &or, nil, nil, types.LookupOptions{})
+			sort.Stable(sort.Reverse(indexedDocsByBM25(expected)))
+			if len(expected) > k {
+				expected = expected[:k]
+			}
+			sort.Sort(sort.Reverse(indexedDocsByDocId(expected)))
+
+			docs, numDocs, numScored, _ := indexer.LookupTopK(ctx, query, nil, nil, nil, k)
+			utils.Expect(t, indexedDocsToString(expected, 0), indexedDocsToString(docs, 0))
+			utils.Expect(t, fmt.Sprint(total), numDocs)
+			// 多个关键词时大部分文档被跳过
+			if len(query) == 5 && numScored > total/2 {
+				t.Errorf("%v k=%d: 评分了%d个文档中的%d个", query, k, total, numScored)
+			}
+		}
+	}
+
+	// 标签和docIds作为附加条件
+	docs, numDocs, _, _ := indexer.LookupTopK(ctx, []string{"a"}, []string{"e"}, map[uint64]bool{1: true, 8: true, 15: true}, nil, 10)
+	expected, total, _, _, _ := indexer.LookupContext(ctx, &types.Query{Operator: types.QueryTerm, Token: "a"},
+		[]string{"e"}, map[uint64]bool{1: true, 8: true, 15: true}, types.LookupOptions{})
+	utils.Expect(t, indexedDocsToString(expected, 0), indexedDocsToString(docs, 0))
+	utils.Expect(t, fmt.Sprint(total), numDocs)
+}
+
+// 为了按BM25排序，BM25相同时保持原来的顺序
+type indexedDocsByBM25 []types.IndexedDocument
+
+func (docs indexedDocsByBM25) Len() int {
+	return len(docs)
+}
+func (docs indexedDocsByBM25) Swap(i, j int) {
+	docs[i], docs[j] = docs[j], docs[i]
+}
+func (docs indexedDocsByBM25) Less(i, j int) bool {
+	return docs[i].BM25 < docs[j].BM25
+}
+
+func TestLookupWithFields(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{
+		IndexType:      types.FrequenciesIndex,
+		BM25Parameters: &types.BM25Parameters{K1: 1, B: 1},
+		FieldBoosts:    map[string]float32{"title": 3},
+	})
+	titleToken := types.FieldToken("title", "token1")
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:             1,
+		TokenLength:       4,
+		FieldTokenLengths: map[string]float32{"title": 2},
+		Keywords:          []types.KeywordIndex{{"token1", 1, nil}, {titleToken, 1, nil}},
+	}, make(chan bool))
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:       2,
+		TokenLength: 4,
+		Keywords:    []types.KeywordIndex{{"token1", 1, nil}, {"token2", 1, nil}},
+	}, make(chan bool))
+	utils.Expect(t, "map[title:2]", indexer.FieldTokenLengths)
+
+	// 标题的平均长度为1，Content的平均长度为(8-2)/2=3，IDF = log2(2/2+1) = 1
+	// doc1: tf = 3*1/(2/1) = 1.5, BM25F = 1.5*2/(1+1.5) = 1.2
+	// doc2: tf = 1/(4/3) = 0.75, BM25F = 0.75*2/(1+0.75) = 0.857
+	docs, _ := indexer.Lookup([]string{"token1"}, nil, nil, false)
+	utils.Expect(t, "2", len(docs))
+	utils.Expect(t, "857", int(docs[0].BM25*1000))
+	utils.Expect(t, "1200", int(docs[1].BM25*1000))
+
+	// 只在标题中查找，IDF = log2(2/1+1)
+	query := types.FieldTermQuery("title", "token1")
+	docs, _ = indexer.LookupQuery(&query, nil, nil, false)
+	utils.Expect(t, "1", len(docs))
+	utils.Expect(t, "1901", int(docs[0].BM25*1000))
+	query = types.FieldTermQuery("title", "token2")
+	_, numDocs := indexer.LookupQuery(&query, nil, nil, true)
+	utils.Expect(t, "0", numDocs)
+
+	// 限定字段的搜索键只在前缀包含字段名时提示
+	utils.Expect(t, "[{token1 2} {token2 1}]", indexer.Suggest(""))
+	utils.Expect(t, "1", len(indexer.Suggest(types.FieldToken("title", ""))))
+
+	// 删除包含字段的文档后等同于BM25
+	indexer.RemoveDoc(1)
+	utils.Expect(t, "map[]", indexer.FieldTokenLengths)
+	utils.Expect(t, "[{token1 1} {token2 1}]", indexer.Suggest(""))
+	utils.Expect(t, "[]", indexer.Suggest(titleToken))
+}
+
+func TestLookupWithFilters(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	for docId := uint64(1); docId <= 5; docId++ {
+		attributes := map[string]types.AttributeValue{"Price": {Int: int64(docId * 10)}}
+		if docId%2 == 1 {
+			attributes["Rating"] = types.AttributeValue{IsFloat: true, Float: float64(docId) / 2}
+		}
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId:      docId,
+			Keywords:   []types.KeywordIndex{{"token1", 0, nil}},
+			Attributes: attributes,
+		}, make(chan bool))
+	}
+
+	ctx := context.Background()
+	query := types.TermQuery("token1")
+	lookup := func(filters ...types.RangeFilter) string {
+		docs, _, _, _, err := indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{Filters: filters})
+		if err != nil {
+			return err.Error()
+		}
+		return indexedDocsToString(docs, 0)
+	}
+	utils.Expect(t, "[4 0 []] [3 0 []] [2 0 []] ", lookup(types.RangeFilter{Attribute: "Price", Min: 20, Max: int64(40)}))
+	utils.Expect(t, "[3 0 []] ", lookup(types.RangeFilter{Attribute: "Price", Min: 20, Max: 40, ExclusiveMin: true, ExclusiveMax: true}))
+	// 整数和浮点数之间按浮点数比较，没有该属性的文档不满足条件
+	utils.Expect(t, "[5 0 []] [3 0 []] ", lookup(types.RangeFilter{Attribute: "Rating", Min: 1.5}))
+	utils.Expect(t, "[3 0 []] ", lookup(types.RangeFilter{Attribute: "Rating", Min: 1}, types.RangeFilter{Attribute: "Price", Max: 35.5}))
+	utils.Expect(t, "", lookup(types.RangeFilter{Attribute: "Weight", Max: 1}))
+	utils.Expect(t, "属性Price的范围条件类型不支持: string", lookup(types.RangeFilter{Attribute: "Price", Min: "20"}))
+	_, numDocs, _, _, _ := indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{
+		Filters: []types.RangeFilter{{Attribute: "Price", Min: 30}}, CountDocsOnly: true})
+	utils.Expect(t, "3", numDocs)
+
+	// 更新文档时替换全部属性，删除文档时清除属性
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:      5,
+		Keywords:   []types.KeywordIndex{{"token1", 0, nil}},
+		Attributes: map[string]types.AttributeValue{"Price": {Int: 1}},
+	}, make(chan bool))
+	utils.Expect(t, "[3 0 []] [1 0 []] ", lookup(types.RangeFilter{Attribute: "Rating"}))
+	indexer.RemoveDoc(3)
+	_, found := indexer.Attribute(3, "Price")
+	utils.Expect(t, "false", found)
+	value, _ := indexer.Attribute(5, "Price")
+	utils.Expect(t, "{false 1 0}", value)
+}
+
+func TestLookupWithFacets(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.FrequenciesIndex})
+	categories := []string{"category:book", "category:music", "category:book", "category:film", "category:book"}
+	for i, category := range categories {
+		docId := uint64(i + 1)
+		keywords := []types.KeywordIndex{{"token1", 1, nil}, {category, 0, nil}, {types.LabelToken(category), 0, nil}}
+		if docId%2 == 0 {
+			keywords = append(keywords, types.KeywordIndex{"token2", 1, nil},
+				types.KeywordIndex{"color:red", 0, nil}, types.KeywordIndex{types.LabelToken("color:red"), 0, nil})
+		}
+		if docId == 1 {
+			// 以前缀开头的文本关键词不是标签，不统计
+			keywords = append(keywords, types.KeywordIndex{"category:text", 1, nil})
+		}
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId:      docId,
+			Keywords:   keywords,
+			Attributes: map[string]types.AttributeValue{"Price": {Int: int64(docId)}},
+		}, make(chan bool))
+	}
+
+	ctx := context.Background()
+	facets := []types.FacetRequest{{Prefix: "category:"}, {Prefix: "color:"}}
+	query := types.TermQuery("token1")
+	docs, numDocs, counts, _, err := indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{Facets: facets})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "5", len(docs))
+	utils.Expect(t, "5", numDocs)
+	utils.Expect(t, "[{category: [{category:book 3} {category:film 1} {category:music 1}]} {color: [{color:red 2}]}]", counts)
+	_, _, _, _, err = indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{Facets: []types.FacetRequest{{}}})
+	utils.Expect(t, "分面统计的前缀不能为空", err)
+	utils.Expect(t, "[{category:book 3} {category:film 1} {category:music 1} {category:text 1}]", indexer.Suggest("category:"))
+
+	// 统计满足标签、DocIds和范围条件的全部文档，和是否返回文档无关
+	_, numDocs, counts, _, _ = indexer.LookupContext(ctx, &query, []string{"color:red"}, nil,
+		types.LookupOptions{Facets: facets, CountDocsOnly: true})
+	utils.Expect(t, "2", numDocs)
+	utils.Expect(t, "[{category: [{category:film 1} {category:music 1}]} {color: [{color:red 2}]}]", counts)
+	filters := []types.RangeFilter{{Attribute: "Price", Min: 2}}
+	_, _, counts, _, _ = indexer.LookupContext(ctx, &query, nil, map[uint64]bool{1: true, 3: true, 4: true},
+		types.LookupOptions{Filters: filters, Facets: facets[:1], CountDocsOnly: true})
+	utils.Expect(t, "[{category: [{category:book 1} {category:film 1}]}]", counts)
+
+	// 删除文档后不再统计
+	indexer.RemoveDoc(4)
+	query = types.TermQuery("token2")
+	_, _, counts, _, _ = indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{Facets: facets})
+	utils.Expect(t, "[{category: [{category:music 1}]} {color: [{color:red 1}]}]", counts)
+	query = types.TermQuery("token3")
+	_, _, counts, _, _ = indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{Facets: facets})
+	utils.Expect(t, "[{category: []} {color: []}]", counts)
+
+	// 合并各shard时对文档数求和并按TopN截断
+	merged := MergeFacets([]types.FacetRequest{{Prefix: "category:", TopN: 2}}, [][]types.Facet{
+		{{Prefix: "category:", Counts: []types.FacetCount{{"category:book", 3}, {"category:film", 1}}}},
+		nil,
+		{{Prefix: "category:", Counts: []types.FacetCount{{"category:music", 2}, {"category:film", 2}}}},
+	})
+	utils.Expect(t, "[{category: [{category:book 3} {category:film 3}]}]", merged)
+}
+
+func TestLookupWithAggregations(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	hour := int64(time.Hour)
+	for docId := uint64(1); docId <= 6; docId++ {
+		attributes := map[string]types.AttributeValue{"Timestamp": {Int: int64(docId) * hour}}
+		if docId != 6 {
+			attributes["Reposts"] = types.AttributeValue{Int: int64(docId * docId)}
+		}
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId:      docId,
+			Keywords:   []types.KeywordIndex{{"token1", 0, nil}},
+			Attributes: attributes,
+		}, make(chan bool))
+	}
+
+	ctx := context.Background()
+	query := types.TermQuery("token1")
+	aggregations := []types.AggregationRequest{
+		{Attribute: "Reposts", Interval: 10},
+		{Attribute: "Timestamp", DateInterval: 2 * time.Hour},
+		{Attribute: "Weight"},
+	}
+	filters := []types.RangeFilter{{Attribute: "Timestamp", Min: 2 * hour}}
+	_, numDocs, _, aggregated, err := indexer.LookupContext(ctx, &query, nil, nil, types.LookupOptions{
+		Filters: filters, Aggregations: aggregations, CountDocsOnly: true})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "5", numDocs)
+	// 没有该属性的文档不参与统计
+	utils.Expect(t, "Reposts 4 {false 4 0} {false 25 0} 54 13.5", fmt.Sprint(aggregated[0].Attribute, " ", aggregated[0].Count, " ",
+		aggregated[0].Min, " ", aggregated[0].Max, " ", aggregated[0].Sum, " ", aggregated[0].Avg))
+	utils.Expect(t, "[{{true 0 0} 2} {{true 0 10} 1} {{true 0 20} 1}]", aggregated[0].Buckets)
+	utils.Expect(t, "[{{false 7200000000000 0} 2} {{false 14400000000000 0} 2} {{false 21600000000000 0} 1}]", aggregated[1].Buckets)
+	utils.Expect(t, "1970-01-01 02:00:00 +0000 UTC", aggregated[1].Buckets[0].Time())
+	utils.Expect(t, "0 []", fmt.Sprint(aggregated[2].Count, " ", aggregated[2].Buckets))
+
+	// 合并各shard时重新计算平均值
+	merged := MergeAggregations(aggregations[:1], [][]types.Aggregation{
+		aggregated[:1],
+		nil,
+		{{Attribute: "Reposts", Count: 1, Min: types.AttributeValue{Int: 1}, Max: types.AttributeValue{Int: 1}, Sum: 1, Avg: 1,
+			Buckets: []types.Bucket{{Key: types.AttributeValue{IsFloat: true}, NumDocs: 1}}}},
+	})
+	utils.Expect(t, "5 {false 1 0} 11", fmt.Sprint(merged[0].Count, " ", merged[0].Min, " ", merged[0].Avg))
+	utils.Expect(t, "[{{true 0 0} 3} {{true 0 10} 1} {{true 0 20} 1}]", merged[0].Buckets)
+
+	utils.Expect(t, "属性Reposts的聚合不能同时设置Interval和DateInterval",
+		ValidateAggregations([]types.AggregationRequest{{Attribute: "Reposts", Interval: 1, DateInterval: time.Second}}))
+	utils.Expect(t, "聚合的属性名不能为空", ValidateAggregations([]types.AggregationRequest{{}}))
+}
+
+func TestLookupWithGeoFilters(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(0, types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	// 天安门、王府井、颐和园、上海、东京
+	points := []types.GeoPoint{{39.9087, 116.3975}, {39.9149, 116.4109}, {39.9999, 116.2755}, {31.2304, 121.4737}, {35.6895, 139.6917}}
+	for i, point := range points {
+		indexer.AddDocument(&types.DocumentIndex{
+			DocId:     uint64(i + 1),
+			Keywords:  []types.KeywordIndex{{"token1", 0, nil}},
+			GeoPoints: map[string]types.GeoPoint{"Location": point},
+		}, make(chan bool))
+	}
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:    6,
+		Keywords: []types.KeywordIndex{{"token1", 0, nil}},
+	}, make(chan bool))
+
+	ctx := context.Background()
+	query := types.TermQuery("token1")
+	lookup := func(options types.LookupOptions) string {
+		docs, _, _, _, err := indexer.LookupContext(ctx, &query, nil, nil, options)
+		if err != nil {
+			return err.Error()
+		}
+		return indexedDocsToString(docs, 0)
+	}
+	center := points[0]
+	utils.Expect(t, "[2 0 []] [1 0 []] ", lookup(types.LookupOptions{GeoFilters: []types.GeoFilter{
+		{Attribute: "Location", Center: &center, Radius: 5000}}}))
+	utils.Expect(t, "[3 0 []] [2 0 []] [1 0 []] ", lookup(types.LookupOptions{GeoFilters: []types.GeoFilter{
+		{Attribute: "Location", Center: &center, Radius: 50000}}}))
+	box := types.GeoBox{Min: types.GeoPoint{Lat: 30, Lon: 116.3}, Max: types.GeoPoint{Lat: 40, Lon: 125}}
+	utils.Expect(t, "[4 0 []] [2 0 []] [1 0 []] ", lookup(types.LookupOptions{GeoFilters: []types.GeoFilter{{Attribute: "Location", Box: &box}}}))
+	// 同时满足矩形和圆形范围，范围覆盖的网格过多时不预先筛选
+	utils.Expect(t, "[4 0 []] ", lookup(types.LookupOptions{GeoFilters: []types.GeoFilter{
+		{Attribute: "Location", Box: &box, Center: &types.GeoPoint{Lat: 35, Lon: 130}, Radius: 1000000}}}))
+	utils.Expect(t, "", lookup(types.LookupOptions{GeoFilters: []types.GeoFilter{{Attribute: "Position", Box: &box}}}))
+
+	// 计算到排序中心的距离，没有该属性的文档为正无穷
+	docs, _, _, _, _ := indexer.LookupContext(ctx, &query, nil, map[uint64]bool{2: true, 6: true}, types.LookupOptions{
+		DistanceSort: &types.DistanceSort{Attribute: "Location", Center: center}})
+	utils.Expect(t, "6 +Inf", fmt.Sprint(docs[0].DocId, " ", docs[0].Distance))
+	utils.Expect(t, "2 1335", fmt.Sprintf("%d %.0f", docs[1].DocId, docs[1].Distance))
+
+	// 移动和删除文档后网格随之更新
+	indexer.AddDocument(&types.DocumentIndex{
+		DocId:     5,
+		Keywords:  []types.KeywordIndex{{"token1", 0, nil}},
+		GeoPoints: map[string]types.GeoPoint{"Location": {39.91, 116.4}},
+	}, make(chan bool))
+	indexer.RemoveDoc(2)
+	utils.Expect(t, "[5 0 []] [1 0 []] ", lookup(types.LookupOptions{GeoFilters: []types.GeoFilter{
+		{Attribute: "Location", Center: &center, Radius: 5000}}}))
+	_, found := indexer.GeoPoint(2, "Location")
+	utils.Expect(t, "false", found)
+
+	utils.Expect(t, "属性Location的圆形范围不正确: {91 0} 1", ValidateGeoFilters([]types.GeoFilter{
+		{Attribute: "Location", Center: &types.GeoPoint{Lat: 91}, Radius: 1}}, nil))
+	utils.Expect(t, "true", ValidateGeoFilters([]types.GeoFilter{{Attribute: "Location", Box: &types.GeoBox{
+		Min: types.GeoPoint{Lat: 10, Lon: 170}, Max: types.GeoPoint{Lat: 20, Lon: -170}}}}, nil) != nil)
+	utils.Expect(t, "<nil>", ValidateGeoFilters(nil, &types.DistanceSort{Attribute: "Location", Center: center}))
 }
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"encoding/binary"
+	"github.com/Jarlene/wukong/types"
+	"sort"
+)
+
+// 压缩反向索引行时每块的文档数。加入文档使一块的文档数超过两倍时将其分为两块
+const postingBlockSize = 128
+
+// 压缩反向索引行，tokenLengths返回文档的关键词长度，用于记录各块中最短的文档长度，为nil时记为0
+func compressPostings(indices *types.KeywordIndices, tokenLengths func(docId uint64) float32) *types.PostingList {
+	list := &types.PostingList{NumDocs: len(indices.DocIds)}
+	for start := 0; start < len(indices.DocIds); start += postingBlockSize {
+		end := start + postingBlockSize
+		if end > len(indices.DocIds) {
+			end = len(indices.DocIds)
+		}
+		list.FirstDocIds = append(list.FirstDocIds, indices.DocIds[start])
+		list.Blocks = append(list.Blocks, compressBlock(indices, start, end, tokenLengths))
+	}
+	setListBounds(list)
+	return list
+}
+
+// 压缩indices中[start, end)位置的文档为一块并记录块中最短的文档长度，tokenLengths见compressPostings
+func compressBlock(indices *types.KeywordIndices, start, end int, tokenLengths func(docId uint64) float32) types.PostingBlock {
+	block := encodePostingBlock(indices, start, end)
+	if tokenLengths != nil {
+		block.MinTokenLength = tokenLengths(indices.DocIds[start])
+		for _, docId := range indices.DocIds[start+1 : end] {
+			if length := tokenLengths(docId); length < block.MinTokenLength {
+				block.MinTokenLength = length
+			}
+		}
+	}
+	return block
+}
+
+// 由各块重新计算整行的MaxFrequency和MinTokenLength
+func setListBounds(list *types.PostingList) {
+	for i := range list.Blocks {
+		block := &list.Blocks[i]
+		if i == 0 || block.MaxFrequency > list.MaxFrequency {
+			list.MaxFrequency = block.MaxFrequency
+		}
+		if i == 0 || block.MinTokenLength < list.MinTokenLength {
+			list.MinTokenLength = block.MinTokenLength
+		}
+	}
+}
+
+// 在indices的第position个位置插入（inserted为true）或者删除一个文档之后，只重新压缩list中受影响的一块，
+// 其余块原样保留。list是插入或删除之前indices压缩后的形式，为nil时压缩整行。
+//
+// 返回新的反向索引行，list本身不修改，已经引用它的查找快照仍然可以使用。
+// 在开头或末尾加入文档且第一块或最后一块已满时新开一块，一块的文档数超过postingBlockSize的两倍时分为两块，删除后为空的块去掉。
+func updatePostings(list *types.PostingList, indices *types.KeywordIndices, position int, inserted bool,
+	tokenLengths func(docId uint64) float32) *types.PostingList {
+	if list == nil || len(list.Blocks) == 0 {
+		return compressPostings(indices, tokenLengths)
+	}
+
+	// 找到position所在的块，start为该块第一个文档的位置
+	i, start := 0, 0
+	for i+1 < len(list.Blocks) && start+list.Blocks[i].NumDocs <= position {
+		start += list.Blocks[i].NumDocs
+		i++
+	}
+	end := start + list.Blocks[i].NumDocs
+	var firstDocIds []uint64
+	var blocks []types.PostingBlock
+	switch {
+	case !inserted:
+		end--
+		if end > start {
+			firstDocIds = []uint64{indices.DocIds[start]}
+			blocks = []types.PostingBlock{compressBlock(indices, start, end, tokenLengths)}
+		}
+	case position == end && i == len(list.Blocks)-1 && list.Blocks[i].NumDocs >= postingBlockSize:
+		firstDocIds = []uint64{list.FirstDocIds[i], indices.DocIds[position]}
+		blocks = []types.PostingBlock{list.Blocks[i], compressBlock(indices, position, position+1, tokenLengths)}
+	case position == 0 && list.Blocks[0].NumDocs >= postingBlockSize:
+		firstDocIds = []uint64{indices.DocIds[0], list.FirstDocIds[0]}
+		blocks = []types.PostingBlock{compressBlock(indices, 0, 1, tokenLengths), list.Blocks[0]}
+	case end+1-start > 2*postingBlockSize:
+		end++
+		middle := (start + end) / 2
+		firstDocIds = []uint64{indices.DocIds[start], indices.DocIds[middle]}
+		blocks = []types.PostingBlock{
+			compressBlock(indices, start, middle, tokenLengths),
+			compressBlock(indices, middle, end, tokenLengths),
+		}
+	default:
+		end++
+		firstDocIds = []uint64{indices.DocIds[start]}
+		blocks = []types.PostingBlock{compressBlock(indices, start, end, tokenLengths)}
+	}
+
+	updated := &types.PostingList{NumDocs: len(indices.DocIds)}
+	updated.FirstDocIds = make([]uint64, 0, len(list.FirstDocIds)+1)
+	updated.FirstDocIds = append(updated.FirstDocIds, list.FirstDocIds[:i]...)
+	updated.FirstDocIds = append(updated.FirstDocIds, firstDocIds...)
+	updated.FirstDocIds = append(updated.FirstDocIds, list.FirstDocIds[i+1:]...)
+	updated.Blocks = make([]types.PostingBlock, 0, len(list.Blocks)+1)
+	updated.Blocks = append(updated.Blocks, list.Blocks[:i]...)
+	updated.Blocks = append(updated.Blocks, blocks...)
+	updated.Blocks = append(updated.Blocks, list.Blocks[i+1:]...)
+	setListBounds(updated)
+	return updated
+}
+
+// 按tokenLengths重新记录各块和整行中最短的文档长度，用于载入时还不知道文档长度的反向索引行
+func setMinTokenLengths(list *types.PostingList, tokenLengths func(docId uint64) float32) {
+	var docIds []uint64
+	for i := range list.Blocks {
+		docIds = appendBlockDocIds(docIds[:0], list, i)
+		block := &list.Blocks[i]
+		block.MinTokenLength = tokenLengths(docIds[0])
+		for _, docId := range docIds[1:] {
+			if length := tokenLengths(docId); length < block.MinTokenLength {
+				block.MinTokenLength = length
+			}
+		}
+		if i == 0 || block.MinTokenLength < list.MinTokenLength {
+			list.MinTokenLength = block.MinTokenLength
+		}
+	}
+}
+
+// 解压整个反向索引行
+func decompressPostings(list *types.PostingList) *types.KeywordIndices {
+	indices := new(types.KeywordIndices)
+	for i := range list.Blocks {
+		block := decodePostingBlock(list, i, true)
+		indices.DocIds = append(indices.DocIds, block.DocIds...)
+		indices.Frequencies = append(indices.Frequencies, block.Frequencies...)
+		indices.Locations = append(indices.Locations, block.Locations...)
+		indices.Positions = append(indices.Positions, block.Positions...)
+	}
+	return indices
+}
+
+// 解压反向索引行中的全部DocId
+func decompressDocIds(list *types.PostingList) []uint64 {
+	docIds := make([]uint64, 0, list.NumDocs)
+	for i := range list.Blocks {
+		docIds = appendBlockDocIds(docIds, list, i)
+	}
+	return docIds
+}
+
+// 压缩indices中[start, end)位置的文档，第一个DocId不在块中，由调用者存入FirstDocIds
+func encodePostingBlock(indices *types.KeywordIndices, start, end int) types.PostingBlock {
+	block := types.PostingBlock{NumDocs: end - start}
+	buf := make([]byte, binary.MaxVarintLen64)
+	for i := start + 1; i < end; i++ {
+		block.DocIds = append(block.DocIds, buf[:binary.PutUvarint(buf, indices.DocIds[i]-indices.DocIds[i-1])]...)
+	}
+	if len(indices.Frequencies) > 0 {
+		block.Frequencies = append([]float32{}, indices.Frequencies[start:end]...)
+		for _, frequency := range block.Frequencies {
+			if frequency > block.MaxFrequency {
+				block.MaxFrequency = frequency
+			}
+		}
+	}
+	if len(indices.Locations) > 0 {
+		for _, locations := range indices.Locations[start:end] {
+			if frequency := float32(len(locations)); frequency > block.MaxFrequency {
+				block.MaxFrequency = frequency
+			}
+			block.Locations = append(block.Locations, buf[:binary.PutUvarint(buf, uint64(len(locations)))]...)
+			previous := 0
+			for _, location := range locations {
+				block.Locations = append(block.Locations, buf[:binary.PutVarint(buf, int64(location-previous))]...)
+				previous = location
+			}
+		}
+		for i := start; i < end; i++ {
+			var positions []int
+			if i < len(indices.Positions) {
+				positions = indices.Positions[i]
+			}
+			block.Positions = append(block.Positions, buf[:binary.PutUvarint(buf, uint64(len(positions)))]...)
+			previous := 0
+			for _, position := range positions {
+				block.Positions = append(block.Positions, buf[:binary.PutVarint(buf, int64(position-previous))]...)
+				previous = position
+			}
+		}
+	}
+	return block
+}
+
+// 将第i块的DocId解压到docIds之后
+func appendBlockDocIds(docIds []uint64, list *types.PostingList, i int) []uint64 {
+	docId := list.FirstDocIds[i]
+	docIds = append(docIds, docId)
+	data := list.Blocks[i].DocIds
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		docId += delta
+		docIds = append(docIds, docId)
+	}
+	return docIds
+}
+
+// 解压第i块，withPayload为false时只解压DocId
+func decodePostingBlock(list *types.PostingList, i int, withPayload bool) *types.KeywordIndices {
+	block := &list.Blocks[i]
+	indices := &types.KeywordIndices{
+		DocIds: appendBlockDocIds(make([]uint64, 0, block.NumDocs), list, i),
+	}
+	if !withPayload {
+		return indices
+	}
+	if len(block.Frequencies) > 0 {
+		indices.Frequencies = append([]float32{}, block.Frequencies...)
+	}
+	if len(block.Locations) > 0 {
+		indices.Locations = decodeLocations(block.Locations, block.NumDocs, false)
+		indices.Positions = decodeLocations(block.Positions, block.NumDocs, true)
+	}
+	return indices
+}
+
+// 解压numDocs个文档的位置列表或者序号列表。data为空时各文档均为nil，omitEmpty为true时个数为0的文档也为nil
+func decodeLocations(data []byte, numDocs int, omitEmpty bool) [][]int {
+	lists := make([][]int, numDocs)
+	for j := 0; j < numDocs && len(data) > 0; j++ {
+		count, n := binary.Uvarint(data)
+		data = data[n:]
+		if count == 0 && omitEmpty {
+			continue
+		}
+		list := make([]int, count)
+		previous := 0
+		for k := range list {
+			delta, n := binary.Varint(data)
+			data = data[n:]
+			previous += int(delta)
+			list[k] = previous
+		}
+		lists[j] = list
+	}
+	return lists
+}
+
+// 二分查找FirstDocIds，返回可能包含docId的块
+func findPostingBlock(list *types.PostingList, docId uint64) int {
+	i := sort.Search(len(list.FirstDocIds), func(i int) bool {
+		return list.FirstDocIds[i] > docId
+	}) - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// 在压缩的反向索引行中按DocId查找文档的游标
+//
+// 游标缓存最近解压的一块，按DocId的顺序查找时每块最多解压一次，不包含要找的文档的块不解压
+type postingCursor struct {
+	list        *types.PostingList
+	withPayload bool
+
+	// 已解压的块及其序号，-1表示尚未解压
+	block   *types.KeywordIndices
+	current int
+}
+
+// 新建游标，withPayload为false时只解压DocId。list为nil时查找总是失败
+func newPostingCursor(list *types.PostingList, withPayload bool) *postingCursor {
+	return &postingCursor{list: list, withPayload: withPayload, current: -1}
+}
+
+// 查找文档，找到时返回它在cursor.block中的位置
+func (cursor *postingCursor) seek(docId uint64) (int, bool) {
+	if cursor.list == nil || len(cursor.list.Blocks) == 0 {
+		return 0, false
+	}
+	cursor.load(findPostingBlock(cursor.list, docId))
+	docIds := cursor.block.DocIds
+	position := sort.Search(len(docIds), func(j int) bool { return docIds[j] >= docId })
+	return position, position < len(docIds) && docIds[position] == docId
+}
+
+// 解压第i块到cursor.block，已经解压时不重复解压
+func (cursor *postingCursor) load(i int) {
+	if i != cursor.current {
+		cursor.block = decodePostingBlock(cursor.list, i, cursor.withPayload)
+		cursor.current = i
+	}
+}
+
+// 游标当前位置的词频和位置，块中没有这些数据时返回零值
+func (cursor *postingCursor) frequency(position int) float32 {
+	if len(cursor.block.Frequencies) == 0 {
+		return 0
+	}
+	return cursor.block.Frequencies[position]
+}
+func (cursor *postingCursor) locations(position int) []int {
+	if len(cursor.block.Locations) == 0 {
+		return nil
+	}
+	return cursor.block.Locations[position]
+}
+func (cursor *postingCursor) positions(position int) []int {
+	if len(cursor.block.Positions) == 0 {
+		return nil
+	}
+	return cursor.block.Positions[position]
+}
+
+// 估计反向索引行压缩后和压缩前占用的内存字节数
+func postingsSize(list *types.PostingList) (compressed, uncompressed int) {
+	const sliceHeader = 24
+	compressed = 8 + 2*sliceHeader + 8*len(list.FirstDocIds)
+	for i := range list.Blocks {
+		block := &list.Blocks[i]
+		compressed += 8 + 4*sliceHeader + len(block.DocIds) + 4*len(block.Frequencies) + len(block.Locations) + len(block.Positions)
+		uncompressed += 8*block.NumDocs + 4*len(block.Frequencies)
+		if len(block.Locations) > 0 {
+			decoded := decodePostingBlock(list, i, true)
+			for j, locations := range decoded.Locations {
+				uncompressed += 2*sliceHeader + 8*len(locations) + 8*len(decoded.Positions[j])
+			}
+		}
+	}
+	uncompressed += 4 * sliceHeader
+	return
+}
@@ -0,0 +1,328 @@
+package core
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"sort"
+)
+
+// 将查询树中的全部搜索键（包括QueryNot下的）加入terms
+func queryTerms(query *types.Query, terms map[string]bool) map[string]bool {
+	if query.Operator == types.QueryTerm {
+		if query.Token != "" {
+			terms[query.Key()] = true
+		}
+		return terms
+	}
+	for i := range query.Children {
+		queryTerms(&query.Children[i], terms)
+	}
+	return terms
+}
+
+// 在反向索引的快照中对布尔查询树求值，返回满足条件的DocId，按照从小到大排序
+func (indexer *Indexer) evaluateQuery(view *indexView, query *types.Query) []uint64 {
+	switch query.Operator {
+	case types.QueryTerm:
+		term := view.term(query.Key())
+		if term == nil {
+			return nil
+		}
+		return view.docIds(term)
+
+	case types.QueryAnd:
+		// 搜索键子节点不整体解压，最短的搜索键逐块遍历，其余的求交集时通过跳表只解压可能包含结果的块
+		var included, excluded [][]uint64
+		var includedTerms, excludedTerms []*termPostings
+		for i := range query.Children {
+			child := &query.Children[i]
+			if child.Operator == types.QueryNot {
+				for j := range child.Children {
+					if grandchild := &child.Children[j]; grandchild.Operator == types.QueryTerm {
+						if term := view.term(grandchild.Key()); term != nil {
+							excludedTerms = append(excludedTerms, term)
+						}
+						continue
+					}
+					excluded = append(excluded, indexer.evaluateQuery(view, &child.Children[j]))
+				}
+				continue
+			}
+			if child.Operator == types.QueryTerm {
+				term := view.term(child.Key())
+				if term == nil {
+					// 交集中有一项为空时无需继续
+					return nil
+				}
+				includedTerms = append(includedTerms, term)
+				continue
+			}
+			docIds := indexer.evaluateQuery(view, child)
+			if len(docIds) == 0 {
+				return nil
+			}
+			included = append(included, docIds)
+		}
+		if len(included) == 0 && len(includedTerms) == 0 {
+			return nil
+		}
+
+		// 从最短的列表开始求交集
+		sort.Sort(docIdsByLength(included))
+		sort.Sort(termsByLength(includedTerms))
+		var result []uint64
+		if len(includedTerms) == 0 || (len(included) > 0 && len(included[0]) <= includedTerms[0].numDocs) {
+			result = included[0]
+			included = included[1:]
+		} else {
+			result = view.intersectTerms(includedTerms[0], includedTerms[1:])
+			includedTerms = nil
+		}
+		for _, docIds := range included {
+			result = intersectDocIds(result, docIds)
+			if len(result) == 0 {
+				return nil
+			}
+		}
+		for _, term := range includedTerms {
+			result = view.filter(result, term, true)
+			if len(result) == 0 {
+				return nil
+			}
+		}
+		for _, docIds := range excluded {
+			result = excludeDocIds(result, docIds)
+		}
+		for _, term := range excludedTerms {
+			result = view.filter(result, term, false)
+		}
+		return result
+
+	case types.QueryPhrase:
+		return indexer.evaluatePhrase(view, query)
+
+	case types.QueryOr:
+		var result []uint64
+		for i := range query.Children {
+			if query.Children[i].Operator == types.QueryNot {
+				continue
+			}
+			result = unionDocIds(result, indexer.evaluateQuery(view, &query.Children[i]))
+		}
+		return result
+	}
+	return nil
+}
+
+// 求短语节点匹配的文档：先求各关键词的交集，再用关键词序号检查相邻关系
+func (indexer *Indexer) evaluatePhrase(view *indexView, query *types.Query) []uint64 {
+	if len(query.Children) == 0 {
+		return nil
+	}
+	tokenLengths := make([]int, len(query.Children))
+	terms := make([]*termPostings, len(query.Children))
+	for i, child := range query.Children {
+		if child.Operator != types.QueryTerm || child.Token == "" {
+			// 短语中只能包含搜索键
+			return nil
+		}
+		term := view.term(child.Key())
+		if term == nil {
+			return nil
+		}
+		// 没有关键词序号的旧数据按关键词本身的字节长度计算相邻关系
+		_, token := types.SplitFieldToken(child.Key())
+		tokenLengths[i] = len(token)
+		terms[i] = term
+	}
+
+	sorted := append([]*termPostings{}, terms...)
+	sort.Sort(termsByLength(sorted))
+	result := view.intersectTerms(sorted[0], sorted[1:])
+	if len(result) == 0 {
+		return nil
+	}
+	if indexer.initOptions.IndexType != types.LocationsIndex || len(terms) == 1 {
+		return result
+	}
+
+	var matched []uint64
+	cursors := make([]*termCursor, len(terms))
+	for i, term := range terms {
+		cursors[i] = view.newTermCursor(term, true)
+	}
+	positions := make([][]int, len(terms))
+	locations := make([][]int, len(terms))
+	unitLengths := make([]int, len(terms))
+	for i := range unitLengths {
+		unitLengths[i] = 1
+	}
+	for _, docId := range result {
+		withPositions := true
+		for i, cursor := range cursors {
+			segmentCursor, position, _ := cursor.seek(docId)
+			positions[i] = segmentCursor.positions(position)
+			locations[i] = segmentCursor.locations(position)
+			if len(positions[i]) != len(locations[i]) {
+				withPositions = false
+			}
+		}
+		var gap int
+		if withPositions {
+			gap = computePhraseGap(positions, unitLengths)
+		} else {
+			gap = computePhraseGap(locations, tokenLengths)
+		}
+		if gap >= 0 && gap <= query.Slop {
+			matched = append(matched, docId)
+		}
+	}
+	return matched
+}
+
+// 计算搜索键在文本中按顺序出现时的最小间隔
+//
+// 假定第 i 个搜索键出现在文本中的位置为 P_i，长度 L_i，要求
+//
+//	P_(i+1) >= P_i + L_i
+//
+// 间隔为 Sum(P_(i+1) - P_i - L_i)，关键词严格相邻时为0。位置为关键词序号时长度均为1，
+// 间隔即为相邻搜索键之间的关键词个数之和。
+// 和computeTokenProximity一样由动态规划实现，不存在满足顺序的位置组合时返回-1。
+func computePhraseGap(locations [][]int, lengths []int) int {
+	// currentMinValues[j]为前 i 个搜索键以第 j 个位置结尾时的最小间隔，-1表示不可达
+	currentLocations := locations[0]
+	currentMinValues := make([]int, len(currentLocations))
+	for i := 1; i < len(lengths); i++ {
+		nextLocations := locations[i]
+		nextMinValues := make([]int, len(nextLocations))
+
+		// 间隔为 next - current - L，因此只需维护 value - current 的前缀最小值
+		iCurrent := 0
+		found := false
+		best := 0
+		for iNext, nextLocation := range nextLocations {
+			for iCurrent < len(currentLocations) &&
+				currentLocations[iCurrent]+lengths[i-1] <= nextLocation {
+				if currentMinValues[iCurrent] != -1 {
+					value := currentMinValues[iCurrent] - currentLocations[iCurrent]
+					if !found || value < best {
+						best = value
+						found = true
+					}
+				}
+				iCurrent++
+			}
+			if found {
+				nextMinValues[iNext] = best + nextLocation - lengths[i-1]
+			} else {
+				nextMinValues[iNext] = -1
+			}
+		}
+
+		currentLocations = nextLocations
+		currentMinValues = nextMinValues
+	}
+
+	minGap := -1
+	for _, value := range currentMinValues {
+		if value != -1 && (minGap == -1 || value < minGap) {
+			minGap = value
+		}
+	}
+	return minGap
+}
+
+// 求两个有序DocId列表的交集，对较短的列表中每一项在较长的列表中二分查找
+func intersectDocIds(a, b []uint64) []uint64 {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	var result []uint64
+	start := 0
+	for _, docId := range a {
+		position := start + sort.Search(len(b)-start, func(i int) bool {
+			return b[start+i] >= docId
+		})
+		if position == len(b) {
+			break
+		}
+		if b[position] == docId {
+			result = append(result, docId)
+		}
+		start = position
+	}
+	return result
+}
+
+// 求两个有序DocId列表的并集
+func unionDocIds(a, b []uint64) []uint64 {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	result := make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// 从有序DocId列表a中去掉出现在b中的项
+func excludeDocIds(a, b []uint64) []uint64 {
+	if len(b) == 0 {
+		return a
+	}
+	result := make([]uint64, 0, len(a))
+	j := 0
+	for _, docId := range a {
+		for j < len(b) && b[j] < docId {
+			j++
+		}
+		if j < len(b) && b[j] == docId {
+			continue
+		}
+		result = append(result, docId)
+	}
+	return result
+}
+
+// 为了按长度排序
+type docIdsByLength [][]uint64
+
+func (lists docIdsByLength) Len() int {
+	return len(lists)
+}
+func (lists docIdsByLength) Swap(i, j int) {
+	lists[i], lists[j] = lists[j], lists[i]
+}
+func (lists docIdsByLength) Less(i, j int) bool {
+	return len(lists[i]) < len(lists[j])
+}
+
+// 为了按文档数排序
+type termsByLength []*termPostings
+
+func (terms termsByLength) Len() int {
+	return len(terms)
+}
+func (terms termsByLength) Swap(i, j int) {
+	terms[i], terms[j] = terms[j], terms[i]
+}
+func (terms termsByLength) Less(i, j int) bool {
+	return terms[i].numDocs < terms[j].numDocs
+}
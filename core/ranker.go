@@ -1,10 +1,11 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"github.com/Jarlene/wukong/types"
 	"github.com/Jarlene/wukong/utils"
 	"log"
-	"sort"
 )
 
 type Ranker struct {
@@ -15,22 +16,48 @@ type Ranker struct {
 	initialized bool
 }
 
+var (
+	ErrRankerInitialized    = errors.New("排序器不能初始化两次")
+	ErrRankerNotInitialized = errors.New("排序器尚未初始化")
+)
+
+// 初始化排序器，使用单独的文档信息表，出错时退出程序
 func (ranker *Ranker) Init(shard int) {
+	if err := ranker.Open(shard, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 初始化排序器，重复初始化时返回错误
+// docInfosShard通常为同一shard索引器的文档信息（Indexer.DocInfosShard），为nil时新建一个
+func (ranker *Ranker) Open(shard int, docInfosShard *types.DocInfosShard) error {
 	if ranker.initialized == true {
-		log.Fatal("排序器不能初始化两次")
+		return ErrRankerInitialized
 	}
 	ranker.initialized = true
 
 	ranker.shard = shard
 
-	AddDocInfosShard(shard)
-	ranker.DocInfosShard = DocInfoGroup[shard]
+	if docInfosShard == nil {
+		docInfosShard = NewDocInfosShard()
+	}
+	ranker.DocInfosShard = docInfosShard
+	return nil
 }
 
-// 给某个文档添加评分字段
+// 给某个文档添加评分字段，排序器尚未初始化时退出程序
 func (ranker *Ranker) AddDoc(docId uint64, fields interface{}, dealDocInfoChan <-chan bool) *types.DocInfo {
+	docInfo, err := ranker.AddDocument(docId, fields, dealDocInfoChan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return docInfo
+}
+
+// 给某个文档添加评分字段，排序器尚未初始化时返回错误
+func (ranker *Ranker) AddDocument(docId uint64, fields interface{}, dealDocInfoChan <-chan bool) (*types.DocInfo, error) {
 	if ranker.initialized == false {
-		log.Fatal("排序器尚未初始化")
+		return nil, ErrRankerNotInitialized
 	}
 
 	<-dealDocInfoChan // 等待索引器处理完成
@@ -42,7 +69,7 @@ func (ranker *Ranker) AddDoc(docId uint64, fields interface{}, dealDocInfoChan <
 		ranker.DocInfosShard.NumDocuments++
 	}
 	ranker.DocInfosShard.DocInfos[docId].Fields = fields
-	return ranker.DocInfosShard.DocInfos[docId]
+	return ranker.DocInfosShard.DocInfos[docId], nil
 }
 
 // 删除某个文档的评分字段
@@ -52,21 +79,39 @@ func (ranker *Ranker) RemoveDoc(docId uint64) {
 	}
 
 	ranker.DocInfosShard.Lock()
-	delete(ranker.DocInfosShard.DocInfos, docId)
-	ranker.DocInfosShard.NumDocuments--
+	if _, found := ranker.DocInfosShard.DocInfos[docId]; found {
+		delete(ranker.DocInfosShard.DocInfos, docId)
+		ranker.DocInfosShard.NumDocuments--
+	}
 	ranker.DocInfosShard.Unlock()
 }
 
-// 给文档评分并排序
+// 给文档评分并排序，只保留排在前OutputOffset+MaxOutputs的文档
 func (ranker *Ranker) Rank(
 	docs []types.IndexedDocument, options types.RankOptions, countDocsOnly bool) (types.ScoredDocuments, int) {
+	outputDocs, numDocs, _ := ranker.RankContext(context.Background(), docs, options, countDocsOnly)
+	return outputDocs, numDocs
+}
+
+// 和Rank相同，但在ctx被取消或者超时时中止评分，此时返回nil和ctx.Err()
+func (ranker *Ranker) RankContext(ctx context.Context,
+	docs []types.IndexedDocument, options types.RankOptions, countDocsOnly bool) (types.ScoredDocuments, int, error) {
 	if ranker.initialized == false {
 		log.Fatal("排序器尚未初始化")
 	}
+	// 只需要排在前OutputOffset+MaxOutputs的文档
+	limit := 0
+	if options.MaxOutputs != 0 {
+		limit = options.OutputOffset + options.MaxOutputs
+	}
+	top := newTopDocuments(limit, options.ReverseOrder)
+
 	// 对每个文档评分
-	var outputDocs types.ScoredDocuments
 	numDocs := 0
-	for _, d := range docs {
+	for i, d := range docs {
+		if i%contextCheckInterval == 0 && ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
 		ranker.DocInfosShard.RLock()
 		// 判断doc是否存在
 		if _, ok := ranker.DocInfosShard.DocInfos[d.DocId]; ok {
@@ -76,11 +121,13 @@ func (ranker *Ranker) Rank(
 			scores := options.ScoringCriteria.Score(d, fs)
 			if len(scores) > 0 {
 				if !countDocsOnly {
-					outputDocs = append(outputDocs, types.ScoredDocument{
+					// 按距离排序时先比较Distance（见rankedBefore），没有坐标的文档距离为正无穷
+					top.push(types.ScoredDocument{
 						DocId:                 d.DocId,
 						Scores:                scores,
 						TokenSnippetLocations: d.TokenSnippetLocations,
-						TokenLocations:        d.TokenLocations})
+						TokenLocations:        d.TokenLocations,
+						Distance:              d.Distance})
 				}
 				numDocs++
 			}
@@ -88,24 +135,12 @@ func (ranker *Ranker) Rank(
 			ranker.DocInfosShard.RUnlock()
 		}
 	}
-
-	// 排序
-	if !countDocsOnly {
-		if options.ReverseOrder {
-			sort.Sort(sort.Reverse(outputDocs))
-		} else {
-			sort.Sort(outputDocs)
-		}
-		// 当用户要求只返回部分结果时返回部分结果
-		var start, end int
-		if options.MaxOutputs != 0 {
-			start = utils.MinInt(options.OutputOffset, len(outputDocs))
-			end = utils.MinInt(options.OutputOffset+options.MaxOutputs, len(outputDocs))
-		} else {
-			start = utils.MinInt(options.OutputOffset, len(outputDocs))
-			end = len(outputDocs)
-		}
-		return outputDocs[start:end], numDocs
+	if countDocsOnly {
+		return nil, numDocs, nil
 	}
-	return outputDocs, numDocs
+
+	// 排序，当用户要求只返回部分结果时返回部分结果
+	outputDocs := top.sorted()
+	start := utils.MinInt(options.OutputOffset, len(outputDocs))
+	return outputDocs[start:], numDocs, nil
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"github.com/Jarlene/wukong/types"
 	"github.com/Jarlene/wukong/utils"
 	"reflect"
@@ -64,6 +65,15 @@ func TestRankDocument(t *testing.T) {
 	}, types.RankOptions{ScoringCriteria: types.RankByBM25{}, ReverseOrder: true}, false)
 	// doc0因为没有AddDoc所以没有添加进来
 	utils.Expect(t, "[1 [6000 ]] [4 [18000 ]] [3 [24000 ]] ", scoredDocsToString(scoredDocs))
+
+	// 已取消的ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	scoredDocs, _, err := ranker.RankContext(ctx, []types.IndexedDocument{
+		types.IndexedDocument{DocId: 1, BM25: 6},
+	}, types.RankOptions{ScoringCriteria: types.RankByBM25{}}, false)
+	utils.Expect(t, "", scoredDocsToString(scoredDocs))
+	utils.Expect(t, "context canceled", err)
 }
 
 func TestRankWithCriteria(t *testing.T) {
@@ -160,3 +170,75 @@ func TestRemoveDocument(t *testing.T) {
 	}, types.RankOptions{ScoringCriteria: criteria}, false)
 	utils.Expect(t, "[1 [25300 ]] [2 [3000 ]] ", scoredDocsToString(scoredDocs))
 }
+
+func TestRankTopK(t *testing.T) {
+	var ranker Ranker
+	ranker.Init(0)
+	var docs []types.IndexedDocument
+	for docId := uint64(0); docId < 100; docId++ {
+		done := make(chan bool)
+		close(done)
+		ranker.AddDoc(docId, nil, done)
+		// 分数为docId除以10，每个分数有10个文档
+		docs = append(docs, types.IndexedDocument{DocId: docId, BM25: float32(docId / 10)})
+	}
+
+	scoredDocs, numDocs := ranker.Rank(docs, types.RankOptions{
+		ScoringCriteria: types.RankByBM25{}, OutputOffset: 8, MaxOutputs: 4}, false)
+	utils.Expect(t, "100", numDocs)
+	utils.Expect(t, "[98 [9000 ]] [99 [9000 ]] [80 [8000 ]] [81 [8000 ]] ", scoredDocsToString(scoredDocs))
+
+	scoredDocs, _ = ranker.Rank(docs, types.RankOptions{
+		ScoringCriteria: types.RankByBM25{}, ReverseOrder: true, MaxOutputs: 3}, false)
+	utils.Expect(t, "[0 [0 ]] [1 [0 ]] [2 [0 ]] ", scoredDocsToString(scoredDocs))
+
+	scoredDocs, _ = ranker.Rank(docs, types.RankOptions{
+		ScoringCriteria: types.RankByBM25{}, OutputOffset: 98}, false)
+	utils.Expect(t, "[8 [0 ]] [9 [0 ]] ", scoredDocsToString(scoredDocs))
+
+	// 归并各shard排好序的输出
+	lists := []types.ScoredDocuments{
+		{{DocId: 1, Scores: []float32{3}}, {DocId: 2, Scores: []float32{1}}},
+		nil,
+		{{DocId: 3, Scores: []float32{3}}, {DocId: 4, Scores: []float32{2}}, {DocId: 5, Scores: []float32{0}}},
+	}
+	utils.Expect(t, "[1 [3000 ]] [3 [3000 ]] [4 [2000 ]] ", scoredDocsToString(MergeScoredDocuments(lists, false, 3)))
+	utils.Expect(t, "5", len(MergeScoredDocuments(lists, false, 0)))
+	lists = []types.ScoredDocuments{
+		{{DocId: 2, Scores: []float32{1}}, {DocId: 1, Scores: []float32{3}}},
+		{{DocId: 5, Scores: []float32{0}}, {DocId: 4, Scores: []float32{2}}},
+	}
+	utils.Expect(t, "[5 [0 ]] [2 [1000 ]] [4 [2000 ]] [1 [3000 ]] ", scoredDocsToString(MergeScoredDocuments(lists, true, 10)))
+
+	// 按距离排序时距离优先于分数，相差不到float32精度的距离也能区分
+	lists = []types.ScoredDocuments{
+		{{DocId: 1, Scores: []float32{3}, Distance: 12345678.4}},
+		{{DocId: 2, Scores: []float32{1}, Distance: 12345678.2}},
+	}
+	utils.Expect(t, "[2 [1000 ]] [1 [3000 ]] ", scoredDocsToString(MergeScoredDocuments(lists, false, 0)))
+	utils.Expect(t, "[1 [3000 ]] [2 [1000 ]] ", scoredDocsToString(MergeScoredDocuments(lists, true, 0)))
+}
+
+// 宽泛查询匹配大量文档但只返回前10个时，有界的堆比排序全部文档快
+func BenchmarkRankTopK(b *testing.B) {
+	var ranker Ranker
+	ranker.Init(0)
+	docs := make([]types.IndexedDocument, 100000)
+	for i := range docs {
+		done := make(chan bool)
+		close(done)
+		ranker.AddDoc(uint64(i), nil, done)
+		docs[i] = types.IndexedDocument{DocId: uint64(i), BM25: float32(i*7919%100003) / 100}
+	}
+	for _, maxOutputs := range []int{10, 0} {
+		name := "Top10"
+		if maxOutputs == 0 {
+			name = "All"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ranker.Rank(docs, types.RankOptions{ScoringCriteria: types.RankByBM25{}, MaxOutputs: maxOutputs}, false)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package core
+
+import (
+	"github.com/Jarlene/wukong/types"
+	"math"
+	"sort"
+)
+
+// 反向索引由一个可修改的缓冲区和若干不可修改的索引段组成
+//
+// 加入的文档先插入缓冲区（未压缩，文档数不超过maxBufferDocs，插入代价很小），缓冲区满时压缩为一个索引段。
+// 索引段按加入的先后排列，后台每凑齐mergeFactor个同一级别的相邻段就将它们合并为高一级的段，
+// 合并时去掉已删除和已被更新的文档，因此段的个数随文档数对数增长。
+//
+// 每次加入文档分配一个递增的序号，文档状态表（见doc_table.go）记录每个文档当前版本的序号，每个段覆盖一段连续的序号。
+// 段中的索引项只有在文档当前的序号落在该段的范围内时才有效，因此删除和更新文档不需要修改已有的段。
+//
+// 查找时在InvertedIndexShard的读锁下取得段列表、缓冲区中相关的行和文档状态表的快照，此后查找和评分不需要任何锁；
+// 加入文档时只在修改缓冲区时短暂持有写锁，压缩、合并等耗时的操作都在锁外进行。
+
+// 缓冲区中最多的文档数，超过时压缩为一个索引段
+const defaultMaxBufferDocs = 1024
+
+// 合并索引段时每次合并的段数
+const mergeFactor = 4
+
+// 不可修改的索引段
+type segment struct {
+	index map[string]*types.PostingList
+
+	// 段覆盖的文档序号范围
+	minSeq, maxSeq uint64
+
+	// 合并的级别，由缓冲区得到的段为0，合并后的段比被合并的段高一级
+	level int
+
+	// 段中的索引项总数
+	numPostings int
+}
+
+// 可修改的缓冲区，受InvertedIndexShard的锁保护，只有持有写入锁的一方修改
+type indexBuffer struct {
+	index map[string]*types.KeywordIndices
+
+	// index中各行压缩后的形式，插入和删除文档时只重新压缩受影响的块（见updatePostings）。
+	// 压缩后的行不再修改，查找时的快照直接引用
+	compressed map[string]*types.PostingList
+
+	// 缓冲区中的文档及其关键词长度
+	docs map[uint64]float32
+
+	// 缓冲区中文档的最小序号，缓冲区覆盖从minSeq开始的全部序号
+	minSeq uint64
+}
+
+func newIndexBuffer(minSeq uint64) *indexBuffer {
+	return &indexBuffer{
+		index:      make(map[string]*types.KeywordIndices),
+		compressed: make(map[string]*types.PostingList),
+		docs:       make(map[uint64]float32),
+		minSeq:     minSeq,
+	}
+}
+
+// 缓冲区中文档的关键词长度
+func (buffer *indexBuffer) tokenLength(docId uint64) float32 {
+	return buffer.docs[docId]
+}
+
+// 向缓冲区中插入一个文档的索引项，positions为和keyword.Starts对应的关键词序号。
+// 文档的关键词长度需已记入buffer.docs。调用者需持有写入锁和反向索引表的写锁
+func (indexer *Indexer) insertIntoBuffer(docId uint64, keyword *types.KeywordIndex, positions []int) {
+	indices, found := indexer.buffer.index[keyword.Text]
+	if !found {
+		indices = new(types.KeywordIndices)
+		indexer.buffer.index[keyword.Text] = indices
+	}
+	position, _ := indexer.searchIndex(indices, 0, indexer.getIndexLength(indices)-1, docId)
+	switch indexer.initOptions.IndexType {
+	case types.LocationsIndex:
+		indices.Locations = append(indices.Locations, []int{})
+		copy(indices.Locations[position+1:], indices.Locations[position:])
+		indices.Locations[position] = keyword.Starts
+		indices.Positions = append(indices.Positions, nil)
+		copy(indices.Positions[position+1:], indices.Positions[position:])
+		indices.Positions[position] = positions
+	case types.FrequenciesIndex:
+		indices.Frequencies = append(indices.Frequencies, float32(0))
+		copy(indices.Frequencies[position+1:], indices.Frequencies[position:])
+		indices.Frequencies[position] = keyword.Frequency
+	}
+	indices.DocIds = append(indices.DocIds, 0)
+	copy(indices.DocIds[position+1:], indices.DocIds[position:])
+	indices.DocIds[position] = docId
+	indexer.buffer.compressed[keyword.Text] = updatePostings(
+		indexer.buffer.compressed[keyword.Text], indices, position, true, indexer.buffer.tokenLength)
+}
+
+// 从缓冲区中去掉一个文档的全部索引项，调用者需持有写入锁和反向索引表的写锁
+func (indexer *Indexer) removeFromBuffer(docId uint64, keywords []string) {
+	for _, keyword := range keywords {
+		indices, found := indexer.buffer.index[keyword]
+		if !found {
+			continue
+		}
+		position, found := indexer.searchIndex(indices, 0, indexer.getIndexLength(indices)-1, docId)
+		if !found {
+			continue
+		}
+		if len(indices.DocIds) == 1 {
+			delete(indexer.buffer.index, keyword)
+			delete(indexer.buffer.compressed, keyword)
+			continue
+		}
+		switch indexer.initOptions.IndexType {
+		case types.LocationsIndex:
+			indices.Locations = append(indices.Locations[:position], indices.Locations[position+1:]...)
+			indices.Positions = append(indices.Positions[:position], indices.Positions[position+1:]...)
+		case types.FrequenciesIndex:
+			indices.Frequencies = append(indices.Frequencies[:position], indices.Frequencies[position+1:]...)
+		}
+		indices.DocIds = append(indices.DocIds[:position], indices.DocIds[position+1:]...)
+		indexer.buffer.compressed[keyword] = updatePostings(
+			indexer.buffer.compressed[keyword], indices, position, false, indexer.buffer.tokenLength)
+	}
+	delete(indexer.buffer.docs, docId)
+}
+
+// 将缓冲区压缩为一个索引段并通知后台合并，调用者需持有写入锁
+func (indexer *Indexer) freezeBuffer() {
+	// 缓冲区中的行已经压缩，直接作为新段的索引
+	buffer := indexer.buffer
+	if len(buffer.docs) == 0 {
+		return
+	}
+	seg := &segment{
+		index:  buffer.compressed,
+		minSeq: buffer.minSeq,
+		maxSeq: indexer.nextSeq - 1,
+	}
+	for _, indices := range buffer.index {
+		seg.numPostings += len(indices.DocIds)
+	}
+
+	indexer.InvertedIndexShard.Lock()
+	segments := make([]*segment, len(indexer.segments), len(indexer.segments)+1)
+	copy(segments, indexer.segments)
+	indexer.segments = append(segments, seg)
+	indexer.buffer = newIndexBuffer(indexer.nextSeq)
+	indexer.InvertedIndexShard.Unlock()
+
+	select {
+	case indexer.mergeChan <- true:
+	default:
+	}
+}
+
+// 后台合并索引段
+func (indexer *Indexer) mergeWorker(mergeChan <-chan bool) {
+	for range mergeChan {
+		for indexer.mergeOnce() {
+		}
+	}
+}
+
+// 找出mergeFactor个同一级别的相邻段并合并，没有可合并的段时返回false
+func (indexer *Indexer) mergeOnce() bool {
+	indexer.mergeLock.Lock()
+	defer indexer.mergeLock.Unlock()
+
+	indexer.InvertedIndexShard.RLock()
+	segments := indexer.segments
+	indexer.InvertedIndexShard.RUnlock()
+
+	for start := 0; start+mergeFactor <= len(segments); start++ {
+		sources := segments[start : start+mergeFactor]
+		sameLevel := true
+		for _, seg := range sources[1:] {
+			if seg.level != sources[0].level {
+				sameLevel = false
+				break
+			}
+		}
+		if sameLevel {
+			indexer.replaceSegments(sources, indexer.mergeSegments(sources))
+			return true
+		}
+	}
+	return false
+}
+
+// 合并相邻的索引段，去掉无效的索引项
+// 合并在锁外进行，按开始合并时的文档状态表检查文档是否有效：之后删除或者更新的文档在合并后的段中仍有记录，
+// 但序号已不在段的范围内，查找时同样无效，留待下一次合并清除
+func (indexer *Indexer) mergeSegments(sources []*segment) *segment {
+	docs := indexer.currentDocs()
+	merged := &segment{
+		index:  make(map[string]*types.PostingList),
+		minSeq: sources[0].minSeq,
+		maxSeq: sources[len(sources)-1].maxSeq,
+	}
+	keywords := make(map[string]bool)
+	for _, seg := range sources {
+		if seg.level >= merged.level {
+			merged.level = seg.level + 1
+		}
+		for keyword := range seg.index {
+			keywords[keyword] = true
+		}
+	}
+
+	for keyword := range keywords {
+		indices := new(types.KeywordIndices)
+		sorted := true
+		for _, seg := range sources {
+			list, found := seg.index[keyword]
+			if !found {
+				continue
+			}
+			for i := range list.Blocks {
+				block := decodePostingBlock(list, i, true)
+				for j, docId := range block.DocIds {
+					if !docs.isLive(seg, docId) {
+						continue
+					}
+					if n := len(indices.DocIds); n > 0 && indices.DocIds[n-1] > docId {
+						sorted = false
+					}
+					indices.DocIds = append(indices.DocIds, docId)
+					if len(block.Frequencies) > 0 {
+						indices.Frequencies = append(indices.Frequencies, block.Frequencies[j])
+					}
+					if len(block.Locations) > 0 {
+						indices.Locations = append(indices.Locations, block.Locations[j])
+						indices.Positions = append(indices.Positions, block.Positions[j])
+					}
+				}
+			}
+		}
+		if len(indices.DocIds) > 0 {
+			if !sorted {
+				sort.Sort(indicesByDocId{indices})
+			}
+			merged.index[keyword] = compressPostings(indices, docs.tokenLength)
+			merged.numPostings += len(indices.DocIds)
+		}
+	}
+	return merged
+}
+
+// 用合并后的段替换段列表中相邻的sources，merged为空时直接去掉。调用者需持有合并锁
+func (indexer *Indexer) replaceSegments(sources []*segment, merged *segment) {
+	indexer.InvertedIndexShard.Lock()
+	defer indexer.InvertedIndexShard.Unlock()
+
+	// 持有合并锁时只有缓冲区压缩会在末尾加入新段，sources仍然相邻
+	start := 0
+	for indexer.segments[start] != sources[0] {
+		start++
+	}
+	segments := make([]*segment, 0, len(indexer.segments)-len(sources)+1)
+	segments = append(segments, indexer.segments[:start]...)
+	if len(merged.index) > 0 {
+		segments = append(segments, merged)
+	}
+	indexer.segments = append(segments, indexer.segments[start+len(sources):]...)
+}
+
+// 查找时反向索引的快照：各索引段、缓冲区中相关的行和文档状态表
+type indexView struct {
+	indexer *Indexer
+	docs    *docTable
+
+	// 按从旧到新排列，最后一个为缓冲区的快照
+	segments []*segment
+
+	// 查询树中各搜索键的文档数
+	docFreqs map[string]int
+
+	terms map[string]*termPostings
+}
+
+// 生成包含tokens中搜索键的快照，调用者需持有反向索引表的读锁
+func (indexer *Indexer) newIndexView(tokens map[string]bool) *indexView {
+	buffer := &segment{
+		index:  make(map[string]*types.PostingList),
+		minSeq: indexer.buffer.minSeq,
+		maxSeq: math.MaxUint64,
+	}
+	view := &indexView{
+		indexer:  indexer,
+		docs:     indexer.docs,
+		segments: append(append([]*segment{}, indexer.segments...), buffer),
+		docFreqs: make(map[string]int, len(tokens)),
+		terms:    make(map[string]*termPostings, len(tokens)),
+	}
+	for token := range tokens {
+		if list, found := indexer.buffer.compressed[token]; found {
+			buffer.index[token] = list
+		}
+		view.docFreqs[token] = indexer.docFreqs[token]
+	}
+	return view
+}
+
+// 一个搜索键在快照各段中的反向索引行
+type termPostings struct {
+	// 包含搜索键的（未删除的）文档数
+	numDocs int
+
+	lists    []*types.PostingList
+	segments []*segment
+}
+
+// 返回搜索键在快照中的反向索引行，搜索键不存在时返回nil
+func (view *indexView) term(token string) *termPostings {
+	if term, found := view.terms[token]; found {
+		return term
+	}
+	var term *termPostings
+	if view.docFreqs[token] > 0 {
+		term = &termPostings{numDocs: view.docFreqs[token]}
+		for _, seg := range view.segments {
+			if list, found := seg.index[token]; found {
+				term.lists = append(term.lists, list)
+				term.segments = append(term.segments, seg)
+			}
+		}
+	}
+	view.terms[token] = term
+	return term
+}
+
+// 搜索键对应的全部有效DocId，按从小到大排序
+func (view *indexView) docIds(term *termPostings) []uint64 {
+	docIds := make([]uint64, 0, term.numDocs)
+	iterator := view.newDocIdIterator(term)
+	for docId, ok := iterator.next(); ok; docId, ok = iterator.next() {
+		docIds = append(docIds, docId)
+	}
+	return docIds
+}
+
+// 求driving和terms中各搜索键的交集，按从小到大排序
+//
+// driving逐块解压并依次检查其中的文档，不整体解压；terms通过跳表只解压可能包含结果的块，
+// 因此driving应是文档数最少的搜索键。
+func (view *indexView) intersectTerms(driving *termPostings, terms []*termPostings) []uint64 {
+	cursors := make([]*termCursor, len(terms))
+	for i, term := range terms {
+		cursors[i] = view.newTermCursor(term, false)
+	}
+	var result []uint64
+	iterator := view.newDocIdIterator(driving)
+	for docId, ok := iterator.next(); ok; docId, ok = iterator.next() {
+		matched := true
+		for _, cursor := range cursors {
+			if _, _, found := cursor.seek(docId); !found {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result = append(result, docId)
+		}
+	}
+	return result
+}
+
+// 按DocId从小到大遍历一个搜索键在各段中的有效文档，每段只保留当前解压的一块
+type docIdIterator struct {
+	view    *indexView
+	term    *termPostings
+	cursors []*postingCursor
+
+	// 各段当前块的序号和块中的位置，块的序号等于块数时该段已遍历完
+	blocks    []int
+	positions []int
+}
+
+// 新建迭代器
+func (view *indexView) newDocIdIterator(term *termPostings) *docIdIterator {
+	iterator := &docIdIterator{
+		view:      view,
+		term:      term,
+		cursors:   make([]*postingCursor, len(term.lists)),
+		blocks:    make([]int, len(term.lists)),
+		positions: make([]int, len(term.lists)),
+	}
+	for i, list := range term.lists {
+		iterator.cursors[i] = newPostingCursor(list, false)
+		if len(list.Blocks) > 0 {
+			iterator.cursors[i].load(0)
+		}
+		iterator.skipDead(i)
+	}
+	return iterator
+}
+
+// 跳过第i段中当前位置上已经失效的文档，块结束时进入下一块
+func (iterator *docIdIterator) skipDead(i int) {
+	cursor := iterator.cursors[i]
+	for iterator.blocks[i] < len(cursor.list.Blocks) {
+		if iterator.positions[i] == len(cursor.block.DocIds) {
+			iterator.blocks[i]++
+			iterator.positions[i] = 0
+			if iterator.blocks[i] < len(cursor.list.Blocks) {
+				cursor.load(iterator.blocks[i])
+			}
+			continue
+		}
+		if iterator.view.docs.isLive(iterator.term.segments[i], cursor.block.DocIds[iterator.positions[i]]) {
+			return
+		}
+		iterator.positions[i]++
+	}
+}
+
+// 返回下一个有效文档，遍历结束时ok为false。文档最多在一个段中有效，因此不会重复
+func (iterator *docIdIterator) next() (docId uint64, ok bool) {
+	current := -1
+	for i, cursor := range iterator.cursors {
+		if iterator.blocks[i] < len(cursor.list.Blocks) {
+			if id := cursor.block.DocIds[iterator.positions[i]]; current == -1 || id < docId {
+				docId = id
+				current = i
+			}
+		}
+	}
+	if current == -1 {
+		return 0, false
+	}
+	iterator.positions[current]++
+	iterator.skipDead(current)
+	return docId, true
+}
+
+// 在一个搜索键的各段中按DocId查找有效索引项的游标
+type termCursor struct {
+	view    *indexView
+	term    *termPostings
+	cursors []*postingCursor
+}
+
+// 新建游标，withPayload为false时只解压DocId。term为nil时查找总是失败
+func (view *indexView) newTermCursor(term *termPostings, withPayload bool) *termCursor {
+	cursor := &termCursor{view: view, term: term}
+	if term != nil {
+		cursor.cursors = make([]*postingCursor, len(term.lists))
+		for i, list := range term.lists {
+			cursor.cursors[i] = newPostingCursor(list, withPayload)
+		}
+	}
+	return cursor
+}
+
+// 查找文档的有效索引项，找到时返回所在段的游标和在游标当前块中的位置
+func (cursor *termCursor) seek(docId uint64) (*postingCursor, int, bool) {
+	// 文档最多在一个段中有效，从新到旧查找
+	for i := len(cursor.cursors) - 1; i >= 0; i-- {
+		position, found := cursor.cursors[i].seek(docId)
+		if found && cursor.view.docs.isLive(cursor.term.segments[i], docId) {
+			return cursor.cursors[i], position, true
+		}
+	}
+	return nil, 0, false
+}
+
+// 为了按DocId排序
+type docIdsAscending []uint64
+
+func (docIds docIdsAscending) Len() int {
+	return len(docIds)
+}
+func (docIds docIdsAscending) Swap(i, j int) {
+	docIds[i], docIds[j] = docIds[j], docIds[i]
+}
+func (docIds docIdsAscending) Less(i, j int) bool {
+	return docIds[i] < docIds[j]
+}
+
+// 为了将索引项按DocId排序
+type indicesByDocId struct {
+	*types.KeywordIndices
+}
+
+func (indices indicesByDocId) Len() int {
+	return len(indices.DocIds)
+}
+func (indices indicesByDocId) Swap(i, j int) {
+	indices.DocIds[i], indices.DocIds[j] = indices.DocIds[j], indices.DocIds[i]
+	if len(indices.Frequencies) > 0 {
+		indices.Frequencies[i], indices.Frequencies[j] = indices.Frequencies[j], indices.Frequencies[i]
+	}
+	if len(indices.Locations) > 0 {
+		indices.Locations[i], indices.Locations[j] = indices.Locations[j], indices.Locations[i]
+	}
+	if len(indices.Positions) > 0 {
+		indices.Positions[i], indices.Positions[j] = indices.Positions[j], indices.Positions[i]
+	}
+}
+func (indices indicesByDocId) Less(i, j int) bool {
+	return indices.DocIds[i] < indices.DocIds[j]
+}
+
+// 从有序DocId列表中保留（keep为true）或者去掉（keep为false）在搜索键的反向索引中有效的文档
+func (view *indexView) filter(docIds []uint64, term *termPostings, keep bool) []uint64 {
+	cursor := view.newTermCursor(term, false)
+	var result []uint64
+	for _, docId := range docIds {
+		if _, _, found := cursor.seek(docId); found == keep {
+			result = append(result, docId)
+		}
+	}
+	return result
+}
@@ -6,7 +6,10 @@ import (
 )
 
 func indicesToString(indexer *Indexer, token string) (output string) {
-	indices := indexer.InvertedIndexShard.InvertedIndex[token]
+	indices, _ := indexer.Postings(token, 0, 0)
+	if indices == nil {
+		return
+	}
 	for i := 0; i < indexer.getIndexLength(indices); i++ {
 		output += fmt.Sprintf("%d ",
 			indexer.getDocId(indices, i))
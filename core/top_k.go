@@ -0,0 +1,175 @@
+package core
+
+import (
+	"container/heap"
+	"github.com/Jarlene/wukong/types"
+	"sort"
+)
+
+// 按排序选项a是否应排在b之前：默认按分数从大到小，reverse为true时从小到大。
+// 先按Distance从近到远（reverse为true时从远到近）比较，没有按距离排序时Distance均为0
+func rankedBefore(a, b *types.ScoredDocument, reverse bool) bool {
+	if a.Distance != b.Distance {
+		return (a.Distance < b.Distance) != reverse
+	}
+	if reverse {
+		return types.MoreScores(b.Scores, a.Scores)
+	}
+	return types.MoreScores(a.Scores, b.Scores)
+}
+
+// 选出排在最前面的limit个文档
+//
+// 维护一个大小不超过limit的堆，堆顶是已选出的文档中排在最后的一个，新文档只需和堆顶比较，
+// 处理n个文档的代价为O(n log limit)。limit为0时不限制，加入全部文档后排序。
+// 排序相同的文档按加入的先后排列
+type topDocuments struct {
+	limit   int
+	reverse bool
+
+	docs   types.ScoredDocuments
+	orders []int
+	pushed int
+}
+
+func newTopDocuments(limit int, reverse bool) *topDocuments {
+	return &topDocuments{limit: limit, reverse: reverse}
+}
+
+// 第i个文档是否排在第j个之前
+func (top *topDocuments) before(i, j int) bool {
+	if rankedBefore(&top.docs[i], &top.docs[j], top.reverse) {
+		return true
+	}
+	if rankedBefore(&top.docs[j], &top.docs[i], top.reverse) {
+		return false
+	}
+	return top.orders[i] < top.orders[j]
+}
+
+// 为了实现heap.Interface，堆顶是排在最后的文档
+func (top *topDocuments) Len() int {
+	return len(top.docs)
+}
+func (top *topDocuments) Less(i, j int) bool {
+	return top.before(j, i)
+}
+func (top *topDocuments) Swap(i, j int) {
+	top.docs[i], top.docs[j] = top.docs[j], top.docs[i]
+	top.orders[i], top.orders[j] = top.orders[j], top.orders[i]
+}
+func (top *topDocuments) Push(x interface{}) {
+	top.docs = append(top.docs, x.(types.ScoredDocument))
+	top.orders = append(top.orders, top.pushed)
+}
+func (top *topDocuments) Pop() interface{} {
+	n := len(top.docs) - 1
+	doc := top.docs[n]
+	top.docs = top.docs[:n]
+	top.orders = top.orders[:n]
+	return doc
+}
+
+// 加入一个文档
+func (top *topDocuments) push(doc types.ScoredDocument) {
+	switch {
+	case top.limit == 0:
+		top.Push(doc)
+	case len(top.docs) < top.limit:
+		heap.Push(top, doc)
+	case rankedBefore(&doc, &top.docs[0], top.reverse):
+		// 只有比堆顶靠前的文档才能进入前limit个
+		top.docs[0] = doc
+		top.orders[0] = top.pushed
+		heap.Fix(top, 0)
+	}
+	top.pushed++
+}
+
+// 按排序返回选出的文档
+func (top *topDocuments) sorted() types.ScoredDocuments {
+	sort.Sort(topDocumentsInOrder{top})
+	return top.docs
+}
+
+// 为了按排序输出
+type topDocumentsInOrder struct {
+	*topDocuments
+}
+
+func (top topDocumentsInOrder) Less(i, j int) bool {
+	return top.before(i, j)
+}
+
+// 多路归并已经排好序的文档列表，返回排在最前面的limit个文档，limit为0时不限制
+// 排序相同的文档中先返回序号较小的列表中的文档
+func MergeScoredDocuments(lists []types.ScoredDocuments, reverse bool, limit int) types.ScoredDocuments {
+	total := 0
+	for _, list := range lists {
+		total += len(list)
+	}
+	if limit == 0 || limit > total {
+		limit = total
+	}
+
+	merger := &scoredDocumentsMerger{lists: lists, reverse: reverse}
+	for i, list := range lists {
+		if len(list) > 0 {
+			merger.heads = append(merger.heads, mergeHead{list: i})
+		}
+	}
+	heap.Init(merger)
+
+	output := make(types.ScoredDocuments, 0, limit)
+	for len(output) < limit {
+		head := &merger.heads[0]
+		output = append(output, lists[head.list][head.position])
+		head.position++
+		if head.position == len(lists[head.list]) {
+			heap.Pop(merger)
+		} else {
+			heap.Fix(merger, 0)
+		}
+	}
+	return output
+}
+
+// 归并中一个列表的当前位置
+type mergeHead struct {
+	list     int
+	position int
+}
+
+// 为了实现heap.Interface，堆顶是当前排在最前的列表
+type scoredDocumentsMerger struct {
+	lists   []types.ScoredDocuments
+	reverse bool
+	heads   []mergeHead
+}
+
+func (merger *scoredDocumentsMerger) Len() int {
+	return len(merger.heads)
+}
+func (merger *scoredDocumentsMerger) Less(i, j int) bool {
+	a := &merger.lists[merger.heads[i].list][merger.heads[i].position]
+	b := &merger.lists[merger.heads[j].list][merger.heads[j].position]
+	if rankedBefore(a, b, merger.reverse) {
+		return true
+	}
+	if rankedBefore(b, a, merger.reverse) {
+		return false
+	}
+	return merger.heads[i].list < merger.heads[j].list
+}
+func (merger *scoredDocumentsMerger) Swap(i, j int) {
+	merger.heads[i], merger.heads[j] = merger.heads[j], merger.heads[i]
+}
+func (merger *scoredDocumentsMerger) Push(x interface{}) {
+	merger.heads = append(merger.heads, x.(mergeHead))
+}
+func (merger *scoredDocumentsMerger) Pop() interface{} {
+	n := len(merger.heads) - 1
+	head := merger.heads[n]
+	merger.heads = merger.heads[:n]
+	return head
+}
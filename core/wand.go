@@ -0,0 +1,434 @@
+package core
+
+import (
+	"container/heap"
+	"context"
+	"github.com/Jarlene/wukong/types"
+	"log"
+	"math"
+	"sort"
+)
+
+// 比较上界和阈值时留出的相对余量，抵消上界和实际分数求和顺序不同带来的舍入误差
+const wandBoundSlack = 1e-5
+
+// 用Block-Max WAND算法求包含任意一个关键词、BM25最高的k个文档
+//
+// 结果和对tokens的OrQuery调用LookupContext、再按BM25从大到小取前k个相同（BM25相同时DocId大的在前），
+// 但不对不可能进入前k个的文档评分：每个关键词的BM25上界由反向索引行中最大的词频和最短的文档长度估计，
+// 已选出k个文档后，按DocId从小到大遍历时跳过上界之和小于第k个文档分数的文档；
+// 再用各块的上界跳过整块。labels、docIds和filters作为附加条件，和LookupContext相同。
+//
+// 返回的文档按DocId从大到小排列。numDocs为满足条件的文档总数，和LookupContext相同，另外只解压DocId统计、不评分；
+// numScored为实际评分的文档数，用于观察跳过的效果。
+// 索引类型为DocIdsIndex、没有BM25参数、索引中有具名字段（计算BM25F）或者k小于等于零时退化为LookupContext
+func (indexer *Indexer) LookupTopK(ctx context.Context, tokens []string, labels []string, docIds map[uint64]bool,
+	filters []types.RangeFilter, k int) (docs []types.IndexedDocument, numDocs, numScored int, err error) {
+	if indexer.initialized == false {
+		log.Fatal("索引器尚未初始化")
+	}
+
+	query := types.OrQuery()
+	for _, token := range tokens {
+		query.Children = append(query.Children, types.TermQuery(token))
+	}
+	if indexer.initOptions.IndexType == types.DocIdsIndex || indexer.initOptions.BM25Parameters == nil || k <= 0 {
+		docs, numDocs, _, _, err = indexer.LookupContext(ctx, &query, labels, docIds, types.LookupOptions{Filters: filters})
+		return docs, numDocs, numDocs, err
+	}
+
+	terms := queryTerms(&query, make(map[string]bool))
+	for _, label := range labels {
+		terms[label] = true
+	}
+	indexer.InvertedIndexShard.RLock()
+	if len(indexer.InvertedIndexShard.FieldTokenLengths) > 0 {
+		// BM25F没有按块估计的上界
+		indexer.InvertedIndexShard.RUnlock()
+		docs, numDocs, _, _, err = indexer.LookupContext(ctx, &query, labels, docIds, types.LookupOptions{Filters: filters})
+		return docs, numDocs, numDocs, err
+	}
+	view := indexer.newIndexView(terms)
+	totalTokenLength := indexer.InvertedIndexShard.TotalTokenLength
+	indexer.InvertedIndexShard.RUnlock()
+
+	if view.docs.size == 0 {
+		return
+	}
+	avgDocLength := totalTokenLength / float32(view.docs.size)
+	compiledFilters, err := compileFilters(filters)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// 标签必须全部出现
+	labelCursors := make([]*termCursor, len(labels))
+	for i, label := range labels {
+		term := view.term(label)
+		if term == nil {
+			return
+		}
+		labelCursors[i] = view.newTermCursor(term, false)
+	}
+
+	// 打分用的游标和WAND遍历用的迭代器，同一个关键词出现多次时分别计分，和LookupContext一致
+	cursors := make([]*termCursor, len(tokens))
+	var iterators []*wandIterator
+	var matchedTerms []*termPostings
+	for i, token := range tokens {
+		term := view.term(token)
+		cursors[i] = view.newTermCursor(term, true)
+		if term != nil {
+			iterators = append(iterators, view.newWandIterator(term, avgDocLength))
+			matchedTerms = append(matchedTerms, term)
+		}
+	}
+
+	top := &wandTopDocs{}
+	for n := 0; ; n++ {
+		if n%contextCheckInterval == 0 && ctx.Err() != nil {
+			return nil, 0, 0, ctx.Err()
+		}
+		sort.Sort(wandIteratorsByDocId(iterators))
+
+		// 前k个已满时，只有上界不小于第k个文档分数的文档才可能进入
+		full := len(top.docs) == k
+		var threshold float32
+		if full {
+			threshold = top.docs[0].BM25
+		}
+
+		// 找出上界之和首次达到阈值的迭代器（pivot），它之前的迭代器中不在pivot文档上的部分可以直接跳到pivot文档
+		pivot := -1
+		var bound float32
+		for i, iterator := range iterators {
+			if iterator.docId == math.MaxUint64 {
+				break
+			}
+			bound += iterator.upperBound
+			if !full || bound*(1+wandBoundSlack) >= threshold {
+				pivot = i
+				break
+			}
+		}
+		if pivot < 0 {
+			break
+		}
+		docId := iterators[pivot].docId
+		for pivot+1 < len(iterators) && iterators[pivot+1].docId == docId {
+			pivot++
+		}
+
+		// 用当前块的上界再检查一次，不够时跳过这些块
+		if full {
+			var blockBound float32
+			blockEnd := uint64(math.MaxUint64)
+			for _, iterator := range iterators[:pivot+1] {
+				bound, end := iterator.blockBound(docId)
+				blockBound += bound
+				if end < blockEnd {
+					blockEnd = end
+				}
+			}
+			if blockBound*(1+wandBoundSlack) < threshold {
+				next := blockEnd
+				if next != math.MaxUint64 {
+					next++
+				}
+				if pivot+1 < len(iterators) && iterators[pivot+1].docId < next {
+					next = iterators[pivot+1].docId
+				}
+				for _, iterator := range iterators[:pivot+1] {
+					iterator.advance(next)
+				}
+				continue
+			}
+		}
+
+		if iterators[0].docId != docId {
+			for _, iterator := range iterators[:pivot] {
+				iterator.advance(docId)
+			}
+			continue
+		}
+
+		// pivot之前的迭代器都在这个文档上，完整评分
+		if state := view.acceptDocument(docId, labelCursors, docIds, compiledFilters); state != nil {
+			doc := view.scoreDocument(state, docId, tokens, nil, cursors, avgDocLength, nil)
+			numScored++
+			if !full {
+				heap.Push(top, doc)
+			} else if doc.BM25 >= threshold {
+				// 按DocId从小到大遍历，分数相同时新文档的DocId更大，排在前面
+				top.docs[0] = doc
+				heap.Fix(top, 0)
+			}
+		}
+		for _, iterator := range iterators[:pivot+1] {
+			iterator.advance(docId + 1)
+		}
+	}
+
+	if numDocs, err = view.countAccepted(ctx, matchedTerms, labelCursors, docIds, compiledFilters); err != nil {
+		return nil, 0, 0, err
+	}
+	docs = top.docs
+	sort.Sort(sort.Reverse(indexedDocsByDocId(docs)))
+	return docs, numDocs, numScored, nil
+}
+
+// 包含terms中任意一个搜索键且满足条件的文档数，按DocId从小到大遍历，只解压DocId、不评分
+func (view *indexView) countAccepted(ctx context.Context, terms []*termPostings,
+	labelCursors []*termCursor, docIds map[uint64]bool, filters []rangeFilter) (int, error) {
+	iterators := make([]*docIdIterator, len(terms))
+	current := make([]uint64, len(terms))
+	ok := make([]bool, len(terms))
+	for i, term := range terms {
+		iterators[i] = view.newDocIdIterator(term)
+		current[i], ok[i] = iterators[i].next()
+	}
+	numDocs := 0
+	for n := 0; ; n++ {
+		if n%contextCheckInterval == 0 && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		// 各迭代器当前文档中最小的一个
+		var docId uint64
+		found := false
+		for i := range iterators {
+			if ok[i] && (!found || current[i] < docId) {
+				docId, found = current[i], true
+			}
+		}
+		if !found {
+			return numDocs, nil
+		}
+		if view.acceptDocument(docId, labelCursors, docIds, filters) != nil {
+			numDocs++
+		}
+		for i, iterator := range iterators {
+			if ok[i] && current[i] == docId {
+				current[i], ok[i] = iterator.next()
+			}
+		}
+	}
+}
+
+// 文档满足标签、docIds和范围条件时返回文档在快照中的状态，否则返回nil
+func (view *indexView) acceptDocument(docId uint64,
+	labelCursors []*termCursor, docIds map[uint64]bool, filters []rangeFilter) *docState {
+	state := view.docs.get(docId)
+	if state == nil {
+		return nil
+	}
+	if docIds != nil {
+		if _, found := docIds[docId]; !found {
+			return nil
+		}
+	}
+	if !matchFilters(state, filters) {
+		return nil
+	}
+	for _, cursor := range labelCursors {
+		if _, _, found := cursor.seek(docId); !found {
+			return nil
+		}
+	}
+	return state
+}
+
+// WAND中一个关键词的迭代器，按DocId从小到大遍历各段中的有效索引项
+type wandIterator struct {
+	view         *indexView
+	term         *termPostings
+	avgDocLength float32
+
+	// 各段中的当前位置
+	positions []wandPosition
+
+	// 当前文档，遍历结束时为math.MaxUint64
+	docId uint64
+
+	// 关键词BM25的上界
+	upperBound float32
+}
+
+// 迭代器在一个段中的位置：当前块的序号、解压后的DocId和块中的位置
+type wandPosition struct {
+	block    int
+	docIds   []uint64
+	position int
+}
+
+// 新建迭代器并移到第一个有效文档
+func (view *indexView) newWandIterator(term *termPostings, avgDocLength float32) *wandIterator {
+	iterator := &wandIterator{
+		view:         view,
+		term:         term,
+		avgDocLength: avgDocLength,
+		positions:    make([]wandPosition, len(term.lists)),
+	}
+	for i, list := range term.lists {
+		if bound := view.bm25(term.numDocs, list.MaxFrequency, list.MinTokenLength, avgDocLength); bound > iterator.upperBound {
+			iterator.upperBound = bound
+		}
+		iterator.positions[i].block = -1
+		iterator.seekBlock(i, 0)
+	}
+	iterator.update()
+	return iterator
+}
+
+// 将第i段的位置移到第block块开头之后第一个有效文档
+func (iterator *wandIterator) seekBlock(i, block int) {
+	list := iterator.term.lists[i]
+	position := &iterator.positions[i]
+	position.block = block
+	position.position = 0
+	if block < len(list.Blocks) {
+		position.docIds = appendBlockDocIds(position.docIds[:0], list, block)
+	}
+	iterator.skipDead(i)
+}
+
+// 跳过第i段中当前位置上已经失效的文档，块结束时进入下一块
+func (iterator *wandIterator) skipDead(i int) {
+	list := iterator.term.lists[i]
+	position := &iterator.positions[i]
+	for position.block < len(list.Blocks) {
+		if position.position == len(position.docIds) {
+			position.block++
+			position.position = 0
+			if position.block < len(list.Blocks) {
+				position.docIds = appendBlockDocIds(position.docIds[:0], list, position.block)
+			}
+			continue
+		}
+		if iterator.view.docs.isLive(iterator.term.segments[i], position.docIds[position.position]) {
+			return
+		}
+		position.position++
+	}
+}
+
+// 各段当前文档中最小的一个
+func (iterator *wandIterator) update() {
+	iterator.docId = math.MaxUint64
+	for i, position := range iterator.positions {
+		if position.block < len(iterator.term.lists[i].Blocks) {
+			if docId := position.docIds[position.position]; docId < iterator.docId {
+				iterator.docId = docId
+			}
+		}
+	}
+}
+
+// 移到DocId不小于target的第一个有效文档
+func (iterator *wandIterator) advance(target uint64) {
+	if iterator.docId >= target {
+		return
+	}
+	for i, list := range iterator.term.lists {
+		position := &iterator.positions[i]
+		if position.block >= len(list.Blocks) || position.docIds[position.position] >= target {
+			continue
+		}
+		if last := position.docIds[len(position.docIds)-1]; last < target {
+			if block := findPostingBlock(list, target); block > position.block {
+				iterator.seekBlock(i, block)
+			} else {
+				// target在两块之间
+				iterator.seekBlock(i, position.block+1)
+			}
+		}
+		if position.block >= len(list.Blocks) {
+			continue
+		}
+		docIds := position.docIds
+		position.position += sort.Search(len(docIds)-position.position, func(j int) bool {
+			return docIds[position.position+j] >= target
+		})
+		iterator.skipDead(i)
+	}
+	iterator.update()
+}
+
+// 包含docId的各块中BM25的上界，以及这些块都覆盖的最后一个DocId
+func (iterator *wandIterator) blockBound(docId uint64) (bound float32, end uint64) {
+	end = math.MaxUint64
+	for _, list := range iterator.term.lists {
+		if len(list.Blocks) == 0 {
+			continue
+		}
+		block := findPostingBlock(list, docId)
+		if docId < list.FirstDocIds[block] {
+			// 在第一块之前，这一段中没有文档
+			if list.FirstDocIds[block]-1 < end {
+				end = list.FirstDocIds[block] - 1
+			}
+			continue
+		}
+		if block+1 < len(list.FirstDocIds) && list.FirstDocIds[block+1]-1 < end {
+			end = list.FirstDocIds[block+1] - 1
+		}
+		b := &list.Blocks[block]
+		if blockBound := iterator.view.bm25(iterator.term.numDocs, b.MaxFrequency, b.MinTokenLength, iterator.avgDocLength); blockBound > bound {
+			bound = blockBound
+		}
+	}
+	return
+}
+
+// 为了按当前文档排序
+type wandIteratorsByDocId []*wandIterator
+
+func (iterators wandIteratorsByDocId) Len() int {
+	return len(iterators)
+}
+func (iterators wandIteratorsByDocId) Swap(i, j int) {
+	iterators[i], iterators[j] = iterators[j], iterators[i]
+}
+func (iterators wandIteratorsByDocId) Less(i, j int) bool {
+	return iterators[i].docId < iterators[j].docId
+}
+
+// 已选出的文档，为了实现heap.Interface，堆顶是BM25最小（相同时DocId最小）的文档
+type wandTopDocs struct {
+	docs []types.IndexedDocument
+}
+
+func (top *wandTopDocs) Len() int {
+	return len(top.docs)
+}
+func (top *wandTopDocs) Less(i, j int) bool {
+	if top.docs[i].BM25 != top.docs[j].BM25 {
+		return top.docs[i].BM25 < top.docs[j].BM25
+	}
+	return top.docs[i].DocId < top.docs[j].DocId
+}
+func (top *wandTopDocs) Swap(i, j int) {
+	top.docs[i], top.docs[j] = top.docs[j], top.docs[i]
+}
+func (top *wandTopDocs) Push(x interface{}) {
+	top.docs = append(top.docs, x.(types.IndexedDocument))
+}
+func (top *wandTopDocs) Pop() interface{} {
+	n := len(top.docs) - 1
+	doc := top.docs[n]
+	top.docs = top.docs[:n]
+	return doc
+}
+
+// 为了按DocId排序
+type indexedDocsByDocId []types.IndexedDocument
+
+func (docs indexedDocsByDocId) Len() int {
+	return len(docs)
+}
+func (docs indexedDocsByDocId) Swap(i, j int) {
+	docs[i], docs[j] = docs[j], docs[i]
+}
+func (docs indexedDocsByDocId) Less(i, j int) bool {
+	return docs[i].DocId < docs[j].DocId
+}
@@ -1,8 +1,8 @@
 package engine
 
 import (
-	"log"
-	"strings"
+	"github.com/Jarlene/wukong/types"
+	"sort"
 )
 
 /**
@@ -12,26 +12,28 @@ import (
 *
  */
 
-func (engine *Engine) suggestion(key string) []string {
+// 搜索提示：返回以prefix开头的搜索键，按包含它的文档数从大到小排列，文档数相同时按字节序排列
+//
+// 搜索键来自各shard索引器中的词典，不需要持久存储。n为最多返回的个数，小于等于零时不限制
+func (engine *Engine) Suggest(prefix string, n int) []types.Suggestion {
 	if !engine.initialized {
-		log.Fatal("请初始化引擎")
+		return nil
 	}
-	res := make([]string, 10)
-	var i = 0
-	if engine.initOptions.UsePersistentStorage {
-		for _, db := range engine.dbs {
-			db[getDB("index")].ForEach(func(k, v []byte) error {
-				str := string(k)
-				if strings.HasPrefix(str, key) {
-					res[i] = str
-					i = i + 1
-				}
-				return nil
-			})
+
+	// 合并各shard中同一个搜索键的文档数
+	numDocs := make(map[string]int)
+	for shard := range engine.indexers {
+		for _, suggestion := range engine.indexers[shard].Suggest(prefix) {
+			numDocs[suggestion.Text] += suggestion.NumDocs
 		}
 	}
-	if len(res) >= 10 {
-		return res[0:10]
+	suggestions := make(types.Suggestions, 0, len(numDocs))
+	for text, num := range numDocs {
+		suggestions = append(suggestions, types.Suggestion{Text: text, NumDocs: num})
+	}
+	sort.Sort(suggestions)
+	if n > 0 && len(suggestions) > n {
+		suggestions = suggestions[:n]
 	}
-	return res
+	return suggestions
 }
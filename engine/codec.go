@@ -0,0 +1,416 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/Jarlene/wukong/types"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// info和index数据库中值的编码
+//
+// 每个值以两字节的头开始：codecMagic和格式版本号。gob编码的第一个字节（消息长度）不会是0，
+// 因此没有头的值是旧版本用gob编码的，启动时读出后改写为当前格式。
+//
+// 版本4中文档信息的格式为：
+//
+//	头 | TokenLengths（float32，4字节） | 具名字段数n | n个（字段名长度 | 字段名 | 关键词长度（float32，4字节））
+//	   | 数值属性数m | m个（属性名长度 | 属性名 | 类型（1字节） | 值（8字节））
+//	   | 地理坐标属性数k | k个（属性名长度 | 属性名 | 纬度（float64，8字节） | 经度（float64，8字节））
+//	   | 评分字段的编码方式（1字节） | 评分字段
+//
+// 属性的类型为0时值为int64，为1时为float64。版本1中没有具名字段、数值属性和地理坐标属性的部分，
+// 版本2中没有数值属性和地理坐标属性的部分，版本3中没有地理坐标属性的部分，读出后同样改写为当前格式。
+// 评分字段为nil时不编码；类型和EngineInitOptions.ScoringFieldsType相同时用gob编码该类型的值，
+// 不需要在gob中注册；否则用gob编码接口值，该类型必须在gob中注册。
+//
+// 反向索引块的格式为：
+//
+//	头 | 标志（1字节） | 文档数n | n个DocId | n个词频（float32，4字节） | n个位置列表 | n个序号列表
+//
+// DocId为和前一个DocId之差的uvarint，位置列表为位置个数的uvarint加上和前一个位置之差的varint，
+// 序号列表（关键词序号，见types.KeywordIndices）的编码和位置列表相同。标志的第0位表示有词频，
+// 第1位表示有位置列表，第2位表示有序号列表，没有的部分不编码。
+//
+// 版本1到4中反向索引块的格式相同，版本号只随文档信息的格式增加，这些块读出时不需要改写。
+// 序号列表在版本4中通过标志的第2位加入，没有这一位的旧块照常读出，其中文档的序号为nil，
+// 短语查询对这些文档按字节位置计算间隔，文档重新索引后写入序号。
+// 没有头的gob编码的整行反向索引在启动时按当前格式切分成块改写（见storeLegacyPostings）。
+// 个数和长度均为uvarint，除特别说明外整数均为小端序。
+const (
+	codecMagic   = 0x00
+	codecVersion = 4
+)
+
+// 评分字段的编码方式
+const (
+	fieldsNil   = 0
+	fieldsTyped = 1
+	fieldsGob   = 2
+)
+
+// 数值属性的类型
+const (
+	attributeInt   = 0
+	attributeFloat = 1
+)
+
+// 反向索引块的标志
+const (
+	hasFrequencies = 1 << 0
+	hasLocations   = 1 << 1
+	hasPositions   = 1 << 2
+)
+
+var errCorruptValue = errors.New("持久存储中的值格式不正确")
+
+// 检查值的头，返回去掉头的部分和格式版本号。没有头（旧版本的gob编码）时版本号为0
+func readHeader(data []byte) (body []byte, version byte, err error) {
+	if len(data) == 0 || data[0] != codecMagic {
+		return data, 0, nil
+	}
+	if len(data) < 2 {
+		return nil, 0, errCorruptValue
+	}
+	if data[1] == 0 || data[1] > codecVersion {
+		return nil, 0, fmt.Errorf("不支持的持久存储格式版本: %d", data[1])
+	}
+	return data[2:], data[1], nil
+}
+
+// 编码评分字段，fieldsType为EngineInitOptions.ScoringFieldsType的类型，可以为nil
+func encodeFields(fields interface{}, fieldsType reflect.Type) ([]byte, error) {
+	if fields == nil {
+		return []byte{fieldsNil}, nil
+	}
+	var buf bytes.Buffer
+	if reflect.TypeOf(fields) == fieldsType {
+		buf.WriteByte(fieldsTyped)
+		if err := gob.NewEncoder(&buf).EncodeValue(reflect.ValueOf(fields)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	buf.WriteByte(fieldsGob)
+	if err := gob.NewEncoder(&buf).Encode(&fields); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeFields(data []byte, fieldsType reflect.Type) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errCorruptValue
+	}
+	switch data[0] {
+	case fieldsNil:
+		return nil, nil
+	case fieldsTyped:
+		if fieldsType == nil {
+			return nil, errors.New("解码评分字段需要设置EngineInitOptions.ScoringFieldsType")
+		}
+		value := reflect.New(fieldsType)
+		if err := gob.NewDecoder(bytes.NewReader(data[1:])).DecodeValue(value); err != nil {
+			return nil, err
+		}
+		return value.Elem().Interface(), nil
+	case fieldsGob:
+		var fields interface{}
+		if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&fields); err != nil {
+			return nil, err
+		}
+		return fields, nil
+	}
+	return nil, errCorruptValue
+}
+
+func encodeDocInfo(docInfo *types.DocInfo, fieldsType reflect.Type) ([]byte, error) {
+	fields, err := encodeFields(docInfo.Fields, fieldsType)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 6, 6+len(fields))
+	data[0], data[1] = codecMagic, codecVersion
+	binary.LittleEndian.PutUint32(data[2:6], math.Float32bits(docInfo.TokenLengths))
+
+	// 字段按名称排序，使同样的文档信息编码相同
+	names := make([]string, 0, len(docInfo.FieldTokenLengths))
+	for name := range docInfo.FieldTokenLengths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := make([]byte, binary.MaxVarintLen64)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(len(names)))]...)
+	for _, name := range names {
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(name)))]...)
+		data = append(data, name...)
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(docInfo.FieldTokenLengths[name]))
+		data = append(data, buf[:4]...)
+	}
+
+	names = names[:0]
+	for name := range docInfo.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(len(names)))]...)
+	for _, name := range names {
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(name)))]...)
+		data = append(data, name...)
+		value := docInfo.Attributes[name]
+		if value.IsFloat {
+			data = append(data, attributeFloat)
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(value.Float))
+		} else {
+			data = append(data, attributeInt)
+			binary.LittleEndian.PutUint64(buf, uint64(value.Int))
+		}
+		data = append(data, buf[:8]...)
+	}
+
+	names = names[:0]
+	for name := range docInfo.GeoPoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(len(names)))]...)
+	for _, name := range names {
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(name)))]...)
+		data = append(data, name...)
+		point := docInfo.GeoPoints[name]
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(point.Lat))
+		data = append(data, buf[:8]...)
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(point.Lon))
+		data = append(data, buf[:8]...)
+	}
+	return append(data, fields...), nil
+}
+
+// 解码文档信息，值是旧版本的格式时legacy为true
+func decodeDocInfo(data []byte, fieldsType reflect.Type) (docInfo *types.DocInfo, legacy bool, err error) {
+	body, version, err := readHeader(data)
+	if err != nil {
+		return nil, false, err
+	}
+	docInfo = new(types.DocInfo)
+	if version == 0 {
+		err = gob.NewDecoder(bytes.NewReader(body)).Decode(docInfo)
+		return docInfo, true, err
+	}
+	if len(body) < 4 {
+		return nil, false, errCorruptValue
+	}
+	docInfo.TokenLengths = math.Float32frombits(binary.LittleEndian.Uint32(body[0:4]))
+	body = body[4:]
+	if version >= 2 {
+		n, size := binary.Uvarint(body)
+		if size <= 0 || n > uint64(len(body)) {
+			return nil, false, errCorruptValue
+		}
+		body = body[size:]
+		if n > 0 {
+			docInfo.FieldTokenLengths = make(map[string]float32, n)
+		}
+		for i := uint64(0); i < n; i++ {
+			length, size := binary.Uvarint(body)
+			if size <= 0 || length+4 > uint64(len(body)-size) {
+				return nil, false, errCorruptValue
+			}
+			body = body[size:]
+			name := string(body[:length])
+			docInfo.FieldTokenLengths[name] = math.Float32frombits(binary.LittleEndian.Uint32(body[length : length+4]))
+			body = body[length+4:]
+		}
+	}
+	if version >= 3 {
+		n, size := binary.Uvarint(body)
+		if size <= 0 || n > uint64(len(body)) {
+			return nil, false, errCorruptValue
+		}
+		body = body[size:]
+		if n > 0 {
+			docInfo.Attributes = make(map[string]types.AttributeValue, n)
+		}
+		for i := uint64(0); i < n; i++ {
+			length, size := binary.Uvarint(body)
+			if size <= 0 || length+9 > uint64(len(body)-size) {
+				return nil, false, errCorruptValue
+			}
+			body = body[size:]
+			name := string(body[:length])
+			bits := binary.LittleEndian.Uint64(body[length+1 : length+9])
+			switch body[length] {
+			case attributeInt:
+				docInfo.Attributes[name] = types.AttributeValue{Int: int64(bits)}
+			case attributeFloat:
+				docInfo.Attributes[name] = types.AttributeValue{IsFloat: true, Float: math.Float64frombits(bits)}
+			default:
+				return nil, false, errCorruptValue
+			}
+			body = body[length+9:]
+		}
+	}
+	if version >= 4 {
+		n, size := binary.Uvarint(body)
+		if size <= 0 || n > uint64(len(body)) {
+			return nil, false, errCorruptValue
+		}
+		body = body[size:]
+		if n > 0 {
+			docInfo.GeoPoints = make(map[string]types.GeoPoint, n)
+		}
+		for i := uint64(0); i < n; i++ {
+			length, size := binary.Uvarint(body)
+			if size <= 0 || length+16 > uint64(len(body)-size) {
+				return nil, false, errCorruptValue
+			}
+			body = body[size:]
+			docInfo.GeoPoints[string(body[:length])] = types.GeoPoint{
+				Lat: math.Float64frombits(binary.LittleEndian.Uint64(body[length : length+8])),
+				Lon: math.Float64frombits(binary.LittleEndian.Uint64(body[length+8 : length+16])),
+			}
+			body = body[length+16:]
+		}
+	}
+	docInfo.Fields, err = decodeFields(body, fieldsType)
+	return docInfo, version < codecVersion, err
+}
+
+func encodeKeywordIndices(indices *types.KeywordIndices) []byte {
+	n := len(indices.DocIds)
+	var flags byte
+	if len(indices.Frequencies) > 0 {
+		flags |= hasFrequencies
+	}
+	if len(indices.Locations) > 0 {
+		flags |= hasLocations
+	}
+	if len(indices.Positions) > 0 {
+		flags |= hasPositions
+	}
+
+	data := make([]byte, 0, 3+binary.MaxVarintLen64+2*n)
+	data = append(data, codecMagic, codecVersion, flags)
+	buf := make([]byte, binary.MaxVarintLen64)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(n))]...)
+	var previous uint64
+	for _, docId := range indices.DocIds {
+		data = append(data, buf[:binary.PutUvarint(buf, docId-previous)]...)
+		previous = docId
+	}
+	if flags&hasFrequencies != 0 {
+		for _, frequency := range indices.Frequencies {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(frequency))
+			data = append(data, buf[:4]...)
+		}
+	}
+	if flags&hasLocations != 0 {
+		data = appendLocations(data, indices.Locations)
+	}
+	if flags&hasPositions != 0 {
+		data = appendLocations(data, indices.Positions)
+	}
+	return data
+}
+
+// 编码位置列表或者序号列表
+func appendLocations(data []byte, lists [][]int) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, list := range lists {
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(list)))]...)
+		previous := 0
+		for _, location := range list {
+			data = append(data, buf[:binary.PutVarint(buf, int64(location-previous))]...)
+			previous = location
+		}
+	}
+	return data
+}
+
+// 解码n个位置列表或者序号列表
+func readLocations(reader *bytes.Reader, n uint64) ([][]int, error) {
+	lists := make([][]int, n)
+	for i := range lists {
+		count, err := binary.ReadUvarint(reader)
+		if err != nil || count > uint64(reader.Len()) {
+			return nil, errCorruptValue
+		}
+		list := make([]int, count)
+		previous := 0
+		for j := range list {
+			delta, err := binary.ReadVarint(reader)
+			if err != nil {
+				return nil, errCorruptValue
+			}
+			previous += int(delta)
+			list[j] = previous
+		}
+		lists[i] = list
+	}
+	return lists, nil
+}
+
+// 解码反向索引块，值是旧版本的gob编码时legacy为true
+func decodeKeywordIndices(data []byte) (indices *types.KeywordIndices, legacy bool, err error) {
+	body, version, err := readHeader(data)
+	if err != nil {
+		return nil, false, err
+	}
+	indices = new(types.KeywordIndices)
+	if version == 0 {
+		err = gob.NewDecoder(bytes.NewReader(body)).Decode(indices)
+		if len(indices.Locations) > 0 {
+			indices.Positions = make([][]int, len(indices.Locations))
+		}
+		return indices, true, err
+	}
+
+	reader := bytes.NewReader(body)
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return nil, false, errCorruptValue
+	}
+	n, err := binary.ReadUvarint(reader)
+	if err != nil || n > uint64(reader.Len()) {
+		return nil, false, errCorruptValue
+	}
+	indices.DocIds = make([]uint64, n)
+	var previous uint64
+	for i := range indices.DocIds {
+		delta, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, false, errCorruptValue
+		}
+		previous += delta
+		indices.DocIds[i] = previous
+	}
+	if flags&hasFrequencies != 0 {
+		if uint64(reader.Len()) < 4*n {
+			return nil, false, errCorruptValue
+		}
+		indices.Frequencies = make([]float32, n)
+		buf := make([]byte, 4)
+		for i := range indices.Frequencies {
+			reader.Read(buf)
+			indices.Frequencies[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf))
+		}
+	}
+	if flags&hasLocations != 0 {
+		if indices.Locations, err = readLocations(reader, n); err != nil {
+			return nil, false, err
+		}
+		if flags&hasPositions != 0 {
+			if indices.Positions, err = readLocations(reader, n); err != nil {
+				return nil, false, err
+			}
+		} else {
+			indices.Positions = make([][]int, n)
+		}
+	}
+	return indices, false, nil
+}
@@ -7,3 +7,13 @@ func (engine *Engine) NumTokenIndexAdded() uint64 {
 func (engine *Engine) NumDocumentsIndexed() uint64 {
 	return engine.numDocumentsIndexed
 }
+
+// 估计各shard反向索引占用的内存字节数之和，以及不压缩时需要的字节数
+func (engine *Engine) PostingsSize() (compressed, uncompressed int) {
+	for shard := range engine.indexers {
+		c, u := engine.indexers[shard].PostingsSize()
+		compressed += c
+		uncompressed += u
+	}
+	return
+}
@@ -1,19 +1,22 @@
 package engine
 
 import (
-	// "encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/Jarlene/wukong/analyzer"
 	"github.com/Jarlene/wukong/core"
 	"github.com/Jarlene/wukong/storage"
 	"github.com/Jarlene/wukong/types"
 	"github.com/Jarlene/wukong/utils"
 	"github.com/huichen/murmur"
-	"github.com/huichen/sego"
 	"log"
 	"os"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -35,10 +38,15 @@ type Engine struct {
 
 	indexers   []core.Indexer
 	rankers    []core.Ranker
-	segmenter  sego.Segmenter
+	analyzer   types.Analyzer
 	stopTokens StopTokens
+	synonyms   Synonyms
 	// 数据库实例[shard][info/index]db
 	dbs [][2]storage.Storage
+	// 每个shard的预写日志
+	wals []*writeAheadLog
+	// 每个shard的index数据库中各关键词反向索引块的下界，见posting_blocks.go
+	postingBlocks []map[string][]uint64
 
 	// 建立分词器使用的通信通道
 	segmenterChannel chan segmenterRequest
@@ -56,33 +64,116 @@ type Engine struct {
 	// 建立持久存储使用的通信通道
 	persistentStorageIndexDocumentChannels []chan persistentStorageIndexDocumentRequest
 	persistentStorageInitChannel           chan bool
+
+	// 写入持久存储时遇到的第一个错误
+	persistentStorageErr     error
+	persistentStorageErrLock sync.Mutex
+
+	// 尚未处理完毕的索引和删除请求数，降为零时通知FlushIndex
+	numPendingRequests  int
+	pendingRequestsLock sync.Mutex
+	pendingRequestsCond *sync.Cond
+
+	// 每个shard中尚未处理完的文档添加和删除请求，见docRequestsShard
+	docRequests       []docRequestsShard
+	docRequestVersion uint64
+}
+
+// 同一文档的添加和删除请求按调用顺序编号，可能经过不同的通道和协程而乱序到达。
+// 索引器只执行比已执行的请求更新的请求，排序器和持久存储只执行索引器最后执行的请求，
+// 过时的请求直接完成，其效果已被更新的请求取代
+type docRequestsShard struct {
+	sync.Mutex
+	docs map[uint64]*docRequests
+}
+
+type docRequests struct {
+	applied    uint64 // 索引器最后执行的请求编号
+	numPending int    // 尚未经过排序器的请求数，降为零时删除记录
+	// 索引器已经执行、但被取代而没有写入持久存储的请求修改的搜索键，由之后写入的请求一起重写
+	changed map[string]bool
 }
 
+var (
+	ErrNotInitialized     = errors.New("必须先初始化引擎")
+	ErrAlreadyInitialized = errors.New("请勿重复初始化引擎")
+)
+
+// 初始化引擎，出错时退出程序。需要处理错误时请使用Open
 func (engine *Engine) Init(options types.EngineInitOptions) {
+	if err := engine.Open(options); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 初始化引擎，配置错误、词典或停用词文件不存在、持久存储无法打开时返回错误
+// 出错后引擎不可使用
+func (engine *Engine) Open(options types.EngineInitOptions) error {
 	// 初始化初始参数
 	if engine.initialized {
-		log.Fatal("请勿重复初始化引擎")
+		return ErrAlreadyInitialized
 	}
 
 	// 将线程数设置为CPU数
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	options.Init()
+	if err := options.Init(); err != nil {
+		return err
+	}
 	engine.initOptions = options
-	engine.initialized = true
 
-	// 载入分词器词典
-	engine.segmenter.LoadDictionary(options.SegmenterDictionaries)
+	// 初始化分词器，未指定时载入sego词典
+	if !options.NotUsingSegmenter {
+		if options.Analyzer != nil {
+			engine.analyzer = options.Analyzer
+		} else {
+			// sego载入词典失败时会直接退出程序，因此先检查文件是否存在
+			for _, dictionary := range strings.Split(options.SegmenterDictionaries, ",") {
+				if _, err := os.Stat(dictionary); err != nil {
+					return fmt.Errorf("无法载入字典文件: %v", err)
+				}
+			}
+			engine.analyzer = analyzer.NewSegoAnalyzer(options.SegmenterDictionaries)
+		}
+	}
 
-	// 初始化停用词
-	engine.stopTokens.Init(options.StopTokenFile)
+	// 初始化停用词和同义词
+	if err := engine.stopTokens.Open(options.StopTokenFile); err != nil {
+		return err
+	}
+	var segment func(text string) []string
+	if engine.analyzer != nil {
+		segment = engine.Segment
+	}
+	if err := engine.synonyms.Init(options.SynonymFile, segment); err != nil {
+		return err
+	}
 
 	// 初始化索引器和排序器
+	engine.indexers = make([]core.Indexer, options.NumShards)
+	engine.rankers = make([]core.Ranker, options.NumShards)
 	for shard := 0; shard < options.NumShards; shard++ {
-		engine.indexers = append(engine.indexers, core.Indexer{})
-		engine.indexers[shard].Init(shard, *options.IndexerInitOptions)
+		if err := engine.indexers[shard].Open(shard, *options.IndexerInitOptions); err != nil {
+			engine.closeIndexers()
+			return err
+		}
+		if err := engine.rankers[shard].Open(shard, engine.indexers[shard].DocInfosShard); err != nil {
+			engine.closeIndexers()
+			return err
+		}
+	}
+
+	// 打开持久存储并从中恢复
+	if options.UsePersistentStorage {
+		if err := engine.openPersistentStorage(); err != nil {
+			engine.closeIndexers()
+			return err
+		}
+	}
 
-		engine.rankers = append(engine.rankers, core.Ranker{})
-		engine.rankers[shard].Init(shard)
+	engine.pendingRequestsCond = sync.NewCond(&engine.pendingRequestsLock)
+	engine.docRequests = make([]docRequestsShard, options.NumShards)
+	for shard := range engine.docRequests {
+		engine.docRequests[shard].docs = make(map[uint64]*docRequests)
 	}
 
 	// 初始化分词器通道
@@ -136,8 +227,6 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 			engine.persistentStorageIndexDocumentChannels[shard] = make(
 				chan persistentStorageIndexDocumentRequest)
 		}
-		engine.persistentStorageInitChannel = make(
-			chan bool, engine.initOptions.NumShards)
 	}
 
 	// 启动分词器
@@ -162,61 +251,159 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 
 	// 启动持久化存储工作协程
 	if engine.initOptions.UsePersistentStorage {
-		err := os.MkdirAll(engine.initOptions.PersistentStorageFolder, 0700)
+		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+			go engine.persistentStorageIndexDocumentWorker(shard)
+		}
+	}
+
+	engine.initialized = true
+	return nil
+}
+
+// 停止全部索引器的后台合并协程
+func (engine *Engine) closeIndexers() {
+	for shard := range engine.indexers {
+		engine.indexers[shard].Close()
+	}
+}
+
+// 打开或者创建持久存储数据库，并从中恢复索引
+func (engine *Engine) openPersistentStorage() error {
+	err := os.MkdirAll(engine.initOptions.PersistentStorageFolder, 0700)
+	if err != nil {
+		return fmt.Errorf("无法创建目录%s: %v", engine.initOptions.PersistentStorageFolder, err)
+	}
+
+	// 打开或者创建数据库
+	engine.dbs = make([][2]storage.Storage, engine.initOptions.NumShards)
+	if err := engine.openDBs(); err != nil {
+		return err
+	}
+
+	// 从数据库中恢复
+	engine.postingBlocks = make([]map[string][]uint64, engine.initOptions.NumShards)
+	for shard := range engine.postingBlocks {
+		engine.postingBlocks[shard] = make(map[string][]uint64)
+	}
+	engine.persistentStorageInitChannel = make(
+		chan bool, engine.initOptions.NumShards)
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		go engine.persistentStorageInitWorker(shard)
+	}
+
+	// 等待恢复完成
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		<-engine.persistentStorageInitChannel
+	}
+
+	// 重放预写日志，将上次退出前已确认但尚未完整写入数据库的操作补齐
+	engine.wals = make([]*writeAheadLog, engine.initOptions.NumShards)
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		engine.indexers[shard].Reconcile()
+		walPath := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + ".wal." + strconv.Itoa(shard)
+		wal, err := openWriteAheadLog(walPath)
+		if err == nil {
+			engine.wals[shard] = wal
+			err = engine.replayWriteAheadLog(shard)
+		}
 		if err != nil {
-			log.Fatal("无法创建目录", engine.initOptions.PersistentStorageFolder)
+			engine.closeWALs()
+			engine.closeDBs()
+			return fmt.Errorf("无法恢复预写日志%s: %v", walPath, err)
 		}
 
-		// 打开或者创建数据库
-		engine.dbs = make([][2]storage.Storage, engine.initOptions.NumShards)
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			dbPathInfo := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + ".info." + strconv.Itoa(shard)
-			dbInfo, err := storage.OpenStorage(dbPathInfo)
-			if dbInfo == nil || err != nil {
-				log.Fatal("无法打开数据库", dbPathInfo, ": ", err)
-			}
-			dbPathIndex := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + ".index." + strconv.Itoa(shard)
-			dbIndex, err := storage.OpenStorage(dbPathIndex)
-			if dbIndex == nil || err != nil {
-				log.Fatal("无法打开数据库", dbPathIndex, ": ", err)
+		// 清除恢复出的反向索引中已删除的文档（没有文档信息的文档）。此时还没有新的请求，索引器和数据库一致
+		batch := storage.NewWriteBatch()
+		for keyword := range engine.indexers[shard].Compact() {
+			engine.storePostings(batch, shard, keyword)
+		}
+		if batch.Len() > 0 {
+			if err := engine.dbs[shard][indexDB].Write(batch); err != nil {
+				engine.closeWALs()
+				engine.closeDBs()
+				return fmt.Errorf("无法清除已删除的文档: %v", err)
 			}
-			engine.dbs[shard][getDB("info")] = dbInfo
-			engine.dbs[shard][getDB("index")] = dbIndex
+		}
+	}
 
+	// 关闭并重新打开数据库
+	engine.closeDBs()
+	if err := engine.openDBs(); err != nil {
+		engine.closeWALs()
+		return err
+	}
+	return nil
+}
+
+// 等待持久存储工作协程处理完已经收到的请求
+func (engine *Engine) syncPersistentStorage() {
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		synced := make(chan bool)
+		engine.persistentStorageIndexDocumentChannels[shard] <- persistentStorageIndexDocumentRequest{
+			typ:    "sync",
+			synced: synced,
 		}
+		<-synced
+	}
+}
 
-		// 从数据库中恢复
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			go engine.persistentStorageInitWorker(shard)
+// 清空全部预写日志，返回遇到的第一个错误
+func (engine *Engine) truncateWALs() (err error) {
+	for _, wal := range engine.wals {
+		if wal == nil {
+			continue
 		}
+		if truncateErr := wal.truncate(); truncateErr != nil && err == nil {
+			err = truncateErr
+		}
+	}
+	return
+}
 
-		// 等待恢复完成
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			<-engine.persistentStorageInitChannel
+// 关闭全部预写日志，返回遇到的第一个错误
+func (engine *Engine) closeWALs() (err error) {
+	for shard, wal := range engine.wals {
+		if wal == nil {
+			continue
 		}
+		if closeErr := wal.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		engine.wals[shard] = nil
+	}
+	return
+}
 
-		// 关闭并重新打开数据库
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			engine.dbs[shard][0].Close()
-			engine.dbs[shard][1].Close()
-			dbPathInfo := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + ".info." + strconv.Itoa(shard)
-			dbInfo, err := storage.OpenStorage(dbPathInfo)
-			if dbInfo == nil || err != nil {
-				log.Fatal("无法打开数据库", dbPathInfo, ": ", err)
-			}
-			dbPathIndex := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + ".index." + strconv.Itoa(shard)
-			dbIndex, err := storage.OpenStorage(dbPathIndex)
-			if dbIndex == nil || err != nil {
-				log.Fatal("无法打开数据库", dbPathIndex, ": ", err)
+// 打开每个shard的info和index数据库，出错时关闭已经打开的数据库
+func (engine *Engine) openDBs() error {
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		for typ, name := range [2]string{"info", "index"} {
+			dbPath := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + "." + name + "." + strconv.Itoa(shard)
+			db, err := storage.OpenStorage(dbPath)
+			if db == nil || err != nil {
+				engine.closeDBs()
+				return fmt.Errorf("无法打开数据库%s: %v", dbPath, err)
 			}
-			engine.dbs[shard][getDB("info")] = dbInfo
-			engine.dbs[shard][getDB("index")] = dbIndex
+			engine.dbs[shard][typ] = db
 		}
+	}
+	return nil
+}
 
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			go engine.persistentStorageIndexDocumentWorker(shard)
+// 关闭全部已经打开的数据库，返回遇到的第一个错误
+func (engine *Engine) closeDBs() (err error) {
+	for shard := range engine.dbs {
+		for typ, db := range engine.dbs[shard] {
+			if db == nil {
+				continue
+			}
+			if closeErr := db.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			engine.dbs[shard][typ] = nil
 		}
 	}
+	return
 }
 
 // 将文档加入索引
@@ -228,84 +415,306 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 // 注意：
 //      1. 这个函数是线程安全的，请尽可能并发调用以提高索引速度
 // 	2. 这个函数调用是非同步的，也就是说在函数返回时有可能文档还没有加入索引中，因此
-//         如果立刻调用Search可能无法查询到这个文档。强制刷新索引请调用FlushIndex函数。
+//         如果立刻调用Search可能无法查询到这个文档。强制刷新索引请调用FlushIndex函数，
+//         需要等待某个文档时请使用IndexAsync。
 func (engine *Engine) IndexDocument(docId uint64, data types.DocumentIndexData) {
+	if err := engine.Index(docId, data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 将文档加入索引，和IndexDocument相同，但出错时返回错误而不是退出程序
+func (engine *Engine) Index(docId uint64, data types.DocumentIndexData) error {
+	_, err := engine.IndexAsync(docId, data)
+	return err
+}
+
+// 将文档加入索引，返回的句柄在文档可以被搜索到（使用持久存储时还要求已经写入数据库）后完成
+func (engine *Engine) IndexAsync(docId uint64, data types.DocumentIndexData) (*IndexHandle, error) {
 	if !engine.initialized {
-		log.Fatal("必须先初始化引擎")
+		return nil, ErrNotInitialized
+	}
+	if err := validateAttributes(data); err != nil {
+		return nil, err
+	}
+	handle := newIndexHandle(1)
+	engine.indexDocument(docId, data, handle)
+	return handle, nil
+}
+
+// 将一批文档加入索引，返回的句柄在所有文档都处理完毕后完成
+func (engine *Engine) IndexBatch(docs map[uint64]types.DocumentIndexData) (*IndexHandle, error) {
+	if !engine.initialized {
+		return nil, ErrNotInitialized
+	}
+	for _, data := range docs {
+		if err := validateAttributes(data); err != nil {
+			return nil, err
+		}
 	}
+	handle := newIndexHandle(len(docs))
+	for docId, data := range docs {
+		engine.indexDocument(docId, data, handle)
+	}
+	return handle, nil
+}
+
+func (engine *Engine) indexDocument(docId uint64, data types.DocumentIndexData, handle *IndexHandle) {
 	atomic.AddUint64(&engine.numIndexingRequests, 1)
-	shard := int(murmur.Murmur3([]byte(fmt.Sprint("%d", docId))) % uint32(engine.initOptions.NumShards))
+	engine.addPendingRequests(1)
+
+	shard := engine.getShard(docId)
+	version := atomic.AddUint64(&engine.docRequestVersion, 1)
+	engine.beginDocRequest(shard, docId)
 	engine.segmenterChannel <- segmenterRequest{
-		docId: docId, shard: shard, data: data}
+		docId: docId, version: version, shard: shard, data: data, handle: handle}
+}
+
+// 检查文档的数值属性类型（见types.NewAttributeValue）和地理坐标属性的范围
+func validateAttributes(data types.DocumentIndexData) error {
+	for name, value := range data.Attributes {
+		if point, ok := value.(types.GeoPoint); ok {
+			if !point.Valid() {
+				return fmt.Errorf("属性%s的坐标超出范围: %v", name, point)
+			}
+			continue
+		}
+		if _, ok := types.NewAttributeValue(value); !ok {
+			return fmt.Errorf("属性%s的类型不支持: %T", name, value)
+		}
+	}
+	return nil
+}
+
+// 文档所在的shard
+func (engine *Engine) getShard(docId uint64) int {
+	return int(murmur.Murmur3([]byte(fmt.Sprint("%d", docId))) % uint32(engine.initOptions.NumShards))
+}
+
+// 一个索引请求处理完毕，通知句柄和FlushIndex
+func (engine *Engine) finishIndexing(handle *IndexHandle, err error) {
+	handle.finishDoc(err)
+	engine.finishPendingRequest()
+}
+
+func (engine *Engine) addPendingRequests(n int) {
+	engine.pendingRequestsLock.Lock()
+	engine.numPendingRequests += n
+	engine.pendingRequestsLock.Unlock()
+}
+
+// 登记文档在shard中的一个新请求
+func (engine *Engine) beginDocRequest(shard int, docId uint64) {
+	requests := &engine.docRequests[shard]
+	requests.Lock()
+	if requests.docs[docId] == nil {
+		requests.docs[docId] = new(docRequests)
+	}
+	requests.docs[docId].numPending++
+	requests.Unlock()
+}
+
+// 在索引器中执行文档的请求，该文档已经执行过更新的请求时跳过，返回是否执行
+func (engine *Engine) applyDocRequest(shard int, docId, version uint64, apply func()) bool {
+	requests := &engine.docRequests[shard]
+	requests.Lock()
+	defer requests.Unlock()
+	doc := requests.docs[docId]
+	if version < doc.applied {
+		return false
+	}
+	doc.applied = version
+	apply()
+	return true
+}
+
+// 文档的请求经过排序器，只有索引器最后执行的请求才执行apply，返回是否执行
+// changed为请求在索引器中修改的搜索键，传给apply时加上之前被取代的请求修改的搜索键
+func (engine *Engine) finishDocRequest(shard int, docId, version uint64, changed map[string]bool, apply func(changed map[string]bool)) bool {
+	requests := &engine.docRequests[shard]
+	requests.Lock()
+	defer requests.Unlock()
+	doc := requests.docs[docId]
+	latest := version == doc.applied
+	if len(doc.changed) > 0 || (!latest && len(changed) > 0) {
+		if doc.changed == nil {
+			doc.changed = make(map[string]bool)
+		}
+		for k, v := range changed {
+			doc.changed[k] = v
+		}
+	}
+	if latest {
+		if doc.changed != nil {
+			changed, doc.changed = doc.changed, nil
+		}
+		apply(changed)
+	}
+	doc.numPending--
+	if doc.numPending == 0 {
+		delete(requests.docs, docId)
+	}
+	return latest
+}
+
+func (engine *Engine) finishPendingRequest() {
+	engine.pendingRequestsLock.Lock()
+	engine.numPendingRequests--
+	if engine.numPendingRequests == 0 {
+		engine.pendingRequestsCond.Broadcast()
+	}
+	engine.pendingRequestsLock.Unlock()
 }
 
 // 只分词与过滤弃用词
 func (engine *Engine) Segment(content string) (keywords []string) {
-	segments := engine.segmenter.Segment([]byte(content))
-	for _, segment := range segments {
-		token := segment.Token().Text()
-		if !engine.stopTokens.IsStopToken(token) {
-			keywords = append(keywords, token)
-		}
+	tokens, _ := engine.analyze(content)
+	for _, token := range tokens {
+		keywords = append(keywords, token.Text)
 	}
 	return
 }
 
+// 用分词器切分文本并过滤停用词，建立索引和搜索都经过这里
+// 第二个返回值为过滤停用词之前的关键词个数
+func (engine *Engine) analyze(text string) (tokens []types.AnalyzedToken, numTokens int) {
+	if engine.analyzer == nil {
+		return
+	}
+	analyzed := engine.analyzer.Analyze(text)
+	for _, token := range analyzed {
+		if !engine.stopTokens.IsStopToken(token.Text) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, len(analyzed)
+}
+
+// 对查询树中的文本叶子节点分词，分出的关键词作为交集替换该节点
+func (engine *Engine) segmentQuery(query types.Query) types.Query {
+	switch query.Operator {
+	case types.QueryTerm:
+		if query.Token != "" || query.Text == "" {
+			return query
+		}
+		keywords := engine.Segment(query.Text)
+		if len(keywords) == 1 {
+			return types.FieldTermQuery(query.Field, keywords[0])
+		}
+		segmented := types.AndQuery()
+		for _, keyword := range keywords {
+			segmented.Children = append(segmented.Children, types.FieldTermQuery(query.Field, keyword))
+		}
+		return segmented
+	}
+	segmented := types.Query{Operator: query.Operator, Slop: query.Slop}
+	for _, child := range query.Children {
+		child = engine.segmentQuery(child)
+		if query.Operator == types.QueryPhrase && child.Operator == types.QueryAnd {
+			// 短语中的文本分词后按顺序展开
+			segmented.Children = append(segmented.Children, child.Children...)
+			continue
+		}
+		segmented.Children = append(segmented.Children, child)
+	}
+	return segmented
+}
+
 // 将文档从索引中删除
 //
 // 输入参数：
 // 	docId	标识文档编号，必须唯一
 //
-// 注意：这个函数仅从排序器中删除文档，索引器不会发生变化。
+// 注意：文档的索引项在索引器中立即失效，内存中的记录在合并索引段时清除，持久存储中的记录和文档信息在同一批次中删除。
+// 同一文档的添加和删除按调用顺序生效。
 func (engine *Engine) RemoveDocument(docId uint64) {
+	if err := engine.Remove(docId); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 将文档从索引中删除，和RemoveDocument相同，但出错时返回错误而不是退出程序
+func (engine *Engine) Remove(docId uint64) error {
 	if !engine.initialized {
-		log.Fatal("必须先初始化引擎")
+		return ErrNotInitialized
 	}
 
+	// 索引器处理完后会转发给排序器，排序器处理完后请求才算完成，文档所在shard的排序器同时从数据库中删除
+	engine.addPendingRequests(engine.initOptions.NumShards)
+	version := atomic.AddUint64(&engine.docRequestVersion, 1)
 	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-		engine.indexerRemoveDocChannels[shard] <- indexerRemoveDocRequest{docId: docId}
-		engine.rankerRemoveDocChannels[shard] <- rankerRemoveDocRequest{docId: docId}
+		engine.beginDocRequest(shard, docId)
 	}
-
-	if engine.initOptions.UsePersistentStorage {
-		// 从数据库中删除
-		shard := int(murmur.Murmur3([]byte(fmt.Sprint("%d", docId)))) % engine.initOptions.NumShards
-		go engine.persistentStorageRemoveDocumentWorker(docId, shard)
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		engine.indexerRemoveDocChannels[shard] <- indexerRemoveDocRequest{docId: docId, version: version}
 	}
+	return nil
 }
 
-// 阻塞等待直到所有索引添加完毕
+// 阻塞等待直到所有索引添加和删除完毕（使用持久存储时还要求已经写入数据库）
 func (engine *Engine) FlushIndex() {
-	for {
-		runtime.Gosched()
-		if engine.numIndexingRequests == engine.numDocumentsIndexed &&
-			(!engine.initOptions.UsePersistentStorage ||
-				engine.numIndexingRequests == engine.numDocumentsStored) {
-			return
-		}
+	if !engine.initialized {
+		return
 	}
+	engine.pendingRequestsLock.Lock()
+	for engine.numPendingRequests > 0 {
+		engine.pendingRequestsCond.Wait()
+	}
+	engine.pendingRequestsLock.Unlock()
 }
 
 // 查找满足搜索条件的文档，此函数线程安全
-func (engine *Engine) Search(request types.SearchRequest) (output types.SearchResponse) {
-	if !engine.initialized {
+// 引擎尚未初始化时退出程序；搜索条件不正确或者某个shard出错时只记录日志，返回其余shard的结果（可能为空），
+// 需要区分这些情况时请使用Query
+func (engine *Engine) Search(request types.SearchRequest) types.SearchResponse {
+	output, err := engine.Query(request)
+	if err == ErrNotInitialized {
 		log.Fatal("必须先初始化引擎")
 	}
+	if err != nil {
+		log.Printf("搜索出错: %v", err)
+	}
+	return output
+}
 
-	// for k, s := range core.DocInfoGroup {
-	// 	log.Printf("DocInfo:%v,%v,%v\n", k, s.NumDocuments, s.DocInfos)
-	// }
-	// for k, s := range core.InvertedIndexGroup {
-	// 	b, _ := json.Marshal(s.InvertedIndex)
-	// 	log.Printf("InvertedIndex:%v,%v,%+v\n", k, s.TotalTokenLength, string(b))
-	// }
+// 查找满足搜索条件的文档，和Search相同，但出错时返回错误
+func (engine *Engine) Query(request types.SearchRequest) (types.SearchResponse, error) {
+	output, err := engine.SearchContext(context.Background(), request)
+	if err == context.DeadlineExceeded {
+		// request.Timeout超时不是错误，仅在output.Timeout中标明
+		err = nil
+	}
+	return output, err
+}
 
-	// for k, s := range core.DocInfoGroup {
-	// 	log.Printf("DocInfo:%v,%v\n", k, s.NumDocuments)
-	// }
-	// for k, s := range core.InvertedIndexGroup {
-	// 	log.Printf("InvertedIndex:%#v,%v\n", k, s.TotalTokenLength)
-	// }
+// 查找满足搜索条件的文档，ctx被取消或者超时（包括request.Timeout）时各shard的查找和排序随即中止，
+// 返回已完成shard的部分结果，output.Timeout为true，同时返回ctx.Err()
+// 某个shard查找出错时返回其余shard的结果和第一个错误
+func (engine *Engine) SearchContext(ctx context.Context, request types.SearchRequest) (output types.SearchResponse, err error) {
+	if !engine.initialized {
+		return output, ErrNotInitialized
+	}
+	if err := core.ValidateFilters(request.Filters); err != nil {
+		return output, err
+	}
+	if err := core.ValidateFacets(request.Facets); err != nil {
+		return output, err
+	}
+	if err := core.ValidateAggregations(request.Aggregations); err != nil {
+		return output, err
+	}
+	var distanceSort *types.DistanceSort
+	if request.RankOptions != nil {
+		distanceSort = request.RankOptions.SortByDistance
+	}
+	if err := core.ValidateGeoFilters(request.GeoFilters, distanceSort); err != nil {
+		return output, err
+	}
+	if request.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(request.Timeout))
+		defer cancel()
+	}
 
 	var rankOptions types.RankOptions
 	if request.RankOptions == nil {
@@ -319,19 +728,51 @@ func (engine *Engine) Search(request types.SearchRequest) (output types.SearchRe
 
 	// 收集关键词
 	tokens := []string{}
-	if request.Text != "" {
-		querySegments := engine.segmenter.Segment([]byte(request.Text))
-		for _, s := range querySegments {
-			token := s.Token().Text()
-			if !engine.stopTokens.IsStopToken(token) {
-				tokens = append(tokens, s.Token().Text())
-			}
-		}
+	var query *types.Query
+	if request.Query != nil {
+		segmentedQuery := engine.segmentQuery(*request.Query)
+		query = &segmentedQuery
+		tokens = append(tokens, query.Tokens()...)
+	} else if request.Text != "" {
+		tokens = append(tokens, engine.Segment(request.Text)...)
 	} else {
 		for _, t := range request.Tokens {
 			tokens = append(tokens, t)
 		}
 	}
+	if request.Query == nil && request.Field != "" {
+		for i, token := range tokens {
+			tokens[i] = types.FieldToken(request.Field, token)
+		}
+	}
+
+	// 短语查询等同于只有一个短语节点的查询树
+	if query == nil && request.Phrase {
+		phrase := types.PhraseQuery(request.PhraseSlop)
+		for _, token := range tokens {
+			phrase.Children = append(phrase.Children, types.TermQuery(token))
+		}
+		query = &phrase
+	}
+
+	// 扩展同义词，没有关键词被扩展时保持原来的查询方式。SearchResponse.Tokens仍为原来的关键词
+	var synonymGroups []int
+	if query != nil {
+		if expanded, groups, ok := engine.expandSynonyms(*query); ok {
+			query, synonymGroups = &expanded, groups
+		}
+	} else if len(tokens) > 0 {
+		root := types.AndQuery()
+		for _, token := range tokens {
+			if request.Field != "" {
+				_, token = types.SplitFieldToken(token)
+			}
+			root.Children = append(root.Children, types.FieldTermQuery(request.Field, token))
+		}
+		if expanded, groups, ok := engine.expandSynonyms(root); ok {
+			query, synonymGroups = &expanded, groups
+		}
+	}
 
 	// 建立排序器返回的通信通道
 	rankerReturnChannel := make(
@@ -339,125 +780,176 @@ func (engine *Engine) Search(request types.SearchRequest) (output types.SearchRe
 
 	// 生成查找请求
 	lookupRequest := indexerLookupRequest{
+		ctx:                 ctx,
 		countDocsOnly:       request.CountDocsOnly,
 		tokens:              tokens,
+		query:               query,
 		labels:              request.Labels,
 		docIds:              request.DocIds,
+		filters:             request.Filters,
+		geoFilters:          request.GeoFilters,
+		facets:              request.Facets,
+		aggregations:        request.Aggregations,
 		options:             rankOptions,
 		rankerReturnChannel: rankerReturnChannel,
 		orderless:           request.Orderless,
+		pruning:             request.Pruning,
 	}
 
 	// 向索引器发送查找请求
+	numRequests := 0
 	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-		engine.indexerLookupChannels[shard] <- lookupRequest
+		select {
+		case engine.indexerLookupChannels[shard] <- lookupRequest:
+			numRequests++
+		case <-ctx.Done():
+		}
 	}
 
-	// 从通信通道读取排序器的输出
+	// 从通信通道读取排序器的输出，直到所有shard返回或者ctx被取消
 	numDocs := 0
-	rankOutput := types.ScoredDocuments{}
-	timeout := request.Timeout
+	shardOutputs := make([]types.ScoredDocuments, engine.initOptions.NumShards)
+	shardFacets := make([][]types.Facet, engine.initOptions.NumShards)
+	shardAggregations := make([][]types.Aggregation, engine.initOptions.NumShards)
+	finishedShards := []int{}
+	numReplies := 0
 	isTimeout := false
-	if timeout <= 0 {
-		// 不设置超时
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			rankerOutput := <-rankerReturnChannel
-			if !request.CountDocsOnly {
-				for _, doc := range rankerOutput.docs {
-					rankOutput = append(rankOutput, doc)
+	for numReplies < numRequests && !isTimeout {
+		select {
+		case rankerOutput := <-rankerReturnChannel:
+			numReplies++
+			if rankerOutput.err != nil {
+				// 出错的shard不计入结果，返回第一个错误
+				if err == nil {
+					err = rankerOutput.err
 				}
+				continue
 			}
-			numDocs += rankerOutput.numDocs
-		}
-	} else {
-		// 设置超时
-		deadline := time.Now().Add(time.Millisecond * time.Duration(request.Timeout))
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			select {
-			case rankerOutput := <-rankerReturnChannel:
-				if !request.CountDocsOnly {
-					for _, doc := range rankerOutput.docs {
-						rankOutput = append(rankOutput, doc)
-					}
-				}
-				numDocs += rankerOutput.numDocs
-			case <-time.After(deadline.Sub(time.Now())):
-				isTimeout = true
-				break
+			if !request.CountDocsOnly {
+				shardOutputs[rankerOutput.shard] = rankerOutput.docs
 			}
+			numDocs += rankerOutput.numDocs
+			shardFacets[rankerOutput.shard] = rankerOutput.facets
+			shardAggregations[rankerOutput.shard] = rankerOutput.aggregations
+			finishedShards = append(finishedShards, rankerOutput.shard)
+		case <-ctx.Done():
+			isTimeout = true
 		}
 	}
-
-	// 再排序
-	if !request.CountDocsOnly && !request.Orderless {
-		if rankOptions.ReverseOrder {
-			sort.Sort(sort.Reverse(rankOutput))
-		} else {
-			sort.Sort(rankOutput)
-		}
+	if len(finishedShards) < engine.initOptions.NumShards && ctx.Err() != nil {
+		isTimeout = true
+		err = ctx.Err()
 	}
+	sort.Ints(finishedShards)
 
 	// 准备输出
 	output.Tokens = tokens
 	// 仅当CountDocsOnly为false时才充填output.Docs
 	if !request.CountDocsOnly {
 		if request.Orderless {
-			// 无序状态无需对Offset截断
+			// 无序状态无需排序和对Offset截断
+			rankOutput := types.ScoredDocuments{}
+			for _, docs := range shardOutputs {
+				rankOutput = append(rankOutput, docs...)
+			}
 			output.Docs = rankOutput
 		} else {
-			var start, end int
-			if rankOptions.MaxOutputs == 0 {
-				start = utils.MinInt(rankOptions.OutputOffset, len(rankOutput))
-				end = len(rankOutput)
-			} else {
-				start = utils.MinInt(rankOptions.OutputOffset, len(rankOutput))
-				end = utils.MinInt(start+rankOptions.MaxOutputs, len(rankOutput))
+			// 各shard的输出已经排好序，多路归并出前OutputOffset+MaxOutputs个
+			limit := 0
+			if rankOptions.MaxOutputs != 0 {
+				limit = rankOptions.OutputOffset + rankOptions.MaxOutputs
 			}
-			output.Docs = rankOutput[start:end]
+			rankOutput := core.MergeScoredDocuments(shardOutputs, rankOptions.ReverseOrder, limit)
+			start := utils.MinInt(rankOptions.OutputOffset, len(rankOutput))
+			output.Docs = rankOutput[start:]
+		}
+		if synonymGroups != nil {
+			collapseSynonymLocations(output.Docs, synonymGroups)
 		}
 	}
 	output.NumDocs = numDocs
+	output.Facets = core.MergeFacets(request.Facets, shardFacets)
+	output.Aggregations = core.MergeAggregations(request.Aggregations, shardAggregations)
 	output.Timeout = isTimeout
+	output.FinishedShards = finishedShards
 	return
 }
 
-// 关闭引擎
+// 关闭引擎，关闭数据库或者写入持久存储出错时退出程序
 func (engine *Engine) Close() {
+	if err := engine.Shutdown(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 关闭引擎，返回关闭数据库或者写入持久存储时遇到的第一个错误
+func (engine *Engine) Shutdown() error {
 	engine.FlushIndex()
-	core.DocInfoGroup = make(map[int]*types.DocInfosShard)
-	core.InvertedIndexGroup = make(map[int]*types.InvertedIndexShard)
 	if engine.initOptions.UsePersistentStorage {
-		for _, db := range engine.dbs {
-			db[0].Close()
-			db[1].Close()
+		engine.syncPersistentStorage()
+		if err := engine.closeDBs(); err != nil {
+			return err
+		}
+		// 数据库已经正常关闭，日志中的记录不需要再重放
+		if err := engine.truncateWALs(); err != nil {
+			return err
+		}
+		if err := engine.closeWALs(); err != nil {
+			return err
 		}
 	}
+	engine.closeIndexers()
+	return engine.PersistentStorageError()
 }
 
+// 清空并关闭持久存储，出错时退出程序
 func (engine *Engine) Clear() {
+	if err := engine.ClearStorage(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 清空并关闭持久存储，返回遇到的第一个错误
+func (engine *Engine) ClearStorage() (err error) {
+	engine.FlushIndex()
 	if engine.initOptions.UsePersistentStorage {
+		// 避免清空后工作协程又写入
+		engine.syncPersistentStorage()
 		for _, db := range engine.dbs {
-
-			db[0].ForEach(func(k, v []byte) error {
-				return db[0].Delete(k)
-			})
-			db[1].ForEach(func(k, v []byte) error {
-				return db[1].Delete(k)
-			})
-			db[0].Close()
-			db[1].Close()
+			for _, d := range db {
+				if d == nil {
+					continue
+				}
+				// 先收集全部键，再在一个批次中删除
+				batch := storage.NewWriteBatch()
+				clearErr := d.ForEach(func(k, v []byte) error {
+					batch.Delete(append([]byte{}, k...))
+					return nil
+				})
+				if clearErr == nil {
+					clearErr = d.Write(batch)
+				}
+				if clearErr != nil && err == nil {
+					err = clearErr
+				}
+			}
+		}
+		if closeErr := engine.closeDBs(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		// 清空预写日志，否则下次启动时会重放已清空的文档
+		if truncateErr := engine.truncateWALs(); truncateErr != nil && err == nil {
+			err = truncateErr
+		}
+		if closeErr := engine.closeWALs(); closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}
+	return
 }
 
-// 获取数据库类别索引
-func getDB(typ string) int {
-	switch typ {
-	case "info":
-		return 0
-	case "index":
-		return 1
-	}
-	log.Fatal("数据库类别不正确")
-	return 0
-}
+// 数据库类别索引
+const (
+	infoDB  = 0
+	indexDB = 1
+)
@@ -1,13 +1,24 @@
 package engine
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
-	"github.com/Jarlene/wukong/core"
+	"errors"
+	"fmt"
+	"github.com/Jarlene/wukong/analyzer"
+	"github.com/Jarlene/wukong/storage"
 	"github.com/Jarlene/wukong/types"
 	"github.com/Jarlene/wukong/utils"
+	"io/ioutil"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type ScoringFields struct {
@@ -56,8 +67,6 @@ func (rule RankByTokenProximity) Score(
 }
 
 func reset() {
-	core.DocInfoGroup = make(map[int]*types.DocInfosShard)
-	core.InvertedIndexGroup = make(map[int]*types.InvertedIndexShard)
 	os.RemoveAll("wukong.persistent")
 }
 
@@ -257,12 +266,30 @@ func TestRemoveDocument(t *testing.T) {
 
 	AddDocs(&engine)
 	engine.RemoveDocument(4)
+	engine.FlushIndex()
 
 	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "1", len(outputs.Docs))
 
 	utils.Expect(t, "0", outputs.Docs[0].DocId)
 	utils.Expect(t, "6000", int(outputs.Docs[0].Scores[0]*1000))
+
+	// 同一文档的添加和删除按调用顺序生效
+	engine.IndexDocument(5, types.DocumentIndexData{Content: "中国人口", Fields: ScoringFields{1, 2, 3}})
+	engine.RemoveDocument(5)
+	engine.IndexDocument(6, types.DocumentIndexData{Content: "中国人口", Fields: ScoringFields{1, 2, 3}})
+	engine.RemoveDocument(6)
+	engine.IndexDocument(6, types.DocumentIndexData{Content: "中国人口", Fields: ScoringFields{1, 2, 3}})
+	engine.FlushIndex()
+
+	outputs = engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "2", len(outputs.Docs))
+	docIds := map[uint64]bool{}
+	for _, doc := range outputs.Docs {
+		docIds[doc.DocId] = true
+	}
+	utils.Expect(t, "false", docIds[5])
+	utils.Expect(t, "true", docIds[6])
 }
 
 func TestEngineIndexDocumentWithTokens(t *testing.T) {
@@ -376,6 +403,60 @@ func TestEngineIndexDocumentWithPersistentStorage(t *testing.T) {
 	utils.Expect(t, "76", int(outputs.Docs[1].Scores[0]*1000))
 	utils.Expect(t, "[0 18]", outputs.Docs[1].TokenSnippetLocations)
 
+	// 被删除的文档不应留在恢复出的反向索引中
+	for shard := range engine1.indexers {
+		for _, suggestion := range engine1.indexers[shard].Suggest("") {
+			indices, _ := engine1.indexers[shard].Postings(suggestion.Text, 0, 0)
+			for _, docId := range indices.DocIds {
+				if docId == 4 {
+					t.Error("删除的文档仍在反向索引中")
+				}
+			}
+		}
+	}
+
+	engine1.Close()
+	os.RemoveAll("wukong.persistent")
+}
+
+func TestIndexAndRemoveInCallOrder(t *testing.T) {
+	reset()
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		SegmenterDictionaries:   "../testdata/test_dict.txt",
+		NumSegmenterThreads:     4,
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+
+	// 不等待之前的请求完成，同一文档的添加和删除交替进行，最后一次调用决定文档是否存在
+	for i := 0; i < 100; i++ {
+		for docId := uint64(0); docId < 10; docId++ {
+			engine.IndexDocument(docId, types.DocumentIndexData{
+				Content: "中国人口", Fields: ScoringFields{float32(i), 0, 0}})
+			if i%2 == 0 || docId%2 == 1 {
+				engine.RemoveDocument(docId)
+			}
+		}
+	}
+	engine.FlushIndex()
+	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "5", len(outputs.Docs))
+	for _, doc := range outputs.Docs {
+		utils.Expect(t, "0", doc.DocId%2)
+	}
+	engine.Close()
+
+	// 数据库中的文档和内存中一致
+	var engine1 Engine
+	engine1.Init(options)
+	outputs = engine1.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "5", len(outputs.Docs))
+	for _, doc := range outputs.Docs {
+		utils.Expect(t, "0", doc.DocId%2)
+	}
 	engine1.Close()
 	os.RemoveAll("wukong.persistent")
 }
@@ -399,6 +480,7 @@ func TestCountDocsOnly(t *testing.T) {
 
 	AddDocs(&engine)
 	engine.RemoveDocument(4)
+	engine.FlushIndex()
 
 	outputs := engine.Search(types.SearchRequest{Text: "中国人口", CountDocsOnly: true})
 	utils.Expect(t, "0", len(outputs.Docs))
@@ -444,3 +526,1212 @@ func TestSearchWithin(t *testing.T) {
 	utils.Expect(t, "100", int(outputs.Docs[1].Scores[0]*1000))
 	utils.Expect(t, "[0 15]", outputs.Docs[1].TokenSnippetLocations)
 }
+
+func TestSearchWithQuery(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+
+	AddDocs(&engine)
+
+	query := types.AndQuery(types.TextQuery("人口"), types.NotQuery(types.TermQuery("中国")))
+	outputs := engine.Search(types.SearchRequest{Query: &query})
+	utils.Expect(t, "[人口]", outputs.Tokens)
+	utils.Expect(t, "2", outputs.NumDocs)
+	utils.Expect(t, "2", len(outputs.Docs))
+
+	query = types.OrQuery(types.TermQuery("有"), types.TermQuery("中国"))
+	outputs = engine.Search(types.SearchRequest{Query: &query})
+	utils.Expect(t, "[有 中国]", outputs.Tokens)
+	utils.Expect(t, "5", outputs.NumDocs)
+
+	query = types.OrQuery(types.TermQuery("有"), types.TermQuery("中国"))
+	outputs = engine.Search(types.SearchRequest{Query: &query, DocIds: map[uint64]bool{1: true, 2: true}})
+	utils.Expect(t, "2", outputs.NumDocs)
+}
+
+func TestSearchWithPruning(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             2,
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.FrequenciesIndex,
+		},
+	})
+	defer engine.Close()
+
+	words := []string{"中国", "人口", "有", "十三亿"}
+	docs := make(map[uint64]types.DocumentIndexData)
+	for docId := uint64(1); docId <= 2000; docId++ {
+		var tokens []types.TokenData
+		for i, word := range words {
+			if docId%uint64(i+2) == 0 {
+				tokens = append(tokens, types.TokenData{word, make([]int, 1+int(docId%uint64(7-i)))})
+			}
+		}
+		docs[docId] = types.DocumentIndexData{Tokens: tokens}
+	}
+	handle, _ := engine.IndexBatch(docs)
+	handle.Wait()
+	engine.FlushIndex()
+
+	// 排序结果和按查询树全部评分的结果相同
+	query := types.OrQuery()
+	for _, word := range words {
+		query.Children = append(query.Children, types.TermQuery(word))
+	}
+	for _, options := range []types.RankOptions{{MaxOutputs: 10}, {OutputOffset: 5, MaxOutputs: 20}} {
+		expected := engine.Search(types.SearchRequest{Query: &query, RankOptions: &options})
+		outputs := engine.Search(types.SearchRequest{Query: &query, Pruning: true, RankOptions: &options})
+		utils.Expect(t, fmt.Sprint(expected.Docs), outputs.Docs)
+		utils.Expect(t, fmt.Sprint(expected.NumDocs), outputs.NumDocs)
+	}
+
+	// 不跳过文档时Pruning被忽略
+	outputs := engine.Search(types.SearchRequest{Query: &query, Pruning: true, CountDocsOnly: true})
+	utils.Expect(t, "1466", outputs.NumDocs)
+
+	// 交集查询不因Pruning变为并集
+	expected := engine.Search(types.SearchRequest{Tokens: words, RankOptions: &types.RankOptions{MaxOutputs: 10}})
+	outputs = engine.Search(types.SearchRequest{Tokens: words, Pruning: true, RankOptions: &types.RankOptions{MaxOutputs: 10}})
+	utils.Expect(t, fmt.Sprint(expected.Docs), outputs.Docs)
+	utils.Expect(t, fmt.Sprint(expected.NumDocs), outputs.NumDocs)
+	utils.Expect(t, "true", outputs.NumDocs < 1466)
+}
+
+func TestTextFields(t *testing.T) {
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType:   types.LocationsIndex,
+			FieldBoosts: map[string]float32{"title": 5},
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+	engine.IndexDocument(1, types.DocumentIndexData{
+		TextFields: map[string]string{"title": "中国人口", "body": "有十三亿"},
+	})
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "中国人口有十三亿"})
+	engine.IndexDocument(3, types.DocumentIndexData{
+		Content:    "有人口",
+		TextFields: map[string]string{"body": "十三亿"},
+	})
+	engine.FlushIndex()
+
+	// 标题的权重较大
+	outputs := engine.Search(types.SearchRequest{Text: "人口"})
+	utils.Expect(t, "3", outputs.NumDocs)
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+
+	// 不限字段的关键词只返回Content中的位置
+	locations := make(map[uint64]string)
+	for _, doc := range outputs.Docs {
+		locations[doc.DocId] = fmt.Sprint(doc.TokenLocations, doc.TokenSnippetLocations)
+	}
+	utils.Expect(t, "map[1:[[]] [-1] 2:[[6]] [6] 3:[[3]] [3]]", locations)
+
+	// 只在一个字段中查找时返回字段中的位置
+	query := types.FieldTextQuery("title", "人口")
+	outputs = engine.Search(types.SearchRequest{Query: &query})
+	utils.Expect(t, "1", outputs.NumDocs)
+	utils.Expect(t, "[[6]]", outputs.Docs[0].TokenLocations)
+	utils.Expect(t, "[6]", outputs.Docs[0].TokenSnippetLocations)
+	outputs = engine.Search(types.SearchRequest{Text: "十三亿", Field: "body"})
+	utils.Expect(t, "2", outputs.NumDocs)
+	outputs = engine.Search(types.SearchRequest{Text: "十三亿", Field: "title"})
+	utils.Expect(t, "0", outputs.NumDocs)
+
+	// 短语不跨越字段
+	outputs = engine.Search(types.SearchRequest{Text: "人口有", Phrase: true})
+	utils.Expect(t, "1", outputs.NumDocs)
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+
+	expected := engine.Search(types.SearchRequest{Text: "中国人口"})
+	engine.Close()
+
+	// 重启后字段的关键词长度从持久存储恢复，评分不变
+	var engine1 Engine
+	engine1.Init(options)
+	outputs = engine1.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, fmt.Sprint(expected.Docs), outputs.Docs)
+	engine1.Close()
+	reset()
+}
+
+func TestSearchWithFilters(t *testing.T) {
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries:   "../testdata/test_dict.txt",
+		NumShards:               2,
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for docId := uint64(0); docId < 10; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content: "中国人口",
+			Attributes: map[string]interface{}{
+				"Timestamp": start.Add(time.Duration(docId) * time.Hour),
+				"Price":     float32(docId) / 2,
+			},
+		})
+	}
+	err := engine.Index(10, types.DocumentIndexData{
+		Content:    "中国人口",
+		Attributes: map[string]interface{}{"Price": "1"},
+	})
+	utils.Expect(t, "true", err != nil)
+	engine.FlushIndex()
+
+	filters := []types.RangeFilter{
+		{Attribute: "Timestamp", Min: start.Add(3 * time.Hour)},
+		{Attribute: "Price", Max: 4, ExclusiveMax: true},
+	}
+	outputs := engine.Search(types.SearchRequest{Text: "中国", Filters: filters})
+	utils.Expect(t, "5", outputs.NumDocs)
+	_, err = engine.Query(types.SearchRequest{Text: "中国", Filters: []types.RangeFilter{{Attribute: "Price", Min: []int{1}}}})
+	utils.Expect(t, "true", err != nil)
+	engine.Close()
+
+	// 重启后数值属性从持久存储恢复
+	var engine1 Engine
+	engine1.Init(options)
+	outputs = engine1.Search(types.SearchRequest{Text: "中国", Filters: filters, CountDocsOnly: true})
+	utils.Expect(t, "5", outputs.NumDocs)
+	engine1.Close()
+	reset()
+}
+
+func TestSearchWithFacets(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             3,
+	})
+	categories := []string{"book", "music", "book", "film", "book", "music", "book"}
+	for i, category := range categories {
+		engine.IndexDocument(uint64(i), types.DocumentIndexData{
+			Content: "中国人口",
+			Labels:  []string{"category:" + category, fmt.Sprintf("year:%d", 2010+i%2)},
+		})
+	}
+	engine.FlushIndex()
+
+	// 各shard的统计结果相加，只返回一页文档时也统计全部满足条件的文档
+	outputs := engine.Search(types.SearchRequest{
+		Text:        "中国",
+		RankOptions: &types.RankOptions{MaxOutputs: 2},
+		Facets:      []types.FacetRequest{{Prefix: "category:", TopN: 2}, {Prefix: "year:"}},
+	})
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "7", outputs.NumDocs)
+	utils.Expect(t, "[{category: [{category:book 4} {category:music 2}]} {year: [{year:2010 4} {year:2011 3}]}]", outputs.Facets)
+
+	outputs = engine.Search(types.SearchRequest{
+		Text:          "中国",
+		Labels:        []string{"year:2011"},
+		CountDocsOnly: true,
+		Facets:        []types.FacetRequest{{Prefix: "category:"}},
+	})
+	utils.Expect(t, "[{category: [{category:music 2} {category:film 1}]}]", outputs.Facets)
+	engine.Close()
+}
+
+func TestSearchWithAggregations(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             3,
+	})
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for docId := uint64(0); docId < 10; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content: "中国人口",
+			Attributes: map[string]interface{}{
+				"Timestamp": start.Add(time.Duration(docId) * 12 * time.Hour),
+				"Reposts":   docId * 3,
+			},
+		})
+	}
+	engine.FlushIndex()
+
+	// 各shard的结果合并后返回，只返回一页文档时也统计全部满足条件的文档
+	outputs := engine.Search(types.SearchRequest{
+		Text:        "中国",
+		RankOptions: &types.RankOptions{MaxOutputs: 1},
+		Aggregations: []types.AggregationRequest{
+			{Attribute: "Reposts", Interval: 10},
+			{Attribute: "Timestamp", DateInterval: 24 * time.Hour},
+		},
+	})
+	utils.Expect(t, "1", len(outputs.Docs))
+	reposts := outputs.Aggregations[0]
+	utils.Expect(t, "10 0 27 135 13.5", fmt.Sprint(reposts.Count, " ", reposts.Min.Int, " ", reposts.Max.Int, " ", reposts.Sum, " ", reposts.Avg))
+	utils.Expect(t, "[{{true 0 0} 4} {{true 0 10} 3} {{true 0 20} 3}]", reposts.Buckets)
+	var days []string
+	for _, bucket := range outputs.Aggregations[1].Buckets {
+		days = append(days, fmt.Sprintf("%s:%d", bucket.Time().Format("01-02"), bucket.NumDocs))
+	}
+	utils.Expect(t, "[01-01:2 01-02:2 01-03:2 01-04:2 01-05:2]", days)
+
+	_, err := engine.Query(types.SearchRequest{
+		Text:         "中国",
+		Aggregations: []types.AggregationRequest{{Attribute: "Reposts", Interval: -1}},
+	})
+	utils.Expect(t, "属性Reposts的聚合桶宽度不正确", err)
+	// Search出错时只记录日志，不退出程序
+	outputs = engine.Search(types.SearchRequest{
+		Text:         "中国",
+		Aggregations: []types.AggregationRequest{{Attribute: "Reposts", Interval: -1}},
+	})
+	utils.Expect(t, "0", len(outputs.Docs))
+	engine.Close()
+}
+
+func TestSearchByDistance(t *testing.T) {
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries:   "../testdata/test_dict.txt",
+		NumShards:               2,
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+	points := []types.GeoPoint{{Lat: 39.9087, Lon: 116.3975}, {Lat: 39.9999, Lon: 116.2755}, {Lat: 31.2304, Lon: 121.4737}, {Lat: 39.9149, Lon: 116.4109}}
+	for i, point := range points {
+		engine.IndexDocument(uint64(i), types.DocumentIndexData{
+			Content:    "中国人口",
+			Attributes: map[string]interface{}{"Location": point, "Rank": i},
+		})
+	}
+	engine.IndexDocument(4, types.DocumentIndexData{Content: "中国人口"})
+	err := engine.Index(5, types.DocumentIndexData{
+		Content:    "中国人口",
+		Attributes: map[string]interface{}{"Location": types.GeoPoint{Lat: 100}},
+	})
+	utils.Expect(t, "true", err != nil)
+	engine.FlushIndex()
+
+	// 按距离从近到远排序，没有坐标的文档排在最后
+	center := points[0]
+	request := types.SearchRequest{
+		Text: "中国",
+		RankOptions: &types.RankOptions{
+			SortByDistance: &types.DistanceSort{Attribute: "Location", Center: center},
+		},
+	}
+	docIds := func(docs []types.ScoredDocument) string {
+		var result []string
+		for _, doc := range docs {
+			result = append(result, fmt.Sprintf("%d:%.0f", doc.DocId, doc.Distance))
+		}
+		return fmt.Sprint(result)
+	}
+	outputs := engine.Search(request)
+	utils.Expect(t, "[0:0 3:1335 1:14525 2:1068140 4:+Inf]", docIds(outputs.Docs))
+
+	request.GeoFilters = []types.GeoFilter{{Attribute: "Location", Center: &center, Radius: 20000}}
+	outputs = engine.Search(request)
+	utils.Expect(t, "[0:0 3:1335 1:14525]", docIds(outputs.Docs))
+	_, err = engine.Query(types.SearchRequest{
+		Text:       "中国",
+		GeoFilters: []types.GeoFilter{{Attribute: "Location", Center: &types.GeoPoint{Lat: -100}, Radius: 1}},
+	})
+	utils.Expect(t, "true", err != nil)
+	engine.Close()
+
+	// 重启后地理坐标属性从持久存储恢复
+	var engine1 Engine
+	engine1.Init(options)
+	outputs = engine1.Search(request)
+	utils.Expect(t, "[0:0 3:1335 1:14525]", docIds(outputs.Docs))
+	value, _ := engine1.indexers[engine1.getShard(3)].Attribute(3, "Rank")
+	utils.Expect(t, "3", value.Int)
+	engine1.Close()
+	reset()
+}
+
+func TestSynonyms(t *testing.T) {
+	reset()
+	synonymFile := "wukong.synonyms.txt"
+	defer os.Remove(synonymFile)
+	ioutil.WriteFile(synonymFile, []byte("中国 十三亿:0.5\n"), 0644)
+	var engine Engine
+	err := engine.Open(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		SynonymFile:           synonymFile,
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	utils.Expect(t, "<nil>", err)
+	engine.IndexDocument(0, types.DocumentIndexData{Content: "中国人口"})
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "人口十三亿"})
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "有人口"})
+	engine.FlushIndex()
+
+	// 关键词扩展为它和同义词的并集，同义词的BM25乘以权重，Tokens和关键词位置仍按原来的关键词排列
+	outputs := engine.Search(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "[中国]", outputs.Tokens)
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "0", outputs.Docs[0].DocId)
+	utils.Expect(t, "[6]", outputs.Docs[1].TokenSnippetLocations)
+	utils.Expect(t, "[[6]]", outputs.Docs[1].TokenLocations)
+	utils.Expect(t, "true", outputs.Docs[0].Scores[0] > outputs.Docs[1].Scores[0])
+
+	outputs = engine.Search(types.SearchRequest{Query: &types.Query{Operator: types.QueryAnd, Children: []types.Query{
+		types.TextQuery("中国"), types.TermQuery("人口")}}})
+	utils.Expect(t, "[中国 人口]", outputs.Tokens)
+	utils.Expect(t, "2", outputs.NumDocs)
+	utils.Expect(t, "[6 0]", outputs.Docs[1].TokenSnippetLocations)
+
+	// 重新读入后使用新的权重，格式不正确时保留原来的同义词
+	ioutil.WriteFile(synonymFile, []byte("中国 十三亿:2\n"), 0644)
+	utils.Expect(t, "<nil>", engine.ReloadSynonyms())
+	outputs = engine.Search(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+	ioutil.WriteFile(synonymFile, []byte("中国 十三亿:0\n"), 0644)
+	utils.Expect(t, "同义词文件wukong.synonyms.txt第1行的权重不正确: 十三亿:0", engine.ReloadSynonyms())
+	outputs = engine.Search(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+
+	// 冒号后不是数时属于同义词本身，标签也可以有同义词
+	engine.IndexDocument(3, types.DocumentIndexData{Labels: []string{"category:mobile"}})
+	engine.FlushIndex()
+	ioutil.WriteFile(synonymFile, []byte("=category:phone =category:mobile\n=category:cell =category:mobile:2\n"), 0644)
+	utils.Expect(t, "<nil>", engine.ReloadSynonyms())
+	for _, label := range []string{"category:phone", "category:cell"} {
+		outputs = engine.Search(types.SearchRequest{Query: &types.Query{Operator: types.QueryTerm, Token: label}})
+		utils.Expect(t, "1", len(outputs.Docs))
+		utils.Expect(t, "3", outputs.Docs[0].DocId)
+	}
+
+	// 同义词用分词器切分，分出多个关键词时作为短语扩展；关键词必须切分为一个关键词
+	ioutil.WriteFile(synonymFile, []byte("十三亿 中国人口\n"), 0644)
+	utils.Expect(t, "<nil>", engine.ReloadSynonyms())
+	outputs = engine.Search(types.SearchRequest{Text: "十三亿"})
+	utils.Expect(t, "[十三亿]", outputs.Tokens)
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "0", outputs.Docs[0].DocId)
+	utils.Expect(t, "[0]", outputs.Docs[0].TokenSnippetLocations)
+	utils.Expect(t, "1", outputs.Docs[1].DocId)
+	utils.Expect(t, "[6]", outputs.Docs[1].TokenSnippetLocations)
+	ioutil.WriteFile(synonymFile, []byte("中国人口 十三亿\n"), 0644)
+	utils.Expect(t, "同义词文件wukong.synonyms.txt第1行的关键词分词后不是一个关键词: 中国人口", engine.ReloadSynonyms())
+
+	// 短语中的关键词不扩展
+	ioutil.WriteFile(synonymFile, []byte("中国 十三亿\n"), 0644)
+	utils.Expect(t, "<nil>", engine.ReloadSynonyms())
+	outputs = engine.Search(types.SearchRequest{Text: "中国", Phrase: true})
+	utils.Expect(t, "1", outputs.NumDocs)
+	engine.Close()
+}
+
+func TestSearchPhrase(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+
+	AddDocs(&engine)
+
+	outputs := engine.Search(types.SearchRequest{Text: "中国人口", Phrase: true})
+	utils.Expect(t, "[中国 人口]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+
+	// 间隔按关键词个数计算："中国十三亿人口"中间隔一个关键词，"中国有十三亿人口人口"中间隔两个
+	outputs = engine.Search(types.SearchRequest{Text: "中国人口", Phrase: true, PhraseSlop: 1})
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+	utils.Expect(t, "4", outputs.Docs[1].DocId)
+
+	outputs = engine.Search(types.SearchRequest{Text: "中国人口", Phrase: true, PhraseSlop: 2})
+	utils.Expect(t, "3", len(outputs.Docs))
+
+	query := types.AndQuery(types.PhraseQuery(0, types.TextQuery("十三亿人口")), types.NotQuery(types.TermQuery("有")))
+	outputs = engine.Search(types.SearchRequest{Query: &query})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "4", outputs.Docs[0].DocId)
+}
+
+func TestUpdateDocumentWithPersistentStorage(t *testing.T) {
+	reset()
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+	AddDocs(&engine)
+	engine.IndexDocument(1, types.DocumentIndexData{
+		Content: "有十三亿人口",
+		Fields:  ScoringFields{1, 2, 3},
+	})
+	engine.FlushIndex()
+
+	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "4", outputs.Docs[0].DocId)
+	utils.Expect(t, "0", outputs.Docs[1].DocId)
+	engine.Close()
+
+	var engine1 Engine
+	engine1.Init(options)
+	outputs = engine1.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "2", len(outputs.Docs))
+	outputs = engine1.Search(types.SearchRequest{Text: "十三亿"})
+	utils.Expect(t, "4", outputs.NumDocs)
+	// 关键词序号也写入了持久存储
+	outputs = engine1.Search(types.SearchRequest{Text: "中国人口", Phrase: true, PhraseSlop: 1})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "4", outputs.Docs[0].DocId)
+	engine1.Close()
+	os.RemoveAll("wukong.persistent")
+}
+
+func TestSearchWithBigramAnalyzer(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Analyzer: analyzer.BigramAnalyzer{},
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+
+	AddDocs(&engine)
+
+	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "[中国 国人 人口]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+	utils.Expect(t, "[0 3 6]", outputs.Docs[0].TokenSnippetLocations)
+
+	outputs = engine.Search(types.SearchRequest{Text: "亿人", Phrase: true})
+	utils.Expect(t, "3", len(outputs.Docs))
+	// 相邻的二元组首字节相隔一个字，按关键词序号仍然相邻
+	outputs = engine.Search(types.SearchRequest{Text: "中国人口", Phrase: true})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+	utils.Expect(t, "[亿人 人口]", engine.Segment("亿人口"))
+}
+
+func TestMultipleEngines(t *testing.T) {
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	}
+	var engine1, engine2 Engine
+	engine1.Init(options)
+	engine2.Init(options)
+
+	AddDocs(&engine1)
+	engine2.IndexDocument(0, types.DocumentIndexData{Content: "中国"})
+	engine2.FlushIndex()
+
+	outputs := engine1.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "3", len(outputs.Docs))
+	outputs = engine2.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "0", len(outputs.Docs))
+	outputs = engine2.Search(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "1", len(outputs.Docs))
+
+	// 关闭一个引擎不影响另一个
+	engine2.Close()
+	outputs = engine1.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "3", len(outputs.Docs))
+	engine1.Close()
+}
+
+func TestOpenErrors(t *testing.T) {
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+	}
+
+	// 未初始化
+	var engine Engine
+	utils.Expect(t, "true", engine.Index(0, types.DocumentIndexData{Content: "中国"}) == ErrNotInitialized)
+	_, err := engine.Query(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "true", err == ErrNotInitialized)
+
+	// 词典文件或者停用词文件不存在
+	badOptions := options
+	badOptions.SegmenterDictionaries = "../testdata/no_such_dict.txt"
+	utils.Expect(t, "true", engine.Open(badOptions) != nil)
+	badOptions = options
+	badOptions.StopTokenFile = "../testdata/no_such_stop_tokens.txt"
+	utils.Expect(t, "true", engine.Open(badOptions) != nil)
+
+	// 持久存储目录是一个普通文件
+	file, _ := os.Create("wukong.persistent")
+	file.Close()
+	badOptions = options
+	badOptions.UsePersistentStorage = true
+	badOptions.PersistentStorageFolder = "wukong.persistent"
+	numGoroutines := runtime.NumGoroutine()
+	utils.Expect(t, "true", engine.Open(badOptions) != nil)
+	reset()
+
+	// 已经打开的索引器随之关闭，后台合并协程不会泄漏
+	for i := 0; i < 100 && runtime.NumGoroutine() > numGoroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utils.Expect(t, "true", runtime.NumGoroutine() <= numGoroutines)
+
+	// 出错后仍可以重新初始化，但不能初始化两次
+	utils.Expect(t, "<nil>", engine.Open(options))
+	utils.Expect(t, "true", engine.Open(options) == ErrAlreadyInitialized)
+	utils.Expect(t, "<nil>", engine.Index(0, types.DocumentIndexData{Content: "中国"}))
+	engine.FlushIndex()
+	output, err := engine.Query(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "1", len(output.Docs))
+	utils.Expect(t, "<nil>", engine.Shutdown())
+}
+
+func TestSearchContext(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             4,
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	AddDocs(&engine)
+
+	// 所有shard都完成
+	outputs, err := engine.SearchContext(context.Background(), types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "false", outputs.Timeout)
+	utils.Expect(t, "[0 1 2 3]", outputs.FinishedShards)
+	utils.Expect(t, "3", len(outputs.Docs))
+
+	// 已取消的ctx不返回任何shard的结果
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	outputs, err = engine.SearchContext(ctx, types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "true", err == context.Canceled)
+	utils.Expect(t, "true", outputs.Timeout)
+	utils.Expect(t, "[]", outputs.FinishedShards)
+	utils.Expect(t, "0", len(outputs.Docs))
+
+	// 取消的搜索不影响之后的搜索
+	outputs = engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "false", outputs.Timeout)
+	utils.Expect(t, "3", len(outputs.Docs))
+
+	// 查找出错的shard也要返回，否则收集结果时会一直等待
+	rankerReturnChannel := make(chan rankerReturnRequest, 1)
+	engine.indexerLookupChannels[0] <- indexerLookupRequest{
+		ctx:                 context.Background(),
+		tokens:              []string{"中国"},
+		filters:             []types.RangeFilter{{Attribute: "price", Min: "x"}},
+		rankerReturnChannel: rankerReturnChannel,
+	}
+	select {
+	case output := <-rankerReturnChannel:
+		utils.Expect(t, "true", output.err != nil)
+	case <-time.After(time.Second):
+		t.Error("查找出错时没有返回")
+	}
+	engine.Close()
+}
+
+func TestIndexAsync(t *testing.T) {
+	reset()
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	})
+
+	// 句柄完成后文档可以被搜索到，无需FlushIndex
+	handle, err := engine.IndexAsync(0, types.DocumentIndexData{Content: "中国有十三亿人口"})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "<nil>", handle.Wait())
+	outputs := engine.Search(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "1", len(outputs.Docs))
+
+	handle, _ = engine.IndexBatch(map[uint64]types.DocumentIndexData{
+		1: {Content: "中国人口"},
+		2: {Content: "有人口"},
+	})
+	<-handle.Done()
+	utils.Expect(t, "<nil>", handle.Err())
+	outputs = engine.Search(types.SearchRequest{Text: "人口"})
+	utils.Expect(t, "3", len(outputs.Docs))
+
+	// 空的批次立即完成
+	handle, _ = engine.IndexBatch(nil)
+	utils.Expect(t, "<nil>", handle.Wait())
+
+	engine.Close()
+	reset()
+}
+
+// 所有写入都失败的存储
+type failingStorage struct{}
+
+func (s failingStorage) Set(k, v []byte) error                                     { return errors.New("写入失败") }
+func (s failingStorage) Get(k []byte) ([]byte, error)                              { return nil, errors.New("读取失败") }
+func (s failingStorage) Delete(k []byte) error                                     { return errors.New("删除失败") }
+func (s failingStorage) ForEach(fn func(k, v []byte) error) error                  { return nil }
+func (s failingStorage) Write(batch *storage.WriteBatch) error                     { return errors.New("写入失败") }
+func (s failingStorage) Range(start, end []byte, fn func(k, v []byte) error) error { return nil }
+func (s failingStorage) Seek(k []byte, fn func(k, v []byte) error) error           { return nil }
+func (s failingStorage) Prefix(prefix []byte, fn func(k, v []byte) error) error    { return nil }
+func (s failingStorage) Close() error                                              { return nil }
+func (s failingStorage) WALName() string                                           { return "" }
+
+func TestIndexAsyncWithStorageErrors(t *testing.T) {
+	reset()
+	storage.RegisterStorageEngine("failing", func(path string) (storage.Storage, error) {
+		return failingStorage{}, nil
+	})
+	os.Setenv("WUKONG_STORAGE_ENGINE", "failing")
+	defer os.Unsetenv("WUKONG_STORAGE_ENGINE")
+
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries:   "../testdata/test_dict.txt",
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	})
+
+	handle, _ := engine.IndexAsync(0, types.DocumentIndexData{Content: "中国人口"})
+	utils.Expect(t, "写入失败", handle.Wait())
+	utils.Expect(t, "写入失败", engine.PersistentStorageError())
+
+	// 写入失败不影响搜索
+	outputs := engine.Search(types.SearchRequest{Text: "中国"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "写入失败", engine.Shutdown())
+	reset()
+}
+
+func TestWriteAheadLogRecovery(t *testing.T) {
+	reset()
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+	AddDocs(&engine)
+	engine.Close()
+
+	// 模拟进程在写入预写日志之后、修改数据库之前崩溃：加入文档5，删除文档1，
+	// 并在文档5的日志末尾留下一条不完整的记录
+	walPath := func(docId uint64) string {
+		return "wukong.persistent/wukong.wal." + strconv.Itoa(engine.getShard(docId))
+	}
+	wal, _ := openWriteAheadLog(walPath(1))
+	wal.append(nil, &walRecord{Op: walRemove, DocId: 1})
+	wal.close()
+	wal, _ = openWriteAheadLog(walPath(5))
+	wal.append(nil, &walRecord{
+		Op:          walIndex,
+		DocId:       5,
+		TokenLength: 2,
+		Keywords: []types.KeywordIndex{
+			{"中国", 1, []int{0}},
+			{"人口", 1, []int{6}},
+		},
+		fields: ScoringFields{1, 1, 1},
+	})
+	wal.file.Write([]byte{100, 0, 0, 0, 1, 2})
+	wal.close()
+
+	// 重启后恢复出已确认的操作，并清空日志
+	for i := 0; i < 2; i++ {
+		var engine1 Engine
+		engine1.Init(options)
+		outputs := engine1.Search(types.SearchRequest{Text: "中国人口"})
+		utils.Expect(t, "3", len(outputs.Docs))
+		utils.Expect(t, "5", outputs.Docs[0].DocId)
+		utils.Expect(t, "4", outputs.Docs[1].DocId)
+		utils.Expect(t, "0", outputs.Docs[2].DocId)
+		engine1.syncPersistentStorage()
+		for _, wal := range engine1.wals {
+			utils.Expect(t, "0", wal.size)
+		}
+		engine1.Close()
+	}
+	reset()
+}
+
+// 设置crashed后所有批次写入都失败的存储，模拟进程在写入预写日志之后、修改数据库之前崩溃
+type crashingStorage struct {
+	storage.Storage
+}
+
+var crashed int32
+
+func (s crashingStorage) Write(batch *storage.WriteBatch) error {
+	if atomic.LoadInt32(&crashed) != 0 {
+		return errors.New("崩溃")
+	}
+	return s.Storage.Write(batch)
+}
+
+func TestReindexCrashBeforeCommit(t *testing.T) {
+	reset()
+	storage.RegisterStorageEngine("crashing", func(path string) (storage.Storage, error) {
+		s, err := storage.OpenLeveldbStorage(path)
+		return crashingStorage{s}, err
+	})
+	os.Setenv("WUKONG_STORAGE_ENGINE", "crashing")
+	defer os.Unsetenv("WUKONG_STORAGE_ENGINE")
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             1,
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	tokens := func(texts ...string) types.DocumentIndexData {
+		var data types.DocumentIndexData
+		for i, text := range texts {
+			data.Tokens = append(data.Tokens, types.TokenData{Text: text, Locations: []int{i}})
+		}
+		return data
+	}
+	search := func(engine *Engine, token string) string {
+		var docIds []uint64
+		for _, doc := range engine.Search(types.SearchRequest{Tokens: []string{token}}).Docs {
+			docIds = append(docIds, doc.DocId)
+		}
+		sort.Slice(docIds, func(i, j int) bool { return docIds[i] < docIds[j] })
+		return fmt.Sprint(docIds)
+	}
+	// 等待工作协程处理完已经收到的请求后关闭数据库，不清空预写日志
+	crash := func(engine *Engine) {
+		engine.syncPersistentStorage()
+		engine.closeDBs()
+		engine.closeWALs()
+		atomic.StoreInt32(&crashed, 0)
+	}
+
+	var engine Engine
+	engine.Init(options)
+	handle, _ := engine.IndexAsync(1, tokens("a"))
+	utils.Expect(t, "<nil>", handle.Wait())
+
+	// 文档1在索引器中已被重新索引、尚未写入预写日志时，写入其它文档不会带上文档1的新索引项
+	engine.indexers[0].AddDocument(&types.DocumentIndex{
+		DocId: 1, TokenLength: 1, Keywords: []types.KeywordIndex{{"b", 1, []int{0}}},
+	}, make(chan bool))
+	handle, _ = engine.IndexAsync(2, tokens("b"))
+	utils.Expect(t, "<nil>", handle.Wait())
+	crash(&engine)
+
+	var engine1 Engine
+	engine1.Init(options)
+	utils.Expect(t, "[1]", search(&engine1, "a"))
+	utils.Expect(t, "[2]", search(&engine1, "b"))
+
+	// 重新索引文档1：写入预写日志之后、修改数据库之前崩溃
+	atomic.StoreInt32(&crashed, 1)
+	handle, _ = engine1.IndexAsync(1, tokens("b", "c"))
+	utils.Expect(t, "崩溃", handle.Wait())
+	crash(&engine1)
+
+	// 重放日志后数据库中只有新的索引项
+	for i := 0; i < 2; i++ {
+		var engine2 Engine
+		engine2.Init(options)
+		utils.Expect(t, "[]", search(&engine2, "a"))
+		utils.Expect(t, "[1 2]", search(&engine2, "b"))
+		utils.Expect(t, "[1]", search(&engine2, "c"))
+		utils.Expect(t, "<nil>", engine2.Shutdown())
+	}
+	reset()
+}
+
+func TestClearWithWriteAheadLog(t *testing.T) {
+	reset()
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+
+	// 正常关闭后预写日志为空
+	var engine Engine
+	engine.Init(options)
+	AddDocs(&engine)
+	engine.Close()
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		info, err := os.Stat("wukong.persistent/wukong.wal." + strconv.Itoa(shard))
+		utils.Expect(t, "<nil>", err)
+		utils.Expect(t, "0", info.Size())
+	}
+
+	// 清空后重启不应重放日志中的文档
+	var engine1 Engine
+	engine1.Init(options)
+	AddDocs(&engine1)
+	engine1.wals[engine1.getShard(5)].append(nil, &walRecord{
+		Op:          walIndex,
+		DocId:       5,
+		TokenLength: 2,
+		Keywords: []types.KeywordIndex{
+			{"中国", 1, []int{0}},
+			{"人口", 1, []int{6}},
+		},
+		fields: ScoringFields{1, 1, 1},
+	})
+	utils.Expect(t, "<nil>", engine1.ClearStorage())
+
+	var engine2 Engine
+	engine2.Init(options)
+	outputs := engine2.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "0", len(outputs.Docs))
+	engine2.Close()
+	reset()
+}
+
+func TestPostingBlocks(t *testing.T) {
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             2,
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	var engine Engine
+	engine.Init(options)
+	docs := make(map[uint64]types.DocumentIndexData)
+	for docId := uint64(1); docId <= 600; docId++ {
+		docs[docId] = types.DocumentIndexData{Content: "中国人口"}
+	}
+	handle, _ := engine.IndexBatch(docs)
+	handle.Wait()
+	engine.Remove(300)
+	engine.FlushIndex()
+
+	// 热门关键词的反向索引被切分为多个块
+	for shard := 0; shard < options.NumShards; shard++ {
+		utils.Expect(t, "true", len(engine.postingBlocks[shard]["中国"]) > 1)
+	}
+	engine.Close()
+
+	// 将块改写为旧版本的整行，重启时应能读入并重新切分
+	for shard := 0; shard < options.NumShards; shard++ {
+		db, _ := storage.OpenStorage("wukong.persistent/wukong.index." + strconv.Itoa(shard))
+		lists := make(map[string]*postingBlockList)
+		var keys [][]byte
+		db.ForEach(func(k, v []byte) error {
+			keyword, lowerBound, _ := parsePostingBlockKey(k)
+			block, _, _ := decodeKeywordIndices(v)
+			if lists[keyword] == nil {
+				lists[keyword] = new(postingBlockList)
+			}
+			lists[keyword].lowerBounds = append(lists[keyword].lowerBounds, lowerBound)
+			lists[keyword].blocks = append(lists[keyword].blocks, block)
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		for _, key := range keys {
+			db.Delete(key)
+		}
+		for keyword, list := range lists {
+			var buf bytes.Buffer
+			gob.NewEncoder(&buf).Encode(list.assemble())
+			db.Set([]byte(keyword), buf.Bytes())
+		}
+		db.Close()
+	}
+
+	for i := 0; i < 2; i++ {
+		var engine1 Engine
+		engine1.Init(options)
+		outputs := engine1.Search(types.SearchRequest{Text: "中国人口", CountDocsOnly: true})
+		utils.Expect(t, "599", outputs.NumDocs)
+		for shard := 0; shard < options.NumShards; shard++ {
+			utils.Expect(t, "true", len(engine1.postingBlocks[shard]["中国"]) > 1)
+			engine1.dbs[shard][indexDB].ForEach(func(k, v []byte) error {
+				if _, _, isBlock := parsePostingBlockKey(k); !isBlock {
+					t.Error("旧版本的整行未被删除")
+				}
+				return nil
+			})
+		}
+		engine1.Close()
+	}
+	reset()
+}
+
+func TestSuggest(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             2,
+	})
+	AddDocs(&engine)
+	utils.Expect(t, "[{人口 5} {中国 3} {十三亿 3} {有 3}]", engine.Suggest("", 0))
+	utils.Expect(t, "[{人口 5} {中国 3}]", engine.Suggest("", 2))
+	utils.Expect(t, "[{中国 3}]", engine.Suggest("中", 10))
+	utils.Expect(t, "[]", engine.Suggest("美国", 10))
+
+	engine.RemoveDocument(0)
+	engine.FlushIndex()
+	utils.Expect(t, "[{人口 4} {中国 2} {十三亿 2} {有 2}]", engine.Suggest("", 0))
+	engine.IndexDocument(5, types.DocumentIndexData{Content: "有人口"})
+	engine.FlushIndex()
+	utils.Expect(t, "[{人口 5} {有 3} {中国 2} {十三亿 2}]", engine.Suggest("", 0))
+	engine.Close()
+
+	// 从持久存储恢复后词典不变
+	reset()
+	options := types.EngineInitOptions{
+		SegmenterDictionaries:   "../testdata/test_dict.txt",
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+	}
+	engine1 := Engine{}
+	engine1.Init(options)
+	engine1.IndexDocument(0, types.DocumentIndexData{Content: "中国人口"})
+	engine1.IndexDocument(1, types.DocumentIndexData{Content: "有人口"})
+	engine1.Close()
+	engine2 := Engine{}
+	engine2.Init(options)
+	utils.Expect(t, "[{人口 2} {中国 1} {有 1}]", engine2.Suggest("", 0))
+	engine2.Close()
+	reset()
+}
+
+// 不在gob中注册的评分字段
+type unregisteredFields struct {
+	Rank  int
+	Flags []bool
+}
+
+func TestCodec(t *testing.T) {
+	fieldsType := reflect.TypeOf(unregisteredFields{})
+	data, err := encodeDocInfo(&types.DocInfo{Fields: unregisteredFields{3, []bool{true}}, TokenLengths: 7}, fieldsType)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "[0 4]", data[0:2])
+	docInfo, legacy, err := decodeDocInfo(data, fieldsType)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "false", legacy)
+	utils.Expect(t, "&{{3 [true]} 7 map[] map[] map[]}", docInfo)
+	_, _, err = decodeDocInfo(data, nil)
+	utils.Expect(t, "true", err != nil)
+	_, err = encodeDocInfo(&types.DocInfo{Fields: unregisteredFields{}}, nil)
+	utils.Expect(t, "true", err != nil)
+
+	data, _ = encodeDocInfo(&types.DocInfo{TokenLengths: 2}, nil)
+	docInfo, _, _ = decodeDocInfo(data, nil)
+	utils.Expect(t, "&{<nil> 2 map[] map[] map[]}", docInfo)
+
+	// 具名字段的关键词长度
+	data, _ = encodeDocInfo(&types.DocInfo{TokenLengths: 5, FieldTokenLengths: map[string]float32{"title": 2, "body": 3}}, nil)
+	docInfo, _, err = decodeDocInfo(data, nil)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "&{<nil> 5 map[body:3 title:2] map[] map[]}", docInfo)
+	_, _, err = decodeDocInfo(data[:len(data)-4], nil)
+	utils.Expect(t, "true", err != nil)
+
+	// 版本1的文档信息没有具名字段，读出后需要改写
+	docInfo, legacy, err = decodeDocInfo([]byte{0, 1, 0, 0, 0x80, 0x3f, fieldsNil}, nil)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "true", legacy)
+	utils.Expect(t, "&{<nil> 1 map[] map[] map[]}", docInfo)
+
+	// 数值属性
+	data, _ = encodeDocInfo(&types.DocInfo{Attributes: map[string]types.AttributeValue{
+		"Price": {IsFloat: true, Float: 9.5}, "Timestamp": {Int: -3},
+	}}, nil)
+	docInfo, legacy, err = decodeDocInfo(data, nil)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "false", legacy)
+	utils.Expect(t, "map[Price:{true 0 9.5} Timestamp:{false -3 0}]", docInfo.Attributes)
+	_, _, err = decodeDocInfo(data[:len(data)-2], nil)
+	utils.Expect(t, "true", err != nil)
+
+	// 地理坐标属性，版本3的文档信息没有这一部分
+	data, _ = encodeDocInfo(&types.DocInfo{GeoPoints: map[string]types.GeoPoint{"Location": {39.9, 116.4}}}, nil)
+	docInfo, _, err = decodeDocInfo(data, nil)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "map[Location:{39.9 116.4}]", docInfo.GeoPoints)
+	_, _, err = decodeDocInfo(data[:len(data)-2], nil)
+	utils.Expect(t, "true", err != nil)
+	docInfo, legacy, err = decodeDocInfo([]byte{0, 3, 0, 0, 0x80, 0x3f, 0, 0, fieldsNil}, nil)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "true", legacy)
+	utils.Expect(t, "&{<nil> 1 map[] map[] map[]}", docInfo)
+
+	indices := &types.KeywordIndices{
+		DocIds:      []uint64{3, 200, 1 << 40},
+		Frequencies: []float32{1, 0.5, 2},
+		Locations:   [][]int{{0}, {1}, {30, 6, 900}},
+		Positions:   [][]int{{0}, {1}, {5, 1, 90}},
+	}
+	data = encodeKeywordIndices(indices)
+	decoded, legacy, err := decodeKeywordIndices(data)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "false", legacy)
+	utils.Expect(t, "true", reflect.DeepEqual(indices, decoded))
+	decoded, _, _ = decodeKeywordIndices(encodeKeywordIndices(&types.KeywordIndices{DocIds: []uint64{1, 2}}))
+	utils.Expect(t, "&{[1 2] [] [] []}", decoded)
+	// 没有序号列表的旧数据
+	withoutPositions := *indices
+	withoutPositions.Positions = nil
+	decoded, _, err = decodeKeywordIndices(encodeKeywordIndices(&withoutPositions))
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "[[0] [1] [30 6 900]] 3 true", fmt.Sprint(decoded.Locations, len(decoded.Positions), decoded.Positions[2] == nil))
+	_, _, err = decodeKeywordIndices(data[:len(data)-1])
+	utils.Expect(t, "true", err != nil)
+	data[1] = codecVersion + 1
+	_, _, err = decodeKeywordIndices(data)
+	utils.Expect(t, "true", err != nil)
+
+	// 旧版本的gob编码
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(&withoutPositions)
+	decoded, legacy, err = decodeKeywordIndices(buf.Bytes())
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "true", legacy)
+	withoutPositions.Positions = make([][]int, 3)
+	utils.Expect(t, "true", reflect.DeepEqual(&withoutPositions, decoded))
+}
+
+func TestCodecMigration(t *testing.T) {
+	reset()
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		SegmenterDictionaries:   "../testdata/test_dict.txt",
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.persistent",
+		NumShards:               2,
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	}
+	var engine Engine
+	engine.Init(options)
+	AddDocs(&engine)
+	request := types.SearchRequest{Text: "中国人口"}
+	expected := engine.Search(request).Docs
+	engine.Close()
+
+	// 将数据库中的值改写为旧版本的gob编码
+	for shard := 0; shard < options.NumShards; shard++ {
+		for _, name := range []string{"info", "index"} {
+			db, _ := storage.OpenStorage("wukong.persistent/wukong." + name + "." + strconv.Itoa(shard))
+			batch := storage.NewWriteBatch()
+			db.ForEach(func(k, v []byte) error {
+				var value interface{}
+				if name == "info" {
+					value, _, _ = decodeDocInfo(v, nil)
+				} else {
+					value, _, _ = decodeKeywordIndices(v)
+				}
+				var buf bytes.Buffer
+				gob.NewEncoder(&buf).Encode(value)
+				batch.Set(append([]byte{}, k...), buf.Bytes())
+				return nil
+			})
+			db.Write(batch)
+			db.Close()
+		}
+	}
+
+	// 重启时读入旧格式并改写，评分字段使用ScoringFieldsType编码
+	options.ScoringFieldsType = ScoringFields{}
+	for i := 0; i < 2; i++ {
+		var engine1 Engine
+		engine1.Init(options)
+		utils.Expect(t, "true", reflect.DeepEqual(expected, engine1.Search(request).Docs))
+		for shard := 0; shard < options.NumShards; shard++ {
+			for _, db := range engine1.dbs[shard] {
+				db.ForEach(func(k, v []byte) error {
+					if v[0] != codecMagic {
+						t.Error("旧格式的值未被改写")
+					}
+					return nil
+				})
+			}
+		}
+		utils.Expect(t, "<nil>", engine1.Shutdown())
+	}
+	reset()
+}
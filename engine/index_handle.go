@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 索引请求的完成句柄，由IndexAsync和IndexBatch返回
+//
+// 句柄中所有文档都可以被搜索到（使用持久存储时还要求已经写入数据库）后句柄完成，
+// 完成后Err返回处理这些文档时遇到的第一个错误
+type IndexHandle struct {
+	// 尚未完成的文档数
+	numPending int32
+	done       chan struct{}
+
+	err     error
+	errLock sync.Mutex
+}
+
+func newIndexHandle(numDocs int) *IndexHandle {
+	handle := &IndexHandle{
+		numPending: int32(numDocs),
+		done:       make(chan struct{}),
+	}
+	if numDocs == 0 {
+		close(handle.done)
+	}
+	return handle
+}
+
+// 返回一个在句柄完成时关闭的通道，可以在select中使用
+func (handle *IndexHandle) Done() <-chan struct{} {
+	return handle.done
+}
+
+// 阻塞等待直到句柄完成，返回第一个错误
+func (handle *IndexHandle) Wait() error {
+	<-handle.done
+	return handle.Err()
+}
+
+// 返回目前为止遇到的第一个错误
+func (handle *IndexHandle) Err() error {
+	handle.errLock.Lock()
+	defer handle.errLock.Unlock()
+	return handle.err
+}
+
+// 一个文档处理完毕
+func (handle *IndexHandle) finishDoc(err error) {
+	if err != nil {
+		handle.errLock.Lock()
+		if handle.err == nil {
+			handle.err = err
+		}
+		handle.errLock.Unlock()
+	}
+	if atomic.AddInt32(&handle.numPending, -1) == 0 {
+		close(handle.done)
+	}
+}
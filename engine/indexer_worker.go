@@ -1,43 +1,52 @@
 package engine
 
 import (
+	"context"
 	"github.com/Jarlene/wukong/types"
 	"sync/atomic"
 )
 
 type indexerAddDocumentRequest struct {
+	version         uint64
 	document        *types.DocumentIndex
 	dealDocInfoChan chan<- bool
+	// 索引器将修改的搜索键交给排序器，其反向索引和文档信息一起写入持久存储
+	addInvertedIndexChan chan<- map[string]bool
 }
 
 type indexerLookupRequest struct {
+	ctx                 context.Context
 	countDocsOnly       bool
 	tokens              []string
+	query               *types.Query
 	labels              []string
 	docIds              map[uint64]bool
+	filters             []types.RangeFilter
+	geoFilters          []types.GeoFilter
+	facets              []types.FacetRequest
+	aggregations        []types.AggregationRequest
 	options             types.RankOptions
 	rankerReturnChannel chan rankerReturnRequest
 	orderless           bool
+	pruning             bool
 }
 
 type indexerRemoveDocRequest struct {
-	docId uint64
+	docId   uint64
+	version uint64
 }
 
 func (engine *Engine) indexerAddDocumentWorker(shard int) {
 	for {
 		request := <-engine.indexerAddDocumentChannels[shard]
-		addInvertedIndex := engine.indexers[shard].AddDocument(request.document, request.dealDocInfoChan)
-		// save
-		if engine.initOptions.UsePersistentStorage {
-			for k, v := range addInvertedIndex {
-				engine.persistentStorageIndexDocumentChannels[shard] <- persistentStorageIndexDocumentRequest{
-					typ:            "index",
-					keyword:        k,
-					keywordIndices: v,
-				}
-			}
+		var addInvertedIndex map[string]bool
+		if !engine.applyDocRequest(shard, request.document.DocId, request.version, func() {
+			addInvertedIndex = engine.indexers[shard].AddDocument(request.document, request.dealDocInfoChan)
+		}) {
+			// 已被之后的请求取代
+			close(request.dealDocInfoChan)
 		}
+		request.addInvertedIndexChan <- addInvertedIndex
 
 		atomic.AddUint64(&engine.numTokenIndexAdded,
 			uint64(len(request.document.Keywords)))
@@ -49,21 +58,54 @@ func (engine *Engine) indexerLookupWorker(shard int) {
 	for {
 		request := <-engine.indexerLookupChannels[shard]
 
-		var docs []types.IndexedDocument
-		var numDocs int
-		if request.docIds == nil {
-			docs, numDocs = engine.indexers[shard].Lookup(request.tokens, request.labels, nil, request.countDocsOnly)
+		// 搜索已被取消或者超时，不再查找，也不返回结果
+		if request.ctx.Err() != nil {
+			continue
+		}
+
+		var (
+			docs         []types.IndexedDocument
+			numDocs      int
+			facets       []types.Facet
+			aggregations []types.Aggregation
+			err          error
+		)
+		pruned := request.pruning && canPrune(request)
+		if pruned {
+			docs, numDocs, _, err = engine.indexers[shard].LookupTopK(request.ctx, request.query.Tokens(), request.labels,
+				request.docIds, request.filters, request.options.OutputOffset+request.options.MaxOutputs)
 		} else {
-			docs, numDocs = engine.indexers[shard].Lookup(request.tokens, request.labels, request.docIds, request.countDocsOnly)
+			query := request.query
+			if query == nil {
+				rootQuery := types.AndQuery()
+				for _, token := range request.tokens {
+					rootQuery.Children = append(rootQuery.Children, types.TermQuery(token))
+				}
+				query = &rootQuery
+			}
+			docs, numDocs, facets, aggregations, err = engine.indexers[shard].LookupContext(
+				request.ctx, query, request.labels, request.docIds, types.LookupOptions{
+					Filters:       request.filters,
+					GeoFilters:    request.geoFilters,
+					Facets:        request.facets,
+					Aggregations:  request.aggregations,
+					DistanceSort:  request.options.SortByDistance,
+					CountDocsOnly: request.countDocsOnly,
+				})
+		}
+		if err != nil {
+			request.rankerReturnChannel <- rankerReturnRequest{shard: shard, err: err}
+			continue
 		}
 
 		if request.countDocsOnly {
-			request.rankerReturnChannel <- rankerReturnRequest{numDocs: numDocs}
+			request.rankerReturnChannel <- rankerReturnRequest{
+				shard: shard, numDocs: numDocs, facets: facets, aggregations: aggregations}
 			continue
 		}
 
 		if len(docs) == 0 {
-			request.rankerReturnChannel <- rankerReturnRequest{}
+			request.rankerReturnChannel <- rankerReturnRequest{shard: shard, facets: facets, aggregations: aggregations}
 			continue
 		}
 
@@ -73,28 +115,71 @@ func (engine *Engine) indexerLookupWorker(shard int) {
 				outputDocs = append(outputDocs, types.ScoredDocument{
 					DocId: d.DocId,
 					TokenSnippetLocations: d.TokenSnippetLocations,
-					TokenLocations:        d.TokenLocations})
+					TokenLocations:        d.TokenLocations,
+					Distance:              d.Distance})
 			}
 			request.rankerReturnChannel <- rankerReturnRequest{
-				docs:    outputDocs,
-				numDocs: len(outputDocs),
+				shard:        shard,
+				docs:         outputDocs,
+				numDocs:      len(outputDocs),
+				facets:       facets,
+				aggregations: aggregations,
 			}
 			continue
 		}
 
 		rankerRequest := rankerRankRequest{
+			ctx:                 request.ctx,
 			countDocsOnly:       request.countDocsOnly,
 			docs:                docs,
 			options:             request.options,
 			rankerReturnChannel: request.rankerReturnChannel,
+			facets:              facets,
+			aggregations:        aggregations,
+		}
+		if pruned {
+			rankerRequest.numDocs = numDocs
 		}
 		engine.rankerRankChannels[shard] <- rankerRequest
 	}
 }
 
+// 是否可以用WAND跳过不可能进入前OutputOffset+MaxOutputs名的文档：只有查询树为若干搜索键的并集且按BM25从大到小排序时才行，
+// 分面统计和聚合需要全部满足条件的文档，按距离排序时分数不只是BM25，有地理范围条件时也不跳过
+func canPrune(request indexerLookupRequest) bool {
+	query := request.query
+	if query == nil || query.Operator != types.QueryOr || len(query.Children) == 0 {
+		return false
+	}
+	for _, child := range query.Children {
+		if child.Operator != types.QueryTerm || child.Token == "" || (child.Weight != 0 && child.Weight != 1) {
+			return false
+		}
+	}
+	if request.countDocsOnly || request.orderless || len(request.facets) > 0 || len(request.aggregations) > 0 ||
+		len(request.geoFilters) > 0 || request.options.ReverseOrder || request.options.MaxOutputs == 0 || request.options.SortByDistance != nil {
+		return false
+	}
+	switch request.options.ScoringCriteria.(type) {
+	case types.RankByBM25, *types.RankByBM25:
+		return true
+	}
+	return false
+}
+
 func (engine *Engine) indexerRemoveDocWorker(shard int) {
 	for {
 		request := <-engine.indexerRemoveDocChannels[shard]
-		engine.indexers[shard].RemoveDoc(request.docId)
+		var changed map[string]bool
+		engine.applyDocRequest(shard, request.docId, request.version, func() {
+			changed = engine.indexers[shard].RemoveDoc(request.docId)
+		})
+		engine.rankerRemoveDocChannels[shard] <- rankerRemoveDocRequest{
+			docId: request.docId, version: request.version, changed: changed}
+
+		// 删除的文档积累到一定数目时压缩内存中的反向索引，持久存储中的索引项在删除时已经清除
+		if engine.indexers[shard].NumRemovedDocs() >= engine.initOptions.NumRemovedDocsToCompact {
+			engine.indexers[shard].Compact()
+		}
 	}
 }
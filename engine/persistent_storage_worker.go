@@ -1,120 +1,367 @@
 package engine
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/gob"
-	"github.com/Jarlene/wukong/core"
+	"github.com/Jarlene/wukong/storage"
 	"github.com/Jarlene/wukong/types"
+	"log"
+	"reflect"
 	"sync"
 	"sync/atomic"
 )
 
 type persistentStorageIndexDocumentRequest struct {
-	typ string //"info"or"index"
+	typ string //"document"、"remove"或"sync"
 
-	// typ=="info"时，以下两个字段有效
-	docId   uint64
-	docInfo *types.DocInfo
+	// typ=="document"时，以下四个字段有效。文档信息和该文档的反向索引项在同一个请求中写入，
+	// 避免两者分别写入时相互穿插。document为分词后的文档，写入预写日志用于崩溃后恢复，
+	// 反向索引项也按它写入，addInvertedIndex为文档原有的和新的搜索键，写入前先从中去掉文档原有的索引项
+	// typ=="remove"时docId和addInvertedIndex（文档原有的搜索键）有效
+	docId            uint64
+	document         *types.DocumentIndex
+	docInfo          *types.DocInfo
+	addInvertedIndex map[string]bool
+	// 写入完成后通知的句柄，以及之前的步骤中遇到的错误
+	handle *IndexHandle
+	err    error
 
-	// typ=="index"时，以下两个字段有效
-	keyword        string
-	keywordIndices *types.KeywordIndices
+	// typ=="sync"时，以下字段有效，之前的请求都写入后关闭该通道
+	synced chan bool
 }
 
+// 持久存储工作协程每次最多合并这么多个请求，一起写入预写日志和数据库
+const maxPersistentStorageBatchRequests = 64
+
 func (engine *Engine) persistentStorageIndexDocumentWorker(shard int) {
+	requests := make([]persistentStorageIndexDocumentRequest, 0, maxPersistentStorageBatchRequests)
 	for {
-		request := <-engine.persistentStorageIndexDocumentChannels[shard]
-		switch request.typ {
-		case "info":
-			// 得到key
-			b := make([]byte, 10)
-			length := binary.PutUvarint(b, request.docId)
-
-			// 得到value
-			var buf bytes.Buffer
-			enc := gob.NewEncoder(&buf)
-			err := enc.Encode(request.docInfo)
-			if err != nil {
+		// 取出一个请求，再取出所有已经在等待的请求
+		requests = append(requests[:0], <-engine.persistentStorageIndexDocumentChannels[shard])
+	collect:
+		for len(requests) < maxPersistentStorageBatchRequests {
+			select {
+			case request := <-engine.persistentStorageIndexDocumentChannels[shard]:
+				requests = append(requests, request)
+			default:
+				break collect
+			}
+		}
+
+		// 先写预写日志，再修改数据库
+		var records []*walRecord
+		for i := range requests {
+			request := &requests[i]
+			switch request.typ {
+			case "document":
+				if request.err == nil && request.document != nil {
+					records = append(records, &walRecord{
+						Op:                walIndex,
+						DocId:             request.docId,
+						TokenLength:       request.document.TokenLength,
+						FieldTokenLengths: request.document.FieldTokenLengths,
+						Keywords:          request.document.Keywords,
+						Attributes:        request.document.Attributes,
+						GeoPoints:         request.document.GeoPoints,
+						fields:            request.docInfo.Fields,
+					})
+				}
+			case "remove":
+				records = append(records, &walRecord{Op: walRemove, DocId: request.docId})
+			}
+		}
+		walErr := engine.wals[shard].append(engine.scoringFieldsType(), records...)
+		engine.setPersistentStorageError(walErr)
+
+		err := engine.storeRequests(shard, requests)
+		if err == nil {
+			err = walErr
+		}
+		for i := range requests {
+			switch requests[i].typ {
+			case "document":
 				atomic.AddUint64(&engine.numDocumentsStored, 1)
-				return
+				if requests[i].err == nil {
+					requests[i].err = err
+				}
+				engine.finishIndexing(requests[i].handle, requests[i].err)
+			case "remove":
+				engine.finishPendingRequest()
+			}
+		}
+		// 只有sync请求的批次不代表之前失败的记录已经写入数据库
+		if len(records) > 0 {
+			engine.checkpointWriteAheadLog(shard, err == nil)
+		}
+		for i := range requests {
+			if requests[i].typ == "sync" {
+				close(requests[i].synced)
+			}
+		}
+	}
+}
+
+// 将一组请求对info和index数据库的修改分别放入一个批次中写入，返回第一个错误
+// 每个修改的关键词只重写相关文档所在的反向索引块，同一块只写入一次
+func (engine *Engine) storeRequests(shard int, requests []persistentStorageIndexDocumentRequest) (err error) {
+	infoBatch := storage.NewWriteBatch()
+	indexBatch := storage.NewWriteBatch()
+	for i := range requests {
+		request := &requests[i]
+		switch request.typ {
+		case "document":
+			if request.docInfo != nil {
+				if encodeErr := storeDocInfo(infoBatch, request.docId, request.docInfo, engine.scoringFieldsType()); encodeErr != nil && request.err == nil {
+					request.err = encodeErr
+				}
 			}
+		case "remove":
+			removeDocInfo(infoBatch, request.docId)
+		}
+	}
+	if err = engine.storeDocPostings(indexBatch, shard, requests); err != nil {
+		engine.setPersistentStorageError(err)
+		return
+	}
 
-			// 将key-value写入数据库
-			engine.dbs[shard][getDB(request.typ)].Set(b[0:length], buf.Bytes())
-			atomic.AddUint64(&engine.numDocumentsStored, 1)
+	for typ, batch := range [2]*storage.WriteBatch{infoBatch, indexBatch} {
+		if batch.Len() == 0 {
+			continue
+		}
+		if writeErr := engine.dbs[shard][typ].Write(batch); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	engine.setPersistentStorageError(err)
+	return
+}
 
-		case "index":
-			// 得到key
-			b := []byte(request.keyword)
+// 批次成功写入数据库后清空预写日志。写入失败时保留日志供重启时重放，
+// 但超过walCheckpointSize时仍然清空，避免日志无限增长
+func (engine *Engine) checkpointWriteAheadLog(shard int, committed bool) {
+	if committed || engine.wals[shard].size >= walCheckpointSize {
+		engine.setPersistentStorageError(engine.wals[shard].truncate())
+	}
+}
 
-			// 得到value
-			var buf bytes.Buffer
-			enc := gob.NewEncoder(&buf)
-			err := enc.Encode(request.keywordIndices)
+// 重放预写日志中的操作，更新内存中的索引并写入数据库，完成后清空日志
+// 必须在数据库恢复完毕之后、工作协程启动之前调用
+func (engine *Engine) replayWriteAheadLog(shard int) error {
+	records, err := engine.wals[shard].records()
+	if err != nil {
+		return err
+	}
+	requests := make([]persistentStorageIndexDocumentRequest, len(records))
+	for i, record := range records {
+		switch record.Op {
+		case walIndex:
+			document := types.DocumentIndex{
+				DocId:             record.DocId,
+				TokenLength:       record.TokenLength,
+				FieldTokenLengths: record.FieldTokenLengths,
+				Keywords:          record.Keywords,
+				Attributes:        record.Attributes,
+				GeoPoints:         record.GeoPoints,
+			}
+			dealDocInfoChan := make(chan bool, 1)
+			addInvertedIndex := engine.indexers[shard].AddDocument(&document, dealDocInfoChan)
+			fields, err := record.decodeFields(engine.scoringFieldsType())
 			if err != nil {
-				return
+				return err
+			}
+			if _, err := engine.rankers[shard].AddDocument(record.DocId, fields, dealDocInfoChan); err != nil {
+				return err
+			}
+			requests[i] = persistentStorageIndexDocumentRequest{
+				typ:              "document",
+				docId:            record.DocId,
+				document:         &document,
+				docInfo:          storedDocInfo(&document, fields),
+				addInvertedIndex: addInvertedIndex,
 			}
 
-			// 将key-value写入数据库
-			engine.dbs[shard][getDB(request.typ)].Set(b, buf.Bytes())
+		case walRemove:
+			changed := engine.indexers[shard].RemoveDoc(record.DocId)
+			engine.rankers[shard].RemoveDoc(record.DocId)
+			requests[i] = persistentStorageIndexDocumentRequest{
+				typ:              "remove",
+				docId:            record.DocId,
+				addInvertedIndex: changed,
+			}
+		}
+	}
+	if err := engine.storeRequests(shard, requests); err != nil {
+		return err
+	}
+	for _, request := range requests {
+		if request.err != nil {
+			return request.err
 		}
 	}
+	return engine.wals[shard].truncate()
 }
 
-func (engine *Engine) persistentStorageRemoveDocumentWorker(docId uint64, shard int) {
+// 记录写入持久存储时的错误，仅保留第一个
+func (engine *Engine) setPersistentStorageError(err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("写入持久存储失败: %v", err)
+	engine.persistentStorageErrLock.Lock()
+	if engine.persistentStorageErr == nil {
+		engine.persistentStorageErr = err
+	}
+	engine.persistentStorageErrLock.Unlock()
+}
+
+// 返回写入持久存储时遇到的第一个错误，没有错误时返回nil
+// 持久存储在后台协程中写入，因此Index和Remove不会直接返回这些错误
+func (engine *Engine) PersistentStorageError() error {
+	engine.persistentStorageErrLock.Lock()
+	defer engine.persistentStorageErrLock.Unlock()
+	return engine.persistentStorageErr
+}
+
+// 评分字段的类型，见EngineInitOptions.ScoringFieldsType
+func (engine *Engine) scoringFieldsType() reflect.Type {
+	if engine.initOptions.ScoringFieldsType == nil {
+		return nil
+	}
+	return reflect.TypeOf(engine.initOptions.ScoringFieldsType)
+}
+
+// 写入持久存储的文档信息，由请求中的文档和评分字段构造，不引用索引器和排序器中可能被之后的请求修改的文档信息。
+// 索引器按列保存数值属性和地理坐标属性，写入时和文档信息一起编码
+func storedDocInfo(document *types.DocumentIndex, fields interface{}) *types.DocInfo {
+	return &types.DocInfo{
+		Fields:            fields,
+		TokenLengths:      document.TokenLength,
+		FieldTokenLengths: document.FieldTokenLengths,
+		Attributes:        document.Attributes,
+		GeoPoints:         document.GeoPoints,
+	}
+}
+
+// 将文档信息写入info数据库的批次
+func storeDocInfo(batch *storage.WriteBatch, docId uint64, docInfo *types.DocInfo, fieldsType reflect.Type) error {
+	// 得到key
+	b := make([]byte, 10)
+	length := binary.PutUvarint(b, docId)
+
+	// 得到value
+	value, err := encodeDocInfo(docInfo, fieldsType)
+	if err != nil {
+		return err
+	}
+
+	// 将key-value写入批次
+	batch.Set(b[0:length], value)
+	return nil
+}
+
+// 从info数据库删除文档信息
+func removeDocInfo(batch *storage.WriteBatch, docId uint64) {
 	// 得到key
 	b := make([]byte, 10)
 	length := binary.PutUvarint(b, docId)
 
 	// 从数据库删除该key
-	engine.dbs[shard][getDB("info")].Delete(b[0:length])
+	batch.Delete(b[0:length])
 }
 
+// 从info和index数据库恢复一个shard的文档信息和反向索引
+//
+// 两个数据库都整体遍历：内存中的索引需要每个文档的信息和每个搜索键的全部块，每个键都要读取一次。
+// info数据库的键是DocId的变长编码，index数据库的键是搜索键加块的下界，都没有可以跳过的范围，
+// 按前缀或者范围分段遍历只会增加查找次数（各存储的ForEach本身就是不设边界的Range）。
+// 遍历出错时记录错误（见PersistentStorageError），已经读出的部分照常载入
 func (engine *Engine) persistentStorageInitWorker(shard int) {
 	var finish sync.WaitGroup
 	finish.Add(2)
-	// 恢复docInfo
+	// 恢复docInfo，旧版本gob编码的值改写为当前格式
+	fieldsType := engine.scoringFieldsType()
+	legacyInfoBatch := storage.NewWriteBatch()
 	go func() {
 		defer finish.Add(-1)
-		engine.dbs[shard][getDB("info")].ForEach(func(k, v []byte) error {
+		err := engine.dbs[shard][infoDB].ForEach(func(k, v []byte) error {
 			key, value := k, v
 			// 得到docID
 			docId, _ := binary.Uvarint(key)
 
 			// 得到data
-			buf := bytes.NewReader(value)
-			dec := gob.NewDecoder(buf)
-			var data types.DocInfo
-			err := dec.Decode(&data)
-			if err == nil {
-				// 添加索引
-				core.AddDocInfo(shard, docId, &data)
+			data, legacy, err := decodeDocInfo(value, fieldsType)
+			if err != nil {
+				engine.setPersistentStorageError(err)
+				return nil
+			}
+			// 添加索引
+			engine.indexers[shard].LoadDocInfo(docId, data)
+			if legacy {
+				engine.setPersistentStorageError(storeDocInfo(legacyInfoBatch, docId, data, fieldsType))
 			}
 			return nil
 		})
+		engine.setPersistentStorageError(err)
 	}()
 
 	// 恢复invertedIndex
+	blockLists := make(map[string]*postingBlockList)
+	legacyKeywords := make(map[string]*types.KeywordIndices)
+	legacyBlocks := storage.NewWriteBatch()
 	go func() {
 		defer finish.Add(-1)
-		engine.dbs[shard][getDB("index")].ForEach(func(k, v []byte) error {
+		err := engine.dbs[shard][indexDB].ForEach(func(k, v []byte) error {
 			key, value := k, v
 			// 得到keyword
-			keyword := string(key)
+			keyword, lowerBound, isBlock := parsePostingBlockKey(key)
 
 			// 得到data
-			buf := bytes.NewReader(value)
-			dec := gob.NewDecoder(buf)
-			var data types.KeywordIndices
-			err := dec.Decode(&data)
-			if err == nil {
-				// 添加索引
-				core.AddKeywordIndices(shard, keyword, &data)
+			data, legacy, err := decodeKeywordIndices(value)
+			if err != nil {
+				engine.setPersistentStorageError(err)
+				return nil
 			}
+			if !isBlock {
+				legacyKeywords[keyword] = data
+				return nil
+			}
+			if legacy {
+				legacyBlocks.Set(append([]byte{}, key...), encodeKeywordIndices(data))
+			}
+			list, found := blockLists[keyword]
+			if !found {
+				list = new(postingBlockList)
+				blockLists[keyword] = list
+			}
+			list.lowerBounds = append(list.lowerBounds, lowerBound)
+			list.blocks = append(list.blocks, data)
 			return nil
 		})
+		engine.setPersistentStorageError(err)
+
+		// 拼接各块并添加索引
+		for keyword, list := range blockLists {
+			engine.indexers[shard].LoadKeywordIndices(keyword, list.assemble())
+			engine.postingBlocks[shard][keyword] = list.lowerBounds
+		}
+		for keyword, data := range legacyKeywords {
+			if _, found := blockLists[keyword]; !found {
+				engine.indexers[shard].LoadKeywordIndices(keyword, data)
+			}
+		}
 	}()
 	finish.Wait()
+
+	// 将旧版本的整行改写为块，和删除整行在同一批次中写入
+	for keyword, data := range legacyKeywords {
+		if _, found := blockLists[keyword]; !found {
+			engine.storeLegacyPostings(legacyBlocks, shard, keyword, data)
+		}
+		legacyBlocks.Delete([]byte(keyword))
+	}
+	for typ, batch := range [2]*storage.WriteBatch{legacyInfoBatch, legacyBlocks} {
+		if batch.Len() > 0 {
+			engine.setPersistentStorageError(engine.dbs[shard][typ].Write(batch))
+		}
+	}
 	engine.persistentStorageInitChannel <- true
 }
@@ -0,0 +1,326 @@
+package engine
+
+import (
+	"encoding/binary"
+	"github.com/Jarlene/wukong/core"
+	"github.com/Jarlene/wukong/storage"
+	"github.com/Jarlene/wukong/types"
+	"sort"
+)
+
+// index数据库中每个反向索引块的文档数，块中文档数超过两倍时分裂
+const postingBlockSize = 128
+
+// index数据库的布局
+//
+// 每个搜索键的反向索引行被切分为若干块，每块覆盖一段DocId范围 [下界, 下一块的下界)，
+// 键为 搜索键 + "\x00" + 8字节大端序的下界，值为仅含该范围内文档的KeywordIndices，编码见codec.go。
+// 第一块的下界为0。加入或删除一个文档时只需重写该文档所在的块，和整行的长度无关。
+//
+// 块的范围一经写入不再改变，块中文档过多时分裂出下界更大的新块。新块和重写的原块在同一批次中写入；
+// 即使存储不能保证批次的原子性，原块中超出其范围的文档在恢复时也会被丢弃，不会丢失或重复文档。
+//
+// 旧版本的数据库中每个搜索键只有一行（键为搜索键本身），恢复时载入后改写为块的格式。
+
+// 反向索引块的键
+func postingBlockKey(keyword string, lowerBound uint64) []byte {
+	key := make([]byte, len(keyword)+9)
+	copy(key, keyword)
+	binary.BigEndian.PutUint64(key[len(keyword)+1:], lowerBound)
+	return key
+}
+
+// 解析反向索引块的键，不是块的键（旧版本的整行）时isBlock为false
+func parsePostingBlockKey(key []byte) (keyword string, lowerBound uint64, isBlock bool) {
+	if len(key) < 9 || key[len(key)-9] != 0 {
+		return string(key), 0, false
+	}
+	return string(key[:len(key)-9]), binary.BigEndian.Uint64(key[len(key)-8:]), true
+}
+
+// 复制反向索引行中DocId在[lowerBound, upperBound)范围内的部分，upperBound为0时不设上界
+func slicePostings(indices *types.KeywordIndices, lowerBound, upperBound uint64) *types.KeywordIndices {
+	start := sort.Search(len(indices.DocIds), func(i int) bool {
+		return indices.DocIds[i] >= lowerBound
+	})
+	end := len(indices.DocIds)
+	if upperBound != 0 {
+		end = sort.Search(len(indices.DocIds), func(i int) bool {
+			return indices.DocIds[i] >= upperBound
+		})
+	}
+	return slicePostingsByPosition(indices, start, end)
+}
+
+// 复制反向索引行中[start, end)位置的部分
+func slicePostingsByPosition(indices *types.KeywordIndices, start, end int) *types.KeywordIndices {
+	block := &types.KeywordIndices{
+		DocIds: append([]uint64{}, indices.DocIds[start:end]...),
+	}
+	if len(indices.Frequencies) > 0 {
+		block.Frequencies = append([]float32{}, indices.Frequencies[start:end]...)
+	}
+	if len(indices.Locations) > 0 {
+		block.Locations = append([][]int{}, indices.Locations[start:end]...)
+	}
+	if len(indices.Positions) > 0 {
+		block.Positions = append([][]int{}, indices.Positions[start:end]...)
+	}
+	return block
+}
+
+// 按索引器中的当前状态重写搜索键的全部块，搜索键已不存在时删除它的全部块。
+// 只在打开引擎、尚未接受新的请求时调用，此时索引器和数据库的内容一致
+func (engine *Engine) storePostings(batch *storage.WriteBatch, shard int, keyword string) {
+	bounds := firstPostingBlock(engine.postingBlocks[shard][keyword])
+	blocks := make(map[int]*types.KeywordIndices, len(bounds))
+	for i := range bounds {
+		var upperBound uint64
+		if i+1 < len(bounds) {
+			upperBound = bounds[i+1]
+		}
+		block, found := engine.indexers[shard].Postings(keyword, bounds[i], upperBound)
+		if !found {
+			block = new(types.KeywordIndices)
+		}
+		blocks[i] = block
+	}
+	engine.writePostingBlocks(batch, shard, keyword, bounds, blocks)
+}
+
+// 一个批次中修改的某个搜索键的块
+type postingBlockEdits struct {
+	bounds []uint64                      // 全部块的下界，第一块的下界为0
+	blocks map[int]*types.KeywordIndices // 修改过的块，键为在bounds中的序号
+}
+
+// 按请求中的文档修改反向索引块并写入批次：从数据库读出文档所在的块，去掉文档原有的索引项
+// （请求修改的搜索键），再加入请求中的关键词。写入的总是已经写入预写日志的请求的内容，
+// 不受索引器中之后的请求影响。只能在持久存储工作协程中或者工作协程启动之前调用
+func (engine *Engine) storeDocPostings(batch *storage.WriteBatch, shard int, requests []persistentStorageIndexDocumentRequest) error {
+	indexType := engine.initOptions.IndexerInitOptions.IndexType
+	edits := make(map[string]*postingBlockEdits)
+	block := func(keyword string, docId uint64) (*types.KeywordIndices, error) {
+		edit, found := edits[keyword]
+		if !found {
+			edit = &postingBlockEdits{
+				bounds: firstPostingBlock(engine.postingBlocks[shard][keyword]),
+				blocks: make(map[int]*types.KeywordIndices),
+			}
+			edits[keyword] = edit
+		}
+		i := sort.Search(len(edit.bounds), func(i int) bool { return edit.bounds[i] > docId }) - 1
+		if b, found := edit.blocks[i]; found {
+			return b, nil
+		}
+		b, err := engine.loadPostingBlock(shard, keyword, edit.bounds[i])
+		if err != nil {
+			return nil, err
+		}
+		edit.blocks[i] = b
+		return b, nil
+	}
+
+	for i := range requests {
+		request := &requests[i]
+		if request.typ != "document" && request.typ != "remove" {
+			continue
+		}
+		for k := range request.addInvertedIndex {
+			b, err := block(k, request.docId)
+			if err != nil {
+				return err
+			}
+			removePosting(b, request.docId)
+		}
+		if request.typ != "document" || request.document == nil {
+			continue
+		}
+		var positions [][]int
+		if indexType == types.LocationsIndex {
+			positions = core.KeywordPositions(request.document.Keywords)
+		}
+		for j := range request.document.Keywords {
+			keyword := &request.document.Keywords[j]
+			b, err := block(keyword.Text, request.docId)
+			if err != nil {
+				return err
+			}
+			var keywordPositions []int
+			if positions != nil {
+				keywordPositions = positions[j]
+			}
+			insertPosting(b, indexType, request.docId, keyword, keywordPositions)
+		}
+	}
+
+	for keyword, edit := range edits {
+		engine.writePostingBlocks(batch, shard, keyword, edit.bounds, edit.blocks)
+	}
+	return nil
+}
+
+// 块的下界，没有下界为0的块时在最前面加入一个（尚未写入的）第一块
+func firstPostingBlock(bounds []uint64) []uint64 {
+	if len(bounds) == 0 || bounds[0] != 0 {
+		return append([]uint64{0}, bounds...)
+	}
+	return bounds
+}
+
+// 从index数据库读出一个块，块不存在时返回空块
+func (engine *Engine) loadPostingBlock(shard int, keyword string, lowerBound uint64) (*types.KeywordIndices, error) {
+	key := postingBlockKey(keyword, lowerBound)
+	block := new(types.KeywordIndices)
+	// 只遍历这一个键，各存储引擎对不存在的键的Get返回值不同
+	err := engine.dbs[shard][indexDB].Range(key, append(key, 0), func(k, v []byte) error {
+		var err error
+		block, _, err = decodeKeywordIndices(v)
+		return err
+	})
+	return block, err
+}
+
+// 从块中去掉文档的索引项
+func removePosting(block *types.KeywordIndices, docId uint64) {
+	i := sort.Search(len(block.DocIds), func(i int) bool { return block.DocIds[i] >= docId })
+	if i == len(block.DocIds) || block.DocIds[i] != docId {
+		return
+	}
+	block.DocIds = append(block.DocIds[:i], block.DocIds[i+1:]...)
+	if len(block.Frequencies) > i {
+		block.Frequencies = append(block.Frequencies[:i], block.Frequencies[i+1:]...)
+	}
+	if len(block.Locations) > i {
+		block.Locations = append(block.Locations[:i], block.Locations[i+1:]...)
+	}
+	if len(block.Positions) > i {
+		block.Positions = append(block.Positions[:i], block.Positions[i+1:]...)
+	}
+}
+
+// 按DocId顺序在块中加入文档的索引项，和索引器的缓冲区保存相同的内容
+func insertPosting(block *types.KeywordIndices, indexType int, docId uint64, keyword *types.KeywordIndex, positions []int) {
+	i := sort.Search(len(block.DocIds), func(i int) bool { return block.DocIds[i] >= docId })
+	block.DocIds = append(block.DocIds, 0)
+	copy(block.DocIds[i+1:], block.DocIds[i:])
+	block.DocIds[i] = docId
+	switch indexType {
+	case types.LocationsIndex:
+		block.Locations = append(block.Locations, nil)
+		copy(block.Locations[i+1:], block.Locations[i:])
+		block.Locations[i] = keyword.Starts
+		block.Positions = append(block.Positions, nil)
+		copy(block.Positions[i+1:], block.Positions[i:])
+		block.Positions[i] = positions
+	case types.FrequenciesIndex:
+		block.Frequencies = append(block.Frequencies, 0)
+		copy(block.Frequencies[i+1:], block.Frequencies[i:])
+		block.Frequencies[i] = keyword.Frequency
+	}
+}
+
+// 将修改过的块写入批次，过大的块分裂，除第一块外的空块删除，全部块为空时删除该搜索键
+func (engine *Engine) writePostingBlocks(batch *storage.WriteBatch, shard int, keyword string, bounds []uint64, blocks map[int]*types.KeywordIndices) {
+	empty := len(blocks) == len(bounds)
+	for _, block := range blocks {
+		empty = empty && len(block.DocIds) == 0
+	}
+	if empty {
+		for _, lowerBound := range bounds {
+			batch.Delete(postingBlockKey(keyword, lowerBound))
+		}
+		delete(engine.postingBlocks[shard], keyword)
+		return
+	}
+
+	var newBounds []uint64
+	for i, lowerBound := range bounds {
+		block, changed := blocks[i]
+		if !changed {
+			newBounds = append(newBounds, lowerBound)
+			continue
+		}
+		if len(block.DocIds) == 0 && lowerBound != 0 {
+			batch.Delete(postingBlockKey(keyword, lowerBound))
+			continue
+		}
+		if len(block.DocIds) <= 2*postingBlockSize {
+			storePostingBlock(batch, keyword, lowerBound, block)
+			newBounds = append(newBounds, lowerBound)
+			continue
+		}
+
+		// 先写入分裂出的新块，最后重写原块
+		newBounds = append(newBounds, lowerBound)
+		for start := postingBlockSize; start < len(block.DocIds); start += postingBlockSize {
+			end := start + postingBlockSize
+			if end > len(block.DocIds) {
+				end = len(block.DocIds)
+			}
+			storePostingBlock(batch, keyword, block.DocIds[start], slicePostingsByPosition(block, start, end))
+			newBounds = append(newBounds, block.DocIds[start])
+		}
+		storePostingBlock(batch, keyword, lowerBound, slicePostingsByPosition(block, 0, postingBlockSize))
+	}
+	engine.postingBlocks[shard][keyword] = newBounds
+}
+
+// 将旧版本的整行反向索引切分为块写入批次。恢复时索引器中的数据在Reconcile之前不可见，
+// 所以直接切分读出的整行，而不是像storePostings那样从索引器中读取
+func (engine *Engine) storeLegacyPostings(batch *storage.WriteBatch, shard int, keyword string, indices *types.KeywordIndices) {
+	bounds := []uint64{0}
+	end := postingBlockSize
+	if end > len(indices.DocIds) {
+		end = len(indices.DocIds)
+	}
+	storePostingBlock(batch, keyword, 0, slicePostingsByPosition(indices, 0, end))
+	for start := postingBlockSize; start < len(indices.DocIds); start += postingBlockSize {
+		end := start + postingBlockSize
+		if end > len(indices.DocIds) {
+			end = len(indices.DocIds)
+		}
+		storePostingBlock(batch, keyword, indices.DocIds[start], slicePostingsByPosition(indices, start, end))
+		bounds = append(bounds, indices.DocIds[start])
+	}
+	engine.postingBlocks[shard][keyword] = bounds
+}
+
+func storePostingBlock(batch *storage.WriteBatch, keyword string, lowerBound uint64, block *types.KeywordIndices) {
+	batch.Set(postingBlockKey(keyword, lowerBound), encodeKeywordIndices(block))
+}
+
+// 恢复时读出的一个搜索键的全部块
+type postingBlockList struct {
+	lowerBounds []uint64
+	blocks      []*types.KeywordIndices
+}
+
+func (list *postingBlockList) Len() int {
+	return len(list.lowerBounds)
+}
+func (list *postingBlockList) Swap(i, j int) {
+	list.lowerBounds[i], list.lowerBounds[j] = list.lowerBounds[j], list.lowerBounds[i]
+	list.blocks[i], list.blocks[j] = list.blocks[j], list.blocks[i]
+}
+func (list *postingBlockList) Less(i, j int) bool {
+	return list.lowerBounds[i] < list.lowerBounds[j]
+}
+
+// 按下界排序并拼接各块，丢弃超出所在块范围的文档
+func (list *postingBlockList) assemble() *types.KeywordIndices {
+	sort.Sort(list)
+	indices := new(types.KeywordIndices)
+	for i, block := range list.blocks {
+		var upperBound uint64
+		if i+1 < len(list.lowerBounds) {
+			upperBound = list.lowerBounds[i+1]
+		}
+		block = slicePostings(block, list.lowerBounds[i], upperBound)
+		indices.DocIds = append(indices.DocIds, block.DocIds...)
+		indices.Frequencies = append(indices.Frequencies, block.Frequencies...)
+		indices.Locations = append(indices.Locations, block.Locations...)
+		indices.Positions = append(indices.Positions, block.Positions...)
+	}
+	return indices
+}
@@ -1,42 +1,83 @@
 package engine
 
 import (
+	"context"
 	"github.com/Jarlene/wukong/types"
+	"log"
 )
 
 type rankerAddDocRequest struct {
-	docId           uint64
-	fields          interface{}
-	dealDocInfoChan <-chan bool
+	docId                uint64
+	version              uint64
+	document             *types.DocumentIndex // 仅用于写入预写日志
+	fields               interface{}
+	dealDocInfoChan      <-chan bool
+	addInvertedIndexChan <-chan map[string]bool
+	handle               *IndexHandle
 }
 
 type rankerRankRequest struct {
+	ctx                 context.Context
 	docs                []types.IndexedDocument
 	options             types.RankOptions
 	rankerReturnChannel chan rankerReturnRequest
 	countDocsOnly       bool
+	// 索引器跳过文档（见SearchRequest.Pruning）时统计的满足条件的文档数，不为零时代替排序的文档数返回
+	numDocs int
+	// 索引器统计的分面和聚合，原样返回
+	facets       []types.Facet
+	aggregations []types.Aggregation
 }
 
 type rankerReturnRequest struct {
-	docs    types.ScoredDocuments
-	numDocs int
+	shard        int
+	docs         types.ScoredDocuments
+	numDocs      int
+	facets       []types.Facet
+	aggregations []types.Aggregation
+
+	// 查找或排序出错时非空，此时其它字段无效
+	err error
 }
 
 type rankerRemoveDocRequest struct {
-	docId uint64
+	docId   uint64
+	version uint64
+	changed map[string]bool // 索引器删除的文档所在的搜索键
 }
 
 func (engine *Engine) rankerAddDocWorker(shard int) {
 	for {
 		request := <-engine.rankerAddDocChannels[shard]
-		docInfo := engine.rankers[shard].AddDoc(request.docId, request.fields, request.dealDocInfoChan)
-		// save
-		if engine.initOptions.UsePersistentStorage {
-			engine.persistentStorageIndexDocumentChannels[shard] <- persistentStorageIndexDocumentRequest{
-				typ:     "info",
-				docId:   request.docId,
-				docInfo: docInfo,
+		// 等待索引器修改完反向索引
+		addInvertedIndex := <-request.addInvertedIndexChan
+		var err error
+		stored := false
+		engine.finishDocRequest(shard, request.docId, request.version, addInvertedIndex, func(addInvertedIndex map[string]bool) {
+			var docInfo *types.DocInfo
+			if _, err = engine.rankers[shard].AddDocument(request.docId, request.fields, request.dealDocInfoChan); err != nil {
+				log.Printf("排序器添加文档%d失败: %v", request.docId, err)
+			} else {
+				docInfo = storedDocInfo(request.document, request.fields)
+			}
+			// save
+			if engine.initOptions.UsePersistentStorage {
+				// 在同一文档之后的请求之前写入预写日志
+				engine.persistentStorageIndexDocumentChannels[shard] <- persistentStorageIndexDocumentRequest{
+					typ:              "document",
+					docId:            request.docId,
+					document:         request.document,
+					docInfo:          docInfo,
+					addInvertedIndex: addInvertedIndex,
+					handle:           request.handle,
+					err:              err,
+				}
+				stored = true
 			}
+		})
+		// 写入持久存储的请求由持久存储工作协程完成，被取代的请求直接完成
+		if !stored {
+			engine.finishIndexing(request.handle, err)
 		}
 	}
 }
@@ -48,14 +89,39 @@ func (engine *Engine) rankerRankWorker(shard int) {
 			request.options.MaxOutputs += request.options.OutputOffset
 		}
 		request.options.OutputOffset = 0
-		outputDocs, numDocs := engine.rankers[shard].Rank(request.docs, request.options, request.countDocsOnly)
-		request.rankerReturnChannel <- rankerReturnRequest{docs: outputDocs, numDocs: numDocs}
+		outputDocs, numDocs, err := engine.rankers[shard].RankContext(
+			request.ctx, request.docs, request.options, request.countDocsOnly)
+		if err != nil {
+			request.rankerReturnChannel <- rankerReturnRequest{shard: shard, err: err}
+			continue
+		}
+		if request.numDocs != 0 {
+			numDocs = request.numDocs
+		}
+		request.rankerReturnChannel <- rankerReturnRequest{
+			shard: shard, docs: outputDocs, numDocs: numDocs,
+			facets: request.facets, aggregations: request.aggregations}
 	}
 }
 
 func (engine *Engine) rankerRemoveDocWorker(shard int) {
 	for {
 		request := <-engine.rankerRemoveDocChannels[shard]
-		engine.rankers[shard].RemoveDoc(request.docId)
+		stored := false
+		engine.finishDocRequest(shard, request.docId, request.version, request.changed, func(changed map[string]bool) {
+			engine.rankers[shard].RemoveDoc(request.docId)
+			if engine.initOptions.UsePersistentStorage && shard == engine.getShard(request.docId) {
+				// 从数据库中删除，和同一shard的索引请求按顺序写入预写日志
+				engine.persistentStorageIndexDocumentChannels[shard] <- persistentStorageIndexDocumentRequest{
+					typ:              "remove",
+					docId:            request.docId,
+					addInvertedIndex: changed,
+				}
+				stored = true
+			}
+		})
+		if !stored {
+			engine.finishPendingRequest()
+		}
 	}
 }
@@ -2,12 +2,17 @@ package engine
 
 import (
 	"github.com/Jarlene/wukong/types"
+	"sort"
 )
 
 type segmenterRequest struct {
-	docId uint64
-	shard int
-	data  types.DocumentIndexData
+	docId   uint64
+	version uint64 // 见docRequestsShard
+	shard   int
+	data    types.DocumentIndexData
+
+	// 文档处理完毕时通知的句柄
+	handle *IndexHandle
 }
 
 func (engine *Engine) segmenterWorker() {
@@ -18,14 +23,11 @@ func (engine *Engine) segmenterWorker() {
 		numTokens := 0
 		if !engine.initOptions.NotUsingSegmenter && request.data.Content != "" {
 			// 当文档正文不为空时，优先从内容分词中得到关键词
-			segments := engine.segmenter.Segment([]byte(request.data.Content))
-			for _, segment := range segments {
-				token := segment.Token().Text()
-				if !engine.stopTokens.IsStopToken(token) {
-					tokensMap[token] = append(tokensMap[token], segment.Start())
-				}
+			var tokens []types.AnalyzedToken
+			tokens, numTokens = engine.analyze(request.data.Content)
+			for _, token := range tokens {
+				tokensMap[token.Text] = append(tokensMap[token.Text], token.Start)
 			}
-			numTokens = len(segments)
 		} else {
 			// 否则载入用户输入的关键词
 			for _, t := range request.data.Tokens {
@@ -36,24 +38,65 @@ func (engine *Engine) segmenterWorker() {
 			numTokens = len(request.data.Tokens)
 		}
 
-		// 加入非分词的文档标签
-		for _, label := range request.data.Labels {
-			if !engine.initOptions.NotUsingSegmenter {
-				if !engine.stopTokens.IsStopToken(label) {
-					tokensMap[label] = []int{}
+		// 具名字段分别分词，关键词同时加入不限字段和限定该字段的搜索键
+		var fieldTokenLengths map[string]float32
+		if len(request.data.TextFields) > 0 {
+			fieldTokenLengths = make(map[string]float32, len(request.data.TextFields))
+			offset := types.FieldLocationStart
+			names := make([]string, 0, len(request.data.TextFields))
+			for name := range request.data.TextFields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				tokens, numFieldTokens := engine.analyze(request.data.TextFields[name])
+				for _, token := range tokens {
+					tokensMap[token.Text] = append(tokensMap[token.Text], offset+token.Start)
+					key := types.FieldToken(name, token.Text)
+					tokensMap[key] = append(tokensMap[key], token.Start)
 				}
-			} else {
+				fieldTokenLengths[name] = float32(numFieldTokens)
+				numTokens += numFieldTokens
+				offset += len(request.data.TextFields[name]) + types.FieldLocationGap
+			}
+		}
+
+		// 加入非分词的文档标签，同时加入分面统计使用的标签搜索键
+		for _, label := range request.data.Labels {
+			if engine.initOptions.NotUsingSegmenter || !engine.stopTokens.IsStopToken(label) {
 				tokensMap[label] = []int{}
+				tokensMap[types.LabelToken(label)] = []int{}
 			}
 		}
 
 		indexerRequest := indexerAddDocumentRequest{
+			version: request.version,
 			document: &types.DocumentIndex{
-				DocId:       request.docId,
-				TokenLength: float32(numTokens),
-				Keywords:    make([]types.KeywordIndex, len(tokensMap)),
+				DocId:             request.docId,
+				TokenLength:       float32(numTokens),
+				FieldTokenLengths: fieldTokenLengths,
+				Keywords:          make([]types.KeywordIndex, len(tokensMap)),
 			},
 		}
+		if len(request.data.Attributes) > 0 {
+			// 类型已在加入索引时检查，地理坐标属性单独保存
+			attributes := make(map[string]types.AttributeValue, len(request.data.Attributes))
+			var geoPoints map[string]types.GeoPoint
+			for name, value := range request.data.Attributes {
+				if point, ok := value.(types.GeoPoint); ok {
+					if geoPoints == nil {
+						geoPoints = make(map[string]types.GeoPoint)
+					}
+					geoPoints[name] = point
+					continue
+				}
+				attributes[name], _ = types.NewAttributeValue(value)
+			}
+			if len(attributes) > 0 {
+				indexerRequest.document.Attributes = attributes
+			}
+			indexerRequest.document.GeoPoints = geoPoints
+		}
 		iTokens := 0
 		for k, v := range tokensMap {
 			indexerRequest.document.Keywords[iTokens] = types.KeywordIndex{
@@ -65,14 +108,20 @@ func (engine *Engine) segmenterWorker() {
 		}
 
 		var dealDocInfoChan = make(chan bool, 1)
+		var addInvertedIndexChan = make(chan map[string]bool, 1)
 
 		indexerRequest.dealDocInfoChan = dealDocInfoChan
+		indexerRequest.addInvertedIndexChan = addInvertedIndexChan
 		engine.indexerAddDocumentChannels[request.shard] <- indexerRequest
 
 		rankerRequest := rankerAddDocRequest{
-			docId:           request.docId,
-			fields:          request.data.Fields,
-			dealDocInfoChan: dealDocInfoChan,
+			docId:                request.docId,
+			version:              request.version,
+			document:             indexerRequest.document,
+			fields:               request.data.Fields,
+			dealDocInfoChan:      dealDocInfoChan,
+			addInvertedIndexChan: addInvertedIndexChan,
+			handle:               request.handle,
 		}
 		engine.rankerAddDocChannels[request.shard] <- rankerRequest
 	}
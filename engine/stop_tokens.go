@@ -11,16 +11,23 @@ type StopTokens struct {
 }
 
 // 从stopTokenFile中读入停用词，一个词一行
-// 文档索引建立时会跳过这些停用词
+// 文档索引建立时会跳过这些停用词，文件无法读取时退出程序
 func (st *StopTokens) Init(stopTokenFile string) {
+	if err := st.Open(stopTokenFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 同Init，文件无法读取时返回错误
+func (st *StopTokens) Open(stopTokenFile string) error {
 	st.stopTokens = make(map[string]bool)
 	if stopTokenFile == "" {
-		return
+		return nil
 	}
 
 	file, err := os.Open(stopTokenFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
@@ -31,7 +38,7 @@ func (st *StopTokens) Init(stopTokenFile string) {
 			st.stopTokens[text] = true
 		}
 	}
-
+	return scanner.Err()
 }
 
 func (st *StopTokens) IsStopToken(token string) bool {
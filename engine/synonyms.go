@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Jarlene/wukong/types"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 关键词的一个同义词及其在BM25中的权重，同义词分词后有多个关键词时作为短语扩展
+type synonym struct {
+	tokens []string
+	weight float32
+}
+
+// 同义词词典，可以在引擎运行时重新读入
+type Synonyms struct {
+	file     string
+	segment  func(text string) []string
+	synonyms map[string][]synonym
+	sync.RWMutex
+}
+
+// 从synonymFile中读入同义词，格式见EngineInitOptions.SynonymFile，文件无法读取或者格式不正确时返回错误
+// segment为建立索引时使用的分词函数，为nil时关键词和同义词不分词
+func (ss *Synonyms) Init(synonymFile string, segment func(text string) []string) error {
+	ss.file = synonymFile
+	ss.segment = segment
+	return ss.Reload()
+}
+
+// 重新读入同义词文件，出错时保留原来的同义词
+func (ss *Synonyms) Reload() error {
+	synonyms := make(map[string][]synonym)
+	if ss.file != "" {
+		file, err := os.Open(ss.file)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			keys := ss.tokens(fields[0])
+			if len(keys) != 1 {
+				return fmt.Errorf("同义词文件%s第%d行的关键词分词后不是一个关键词: %s", ss.file, line, fields[0])
+			}
+			for _, field := range fields[1:] {
+				// 最后一个冒号后能解析为数时才是权重，否则冒号属于同义词本身（比如标签category:x）
+				text, weight := field, 1.0
+				if i := strings.LastIndex(field, ":"); i > 0 {
+					if w, err := strconv.ParseFloat(field[i+1:], 32); err == nil {
+						if w <= 0 {
+							return fmt.Errorf("同义词文件%s第%d行的权重不正确: %s", ss.file, line, field)
+						}
+						text, weight = field[:i], w
+					}
+				}
+				tokens := ss.tokens(text)
+				if len(tokens) == 0 {
+					return fmt.Errorf("同义词文件%s第%d行的同义词分词后为空: %s", ss.file, line, field)
+				}
+				synonyms[keys[0]] = append(synonyms[keys[0]], synonym{tokens: tokens, weight: float32(weight)})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	ss.Lock()
+	ss.synonyms = synonyms
+	ss.Unlock()
+	return nil
+}
+
+// 将关键词或者同义词切分为搜索键，以"="开头时去掉"="后原样使用（比如标签）
+func (ss *Synonyms) tokens(text string) []string {
+	if strings.HasPrefix(text, "=") {
+		if text == "=" {
+			return nil
+		}
+		return []string{text[1:]}
+	}
+	if ss.segment == nil {
+		return []string{text}
+	}
+	return ss.segment(text)
+}
+
+// 返回关键词的同义词，没有时返回nil
+func (ss *Synonyms) lookup(token string) []synonym {
+	ss.RLock()
+	defer ss.RUnlock()
+	return ss.synonyms[token]
+}
+
+// 重新读入EngineInitOptions.SynonymFile，之后的搜索使用新的同义词。出错时保留原来的同义词
+func (engine *Engine) ReloadSynonyms() error {
+	if !engine.initialized {
+		return ErrNotInitialized
+	}
+	return engine.synonyms.Reload()
+}
+
+// 将查询树中的关键词扩展为它和同义词的并集，同义词的权重为原关键词的权重乘以同义词文件中的权重
+// 短语中的关键词不扩展。groups和扩展前的query.Tokens()一一对应，为各关键词扩展后的搜索键数，
+// 没有关键词被扩展时ok为false
+func (engine *Engine) expandSynonyms(query types.Query) (expanded types.Query, groups []int, ok bool) {
+	expanded = engine.expandQuery(query, false, &groups, &ok)
+	return
+}
+
+func (engine *Engine) expandQuery(query types.Query, excluded bool, groups *[]int, ok *bool) types.Query {
+	switch query.Operator {
+	case types.QueryTerm:
+		if query.Token == "" {
+			return query
+		}
+		synonyms := engine.synonyms.lookup(query.Token)
+		if len(synonyms) == 0 {
+			if !excluded {
+				*groups = append(*groups, 1)
+			}
+			return query
+		}
+		*ok = true
+		weight := query.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		or := types.OrQuery(query)
+		for _, s := range synonyms {
+			var terms []types.Query
+			for _, token := range s.tokens {
+				terms = append(terms, types.Query{
+					Operator: types.QueryTerm, Token: token, Field: query.Field, Weight: weight * s.weight})
+			}
+			if len(terms) == 1 {
+				or.Children = append(or.Children, terms[0])
+			} else {
+				or.Children = append(or.Children, types.PhraseQuery(0, terms...))
+			}
+		}
+		if !excluded {
+			*groups = append(*groups, len(or.Tokens()))
+		}
+		return or
+	case types.QueryPhrase:
+		if !excluded {
+			for range query.Tokens() {
+				*groups = append(*groups, 1)
+			}
+		}
+		return query
+	}
+	result := query
+	result.Children = make([]types.Query, len(query.Children))
+	for i, child := range query.Children {
+		result.Children[i] = engine.expandQuery(child, excluded || query.Operator == types.QueryNot, groups, ok)
+	}
+	return result
+}
+
+// 将按扩展后的搜索键排列的关键词位置合并为按原关键词排列：TokenSnippetLocations取同一组中第一个找到的位置，
+// TokenLocations为同一组中全部位置按升序合并。groups见expandSynonyms
+func collapseSynonymLocations(docs []types.ScoredDocument, groups []int) {
+	total := 0
+	for _, size := range groups {
+		total += size
+	}
+	for i := range docs {
+		doc := &docs[i]
+		if len(doc.TokenSnippetLocations) != total || len(doc.TokenLocations) != total {
+			continue
+		}
+		snippetLocations := make([]int, len(groups))
+		tokenLocations := make([][]int, len(groups))
+		start := 0
+		for j, size := range groups {
+			snippetLocations[j] = -1
+			for k := start; k < start+size; k++ {
+				if snippetLocations[j] < 0 {
+					snippetLocations[j] = doc.TokenSnippetLocations[k]
+				}
+				tokenLocations[j] = append(tokenLocations[j], doc.TokenLocations[k]...)
+			}
+			if size > 1 {
+				sort.Ints(tokenLocations[j])
+			}
+			start += size
+		}
+		doc.TokenSnippetLocations = snippetLocations
+		doc.TokenLocations = tokenLocations
+	}
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"github.com/Jarlene/wukong/types"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+)
+
+// 预写日志中的操作类型
+const (
+	walIndex  = 0
+	walRemove = 1
+)
+
+// 数据库写入失败时预写日志中的记录会保留下来，超过这个字节数时仍然清空
+const walCheckpointSize = 4 << 20
+
+// 预写日志记录
+//
+// 每个shard的持久存储工作协程在修改info和index数据库之前先将操作写入预写日志并同步到磁盘，
+// 引擎重启时重放日志中的操作，使数据库和已确认的操作保持一致
+type walRecord struct {
+	Op    int
+	DocId uint64
+
+	// Op == walIndex时有效：分词后的文档和编码后的评分字段（见encodeFields）
+	TokenLength       float32
+	FieldTokenLengths map[string]float32
+	Keywords          []types.KeywordIndex
+	Attributes        map[string]types.AttributeValue
+	GeoPoints         map[string]types.GeoPoint
+	EncodedFields     []byte
+
+	// 旧版本的日志中直接用gob编码的评分字段
+	Fields interface{}
+
+	// 写入时待编码的评分字段
+	fields interface{}
+}
+
+// 得到记录中的评分字段
+func (record *walRecord) decodeFields(fieldsType reflect.Type) (interface{}, error) {
+	if record.EncodedFields == nil {
+		return record.Fields, nil
+	}
+	return decodeFields(record.EncodedFields, fieldsType)
+}
+
+// 预写日志文件
+//
+// 每条记录的格式为：4字节长度 + 4字节CRC32校验和 + gob编码的walRecord，均为小端序。
+// 进程在写入记录时崩溃会在文件末尾留下不完整的记录，读取时忽略
+type writeAheadLog struct {
+	file *os.File
+	size int64
+}
+
+func openWriteAheadLog(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &writeAheadLog{file: file, size: info.Size()}, nil
+}
+
+// 追加若干条记录，一起同步到磁盘。fieldsType见encodeFields
+func (wal *writeAheadLog) append(fieldsType reflect.Type, records ...*walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, record := range records {
+		if record.Op == walIndex {
+			encodedFields, err := encodeFields(record.fields, fieldsType)
+			if err != nil {
+				return err
+			}
+			record.EncodedFields = encodedFields
+		}
+		var payload bytes.Buffer
+		if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+			return err
+		}
+		header := make([]byte, 8)
+		binary.LittleEndian.PutUint32(header[0:4], uint32(payload.Len()))
+		binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+		buf = append(buf, header...)
+		buf = append(buf, payload.Bytes()...)
+	}
+
+	n, err := wal.file.Write(buf)
+	wal.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// 清空日志，必须在日志中的所有记录都写入数据库之后调用
+func (wal *writeAheadLog) truncate() error {
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	wal.size = 0
+	return wal.file.Sync()
+}
+
+func (wal *writeAheadLog) close() error {
+	return wal.file.Close()
+}
+
+// 按顺序读出日志中的全部完整记录，遇到不完整或者校验失败的记录时停止
+func (wal *writeAheadLog) records() ([]walRecord, error) {
+	if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var records []walRecord
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(wal.file, header); err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if int64(length) > wal.size {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(wal.file, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		var record walRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			return records, errors.New("无法解析预写日志记录: " + err.Error())
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -21,7 +21,7 @@ const (
 var (
 	weibo_data = flag.String(
 		"weibo_data",
-		"../testdata/weibo_data.txt",
+		"../../testdata/weibo_data.txt",
 		"微博数据")
 	queries = flag.String(
 		"queries",
@@ -30,11 +30,11 @@ var (
 		"待搜索的关键词")
 	dictionaries = flag.String(
 		"dictionaries",
-		"../data/dictionary.txt",
+		"../../data/dictionary.txt",
 		"分词字典文件")
 	stop_token_file = flag.String(
 		"stop_token_file",
-		"../data/stop_tokens.txt",
+		"../../data/stop_tokens.txt",
 		"停用词文件")
 	cpuprofile                = flag.String("cpuprofile", "", "处理器profile文件")
 	memprofile                = flag.String("memprofile", "", "内存profile文件")
@@ -42,7 +42,6 @@ var (
 	index_type                = flag.Int("index_type", types.DocIdsIndex, "索引类型")
 	use_persistent            = flag.Bool("use_persistent", false, "是否使用持久存储")
 	persistent_storage_folder = flag.String("persistent_storage_folder", "benchmark.persistent", "持久存储数据库保存的目录")
-	persistent_storage_shards = flag.Int("persistent_storage_shards", 0, "持久数据库存储裂分数目")
 
 	searcher = engine.Engine{}
 	options  = types.RankOptions{
@@ -73,7 +72,6 @@ func main() {
 		DefaultRankOptions:      &options,
 		UsePersistentStorage:    *use_persistent,
 		PersistentStorageFolder: *persistent_storage_folder,
-		PersistentStorageShards: *persistent_storage_shards,
 	})
 	tEndInit := time.Now()
 	defer searcher.Close()
@@ -140,6 +138,15 @@ func main() {
 	log.Printf("建立索引速度每秒添加 %f 百万个索引",
 		float64(searcher.NumTokenIndexAdded())/t1.Sub(t0).Seconds()/(1000000))
 
+	// 反向索引占用的内存
+	runtime.GC()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	compressed, uncompressed := searcher.PostingsSize()
+	log.Printf("堆内存 %.1f MB，其中反向索引约 %.1f MB，不压缩时约 %.1f MB，节省 %.1f%%",
+		float64(memStats.HeapAlloc)/(1<<20), float64(compressed)/(1<<20), float64(uncompressed)/(1<<20),
+		100*(1-float64(compressed)/float64(uncompressed)))
+
 	// 写入内存profile文件
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
@@ -183,7 +190,6 @@ func main() {
 			DefaultRankOptions:      &options,
 			UsePersistentStorage:    *use_persistent,
 			PersistentStorageFolder: *persistent_storage_folder,
-			PersistentStorageShards: *persistent_storage_shards,
 		})
 		defer searcher1.Close()
 		t5 := time.Now()
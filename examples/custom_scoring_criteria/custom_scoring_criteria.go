@@ -14,7 +14,6 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"github.com/Jarlene/wukong/engine"
@@ -34,7 +33,7 @@ const (
 var (
 	weibo_data = flag.String(
 		"weibo_data",
-		"../testdata/weibo_data.txt",
+		"../../testdata/weibo_data.txt",
 		"索引的微博帖子，每行当作一个文档")
 	query = flag.String(
 		"query",
@@ -42,11 +41,11 @@ var (
 		"待搜索的短语")
 	dictionaries = flag.String(
 		"dictionaries",
-		"../data/dictionary.txt",
+		"../../data/dictionary.txt",
 		"分词字典文件")
 	stop_token_file = flag.String(
 		"stop_token_file",
-		"../data/stop_tokens.txt",
+		"../../data/stop_tokens.txt",
 		"停用词文件")
 
 	searcher = engine.Engine{}
@@ -97,7 +96,6 @@ func main() {
 	log.Printf("待搜索的短语为\"%s\"", *query)
 
 	// 初始化
-	gob.Register(WeiboScoringFields{})
 	searcher.Init(types.EngineInitOptions{
 		SegmenterDictionaries: *dictionaries,
 		StopTokenFile:         *stop_token_file,
@@ -105,6 +103,7 @@ func main() {
 			IndexType: types.LocationsIndex,
 		},
 		DefaultRankOptions: &options,
+		ScoringFieldsType:  WeiboScoringFields{},
 	})
 	defer searcher.Close()
 
@@ -20,7 +20,7 @@ var (
 func main() {
 	// 初始化
 	searcher.Init(types.EngineInitOptions{
-		SegmenterDictionaries: "../data/dictionary.txt"})
+		SegmenterDictionaries: "../../data/dictionary.txt"})
 	defer searcher.Close()
 
 	// 将文档加入索引
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"github.com/boltdb/bolt"
 	"time"
 )
@@ -51,17 +52,45 @@ func (s *boltStorage) Delete(k []byte) error {
 	})
 }
 
-func (s *boltStorage) ForEach(fn func(k, v []byte) error) error {
-	return s.db.View(func(tx *bolt.Tx) error {
+func (s *boltStorage) Write(batch *WriteBatch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(wukong_documents)
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+		return batch.Replay(b.Put, b.Delete)
+	})
+}
+
+func (s *boltStorage) ForEach(fn func(k, v []byte) error) error {
+	return s.Range(nil, nil, fn)
+}
+
+func (s *boltStorage) Range(start, end []byte, fn func(k, v []byte) error) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(wukong_documents).Cursor()
+		var k, v []byte
+		if start == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(start)
+		}
+		for ; k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
 			if err := fn(k, v); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+func (s *boltStorage) Seek(k []byte, fn func(k, v []byte) error) error {
+	return s.Range(k, nil, fn)
+}
+
+func (s *boltStorage) Prefix(prefix []byte, fn func(k, v []byte) error) error {
+	return s.Range(prefix, prefixEnd(prefix), fn)
 }
 
 func (s *boltStorage) Close() error {
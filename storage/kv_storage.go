@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"github.com/cznic/kv"
 	"io"
 )
@@ -38,8 +39,29 @@ func (s *kvStorage) Delete(k []byte) error {
 	return s.db.Delete(k)
 }
 
+func (s *kvStorage) Write(batch *WriteBatch) error {
+	if err := s.db.BeginTransaction(); err != nil {
+		return err
+	}
+	if err := batch.Replay(s.db.Set, s.db.Delete); err != nil {
+		s.db.Rollback()
+		return err
+	}
+	return s.db.Commit()
+}
+
 func (s *kvStorage) ForEach(fn func(k, v []byte) error) error {
-	iter, err := s.db.SeekFirst()
+	return s.Range(nil, nil, fn)
+}
+
+func (s *kvStorage) Range(start, end []byte, fn func(k, v []byte) error) error {
+	var iter *kv.Enumerator
+	var err error
+	if start == nil {
+		iter, err = s.db.SeekFirst()
+	} else {
+		iter, _, err = s.db.Seek(start)
+	}
 	if err == io.EOF {
 		return nil
 	} else if err != nil {
@@ -52,13 +74,26 @@ func (s *kvStorage) ForEach(fn func(k, v []byte) error) error {
 		} else if err != nil {
 			return err
 		}
-		if err := fn(key, value); err != nil {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if err := fn(key, value); err == ErrStopIteration {
+			break
+		} else if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (s *kvStorage) Seek(k []byte, fn func(k, v []byte) error) error {
+	return s.Range(k, nil, fn)
+}
+
+func (s *kvStorage) Prefix(prefix []byte, fn func(k, v []byte) error) error {
+	return s.Range(prefix, prefixEnd(prefix), fn)
+}
+
 func (s *kvStorage) Close() error {
 	return s.db.Close()
 }
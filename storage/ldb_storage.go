@@ -2,6 +2,7 @@ package storage
 
 import (
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type leveldbStorage struct {
@@ -34,18 +35,48 @@ func (s *leveldbStorage) Delete(k []byte) error {
 	return s.db.Delete(k, nil)
 }
 
+func (s *leveldbStorage) Write(batch *WriteBatch) error {
+	var b leveldb.Batch
+	batch.Replay(func(k, v []byte) error {
+		b.Put(k, v)
+		return nil
+	}, func(k []byte) error {
+		b.Delete(k)
+		return nil
+	})
+	return s.db.Write(&b, nil)
+}
+
 func (s *leveldbStorage) ForEach(fn func(k, v []byte) error) error {
-	iter := s.db.NewIterator(nil, nil)
+	return s.Range(nil, nil, fn)
+}
+
+func (s *leveldbStorage) Range(start, end []byte, fn func(k, v []byte) error) error {
+	return s.iterate(&util.Range{Start: start, Limit: end}, fn)
+}
+
+func (s *leveldbStorage) Seek(k []byte, fn func(k, v []byte) error) error {
+	return s.iterate(&util.Range{Start: k}, fn)
+}
+
+func (s *leveldbStorage) Prefix(prefix []byte, fn func(k, v []byte) error) error {
+	return s.iterate(util.BytesPrefix(prefix), fn)
+}
+
+func (s *leveldbStorage) iterate(slice *util.Range, fn func(k, v []byte) error) error {
+	iter := s.db.NewIterator(slice, nil)
+	defer iter.Release()
 	for iter.Next() {
 		// Remember that the contents of the returned slice should not be modified, and
 		// only valid until the next call to Next.
 		key := iter.Key()
 		value := iter.Value()
-		if err := fn(key, value); err != nil {
+		if err := fn(key, value); err == ErrStopIteration {
+			return nil
+		} else if err != nil {
 			return err
 		}
 	}
-	iter.Release()
 	return iter.Error()
 }
 
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"os"
 )
@@ -17,15 +18,41 @@ func RegisterStorageEngine(name string, fn func(path string) (Storage, error)) {
 	supportedStorage[name] = fn
 }
 
+// 以下遍历函数均按键的字节序从小到大调用fn，fn中的k和v仅在本次调用中有效，需要保留时请复制。
+// fn返回ErrStopIteration时提前结束遍历并返回nil，返回其他错误时结束遍历并返回该错误。
 type Storage interface {
 	Set(k, v []byte) error
 	Get(k []byte) ([]byte, error)
 	Delete(k []byte) error
+	// 遍历全部键
 	ForEach(fn func(k, v []byte) error) error
+	// 遍历大于等于start、小于end的键，start为nil时从第一个键开始，end为nil时直到最后一个键
+	Range(start, end []byte, fn func(k, v []byte) error) error
+	// 从第一个大于等于k的键开始遍历
+	Seek(k []byte, fn func(k, v []byte) error) error
+	// 遍历以prefix开头的键
+	Prefix(prefix []byte, fn func(k, v []byte) error) error
+	// 原子地执行batch中的全部操作：要么全部写入，要么都不写入
+	Write(batch *WriteBatch) error
 	Close() error
 	WALName() string
 }
 
+// 遍历函数返回此错误时提前结束遍历
+var ErrStopIteration = errors.New("stop iteration")
+
+// 以prefix开头的键的上界（不含），即大于所有以prefix开头的键的最小键，不存在时返回nil
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 func OpenStorage(path string) (Storage, error) {
 	wse := os.Getenv("WUKONG_STORAGE_ENGINE")
 	if wse == "" {
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"github.com/Jarlene/wukong/utils"
+	"os"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	for name, open := range supportedStorage {
+		path := name + "_batch_test"
+		db, err := open(path)
+		utils.Expect(t, "<nil>", err)
+
+		db.Set([]byte("key1"), []byte("value1"))
+		batch := NewWriteBatch()
+		batch.Set([]byte("key2"), []byte("value2"))
+		batch.Set([]byte("key3"), []byte("value3"))
+		batch.Delete([]byte("key1"))
+		batch.Set([]byte("key3"), []byte("value4"))
+		utils.Expect(t, "4", batch.Len())
+		utils.Expect(t, "<nil>", db.Write(batch))
+
+		result := ""
+		db.ForEach(func(k, v []byte) error {
+			result += string(k) + "=" + string(v) + " "
+			return nil
+		})
+		utils.Expect(t, "key2=value2 key3=value4 ", result)
+
+		batch.Reset()
+		utils.Expect(t, "0", batch.Len())
+		utils.Expect(t, "<nil>", db.Write(batch))
+
+		walFile := db.WALName()
+		db.Close()
+		if walFile != "" {
+			os.Remove(walFile)
+		}
+		os.RemoveAll(path)
+	}
+}
+
+func TestRangeAndPrefix(t *testing.T) {
+	for name, open := range supportedStorage {
+		path := name + "_range_test"
+		db, err := open(path)
+		utils.Expect(t, "<nil>", err)
+
+		batch := NewWriteBatch()
+		for _, k := range []string{"b", "a", "ab", "abc", "b\xff", "ac", "c"} {
+			batch.Set([]byte(k), []byte(k))
+		}
+		db.Write(batch)
+
+		collect := func(result *string, limit int) func(k, v []byte) error {
+			return func(k, v []byte) error {
+				if limit == 0 {
+					return ErrStopIteration
+				}
+				limit--
+				*result += string(k) + " "
+				return nil
+			}
+		}
+		var all, ranged, seek, prefix, prefixFF, limited string
+		utils.Expect(t, "<nil>", db.ForEach(collect(&all, -1)))
+		utils.Expect(t, "<nil>", db.Range([]byte("ab"), []byte("b"), collect(&ranged, -1)))
+		utils.Expect(t, "<nil>", db.Seek([]byte("abd"), collect(&seek, -1)))
+		utils.Expect(t, "<nil>", db.Prefix([]byte("ab"), collect(&prefix, -1)))
+		utils.Expect(t, "<nil>", db.Prefix([]byte("b"), collect(&prefixFF, -1)))
+		utils.Expect(t, "<nil>", db.Prefix([]byte("a"), collect(&limited, 2)))
+		utils.Expect(t, "a ab abc ac b b\xff c ", all)
+		utils.Expect(t, "ab abc ac ", ranged)
+		utils.Expect(t, "ac b b\xff c ", seek)
+		utils.Expect(t, "ab abc ", prefix)
+		utils.Expect(t, "b b\xff ", prefixFF)
+		utils.Expect(t, "a ab ", limited)
+
+		walFile := db.WALName()
+		db.Close()
+		if walFile != "" {
+			os.Remove(walFile)
+		}
+		os.RemoveAll(path)
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+// 一组写操作，通过Storage.Write一次性原子地写入数据库
+//
+// Set和Delete只保存键值的引用，在调用Storage.Write之前不要修改它们
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// 写入一个键值
+func (b *WriteBatch) Set(k, v []byte) {
+	b.ops = append(b.ops, batchOp{key: k, value: v})
+}
+
+// 删除一个键
+func (b *WriteBatch) Delete(k []byte) {
+	b.ops = append(b.ops, batchOp{key: k, delete: true})
+}
+
+// 操作的个数
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// 清空所有操作，以便重复使用
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// 按加入的顺序对每个操作调用set或者del，任一调用返回错误时停止并返回该错误
+// 供RegisterStorageEngine注册的存储实现Write时使用
+func (b *WriteBatch) Replay(set func(k, v []byte) error, del func(k []byte) error) error {
+	for _, op := range b.ops {
+		var err error
+		if op.delete {
+			err = del(op.key)
+		} else {
+			err = set(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
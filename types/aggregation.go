@@ -0,0 +1,58 @@
+package types
+
+import (
+	"time"
+)
+
+// 数值属性的聚合请求：对满足搜索条件的全部文档统计最小值、最大值、总和与平均值，
+// Interval或DateInterval大于零时还按固定宽度分桶统计文档数（直方图）
+type AggregationRequest struct {
+	// 属性名，没有该属性的文档不参与统计
+	Attribute string
+
+	// 直方图的桶宽度，值为v的文档落入以floor(v / Interval) * Interval为下界的桶
+	Interval float64
+
+	// 日期直方图的桶宽度，用于time.Time类型的属性，桶的下界为从1970-01-01 UTC起DateInterval的整数倍
+	// 不能和Interval同时设置
+	DateInterval time.Duration
+}
+
+// 一个聚合请求的统计结果
+type Aggregation struct {
+	Attribute string
+
+	// 有该属性的文档数，为零时Min和Max为零值
+	Count    int
+	Min, Max AttributeValue
+	Sum, Avg float64
+
+	// 文档数不为零的桶，按下界从小到大排列，没有请求直方图时为nil
+	Buckets []Bucket
+}
+
+// 直方图的一个桶
+type Bucket struct {
+	// 桶的下界：直方图为浮点数，日期直方图为纳秒时间戳
+	Key     AttributeValue
+	NumDocs int
+}
+
+// 日期直方图中桶的起始时间
+func (bucket Bucket) Time() time.Time {
+	return time.Unix(0, bucket.Key.Int).UTC()
+}
+
+// 为了方便排序：按下界从小到大
+
+type Buckets []Bucket
+
+func (buckets Buckets) Len() int {
+	return len(buckets)
+}
+func (buckets Buckets) Swap(i, j int) {
+	buckets[i], buckets[j] = buckets[j], buckets[i]
+}
+func (buckets Buckets) Less(i, j int) bool {
+	return buckets[i].Key.Compare(buckets[j].Key) < 0
+}
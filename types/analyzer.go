@@ -0,0 +1,18 @@
+package types
+
+// 分词器通用接口
+// 引擎建立索引和搜索时都通过同一个分词器切分文本，实现必须是协程安全的
+type Analyzer interface {
+	// 将UTF-8文本切分为关键词，按照在文本中出现的顺序返回
+	Analyze(text string) []AnalyzedToken
+}
+
+// 分词器切分出的一个关键词
+type AnalyzedToken struct {
+	// 关键词的字符串
+	Text string
+
+	// 关键词首字节在文本中的位置，以及尾字节之后一个字节的位置
+	Start int
+	End   int
+}
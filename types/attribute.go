@@ -0,0 +1,92 @@
+package types
+
+import (
+	"time"
+)
+
+// 文档的数值属性值：整数和时间（纳秒时间戳）按int64保存，浮点数按float64保存
+type AttributeValue struct {
+	IsFloat bool
+	Int     int64
+	Float   float64
+}
+
+// 将属性值转换为AttributeValue，支持各种整数、浮点数和time.Time，其他类型返回false
+// 大于math.MaxInt64的uint64按浮点数保存
+func NewAttributeValue(value interface{}) (AttributeValue, bool) {
+	switch v := value.(type) {
+	case int:
+		return AttributeValue{Int: int64(v)}, true
+	case int8:
+		return AttributeValue{Int: int64(v)}, true
+	case int16:
+		return AttributeValue{Int: int64(v)}, true
+	case int32:
+		return AttributeValue{Int: int64(v)}, true
+	case int64:
+		return AttributeValue{Int: v}, true
+	case uint:
+		return NewAttributeValue(uint64(v))
+	case uint8:
+		return AttributeValue{Int: int64(v)}, true
+	case uint16:
+		return AttributeValue{Int: int64(v)}, true
+	case uint32:
+		return AttributeValue{Int: int64(v)}, true
+	case uint64:
+		if v > 1<<63-1 {
+			return AttributeValue{IsFloat: true, Float: float64(v)}, true
+		}
+		return AttributeValue{Int: int64(v)}, true
+	case float32:
+		return AttributeValue{IsFloat: true, Float: float64(v)}, true
+	case float64:
+		return AttributeValue{IsFloat: true, Float: v}, true
+	case time.Time:
+		return AttributeValue{Int: v.UnixNano()}, true
+	case AttributeValue:
+		return v, true
+	}
+	return AttributeValue{}, false
+}
+
+// 按浮点数返回属性值
+func (value AttributeValue) Float64() float64 {
+	if value.IsFloat {
+		return value.Float
+	}
+	return float64(value.Int)
+}
+
+// 比较两个属性值，小于、等于、大于other时分别返回-1、0、1。整数和浮点数之间按浮点数比较
+func (value AttributeValue) Compare(other AttributeValue) int {
+	if !value.IsFloat && !other.IsFloat {
+		switch {
+		case value.Int < other.Int:
+			return -1
+		case value.Int > other.Int:
+			return 1
+		}
+		return 0
+	}
+	a, b := value.Float64(), other.Float64()
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// 数值属性的范围条件，比如Timestamp >= x：RangeFilter{Attribute: "Timestamp", Min: x}
+type RangeFilter struct {
+	// 属性名，没有该属性的文档不满足条件
+	Attribute string
+
+	// 下界和上界，类型见NewAttributeValue，为nil时不限
+	Min, Max interface{}
+
+	// 为true时不包含边界
+	ExclusiveMin, ExclusiveMax bool
+}
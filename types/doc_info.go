@@ -14,4 +14,10 @@ type DocInfosShard struct {
 type DocInfo struct {
 	Fields       interface{}
 	TokenLengths float32
+	// 各具名字段的关键词长度
+	FieldTokenLengths map[string]float32
+	// 数值属性，只在写入和读出持久存储时使用，索引器中的属性保存在文档状态中
+	Attributes map[string]AttributeValue
+	// 地理坐标属性，和Attributes一样只在写入和读出持久存储时使用
+	GeoPoints map[string]GeoPoint
 }
@@ -1,20 +1,49 @@
 package types
 
+import (
+	"strings"
+)
+
+// 字段名和关键词之间的分隔符，见FieldToken
+const FieldSeparator = "\x1f"
+
+// 标签搜索键的前缀，见LabelToken
+const LabelPrefix = "\x1e"
+
+// 不限字段的搜索键中具名字段的位置从FieldLocationStart开始（Content不能超过这么多字节），按字段名依次排列，
+// 字段之间相隔FieldLocationGap字节，使短语查询和紧邻距离不跨越字段。
+// 这些位置只在索引器内部使用，不出现在查找结果中，见IndexedDocument.TokenLocations
+const (
+	FieldLocationStart = 1 << 30
+	FieldLocationGap   = 1 << 16
+)
+
 type DocumentIndexData struct {
 	// 文档全文（必须是UTF-8格式），用于生成待索引的关键词
 	Content string
 
+	// 具名文本字段（必须是UTF-8格式），比如标题、正文、作者，键为字段名（不能包含FieldSeparator）
+	// 字段分别分词，其中的关键词既可以不限字段地查找，也可以用FieldToken得到的搜索键只在该字段中查找。
+	// 各字段的关键词长度分别统计，排序时按IndexerInitOptions.FieldBoosts计算BM25F。需要使用分词器
+	TextFields map[string]string
+
 	// 文档的关键词
 	// 当Content不为空的时候，优先从Content中分词得到关键词。
 	// Tokens存在的意义在于绕过悟空内置的分词器，在引擎外部
 	// 进行分词和预处理。
 	Tokens []TokenData
 
-	// 文档标签（必须是UTF-8格式），比如文档的类别属性等，这些标签并不出现在文档文本中
+	// 文档标签（必须是UTF-8格式），比如文档的类别属性等，这些标签并不出现在文档文本中。
+	// 标签同时以原文和LabelToken加入索引，前者用于SearchRequest.Labels和文本查找，后者只用于分面统计
 	Labels []string
 
 	// 文档的评分字段，可以接纳任何类型的结构体
 	Fields interface{}
+
+	// 数值属性，键为属性名，值可以是整数、浮点数或者time.Time（见NewAttributeValue）
+	// 索引器保存在文档状态中，查找时用SearchRequest.Filters按范围过滤
+	// 值为GeoPoint时是地理坐标属性，用SearchRequest.GeoFilters过滤、用RankOptions.SortByDistance排序
+	Attributes map[string]interface{}
 }
 
 // 文档的一个关键词
@@ -25,3 +54,21 @@ type TokenData struct {
 	// 关键词的首字节在文档中出现的位置
 	Locations []int
 }
+
+// 只在字段field中查找关键词token的搜索键
+func FieldToken(field, token string) string {
+	return field + FieldSeparator + token
+}
+
+// 标签label的搜索键，和文本关键词分开，分面统计只统计这些搜索键
+func LabelToken(label string) string {
+	return LabelPrefix + label
+}
+
+// 将搜索键分为字段名和关键词，不限字段的搜索键的字段名为空
+func SplitFieldToken(key string) (field, token string) {
+	if i := strings.Index(key, FieldSeparator); i >= 0 {
+		return key[:i], key[i+len(FieldSeparator):]
+	}
+	return "", key
+}
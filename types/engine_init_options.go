@@ -1,7 +1,7 @@
 package types
 
 import (
-	"log"
+	"errors"
 	"runtime"
 )
 
@@ -13,6 +13,7 @@ var (
 	defaultNumIndexerThreadsPerShard = runtime.NumCPU()
 	defaultRankerBufferLength        = runtime.NumCPU()
 	defaultNumRankerThreadsPerShard  = runtime.NumCPU()
+	defaultNumRemovedDocsToCompact   = 1000
 	defaultDefaultRankOptions        = RankOptions{
 		ScoringCriteria: RankByBM25{},
 	}
@@ -33,6 +34,11 @@ type EngineInitOptions struct {
 	// 注意，如果你不用分词器，那么在调用IndexDocument时DocumentIndexData中的Content会被忽略
 	NotUsingSegmenter bool
 
+	// 分词器，建立索引和搜索时使用同一个分词器
+	// 为nil时使用sego词典分词，词典由SegmenterDictionaries指定
+	// 不需要词典的CJK二元分词见analyzer.BigramAnalyzer
+	Analyzer Analyzer
+
 	// 半角逗号分隔的字典文件，具体用法见
 	// sego.Segmenter.LoadDictionary函数的注释
 	SegmenterDictionaries string
@@ -40,6 +46,17 @@ type EngineInitOptions struct {
 	// 停用词文件
 	StopTokenFile string
 
+	// 同义词文件，为空时不扩展同义词。每行为一个关键词和它的同义词，用空白分隔，比如
+	//
+	//	北京大学 北大:0.8 燕园:0.5
+	//
+	// 搜索时查询中的关键词扩展为它和同义词的并集，冒号后为同义词在BM25中的权重，没有时为1。
+	// 只有最后一个冒号后能解析为数时才是权重，同义词本身以冒号加数字结尾时需在末尾写出权重，如 price:100:1。
+	// 关键词和同义词用建立索引时的分词器切分并过滤停用词：关键词必须切分为一个关键词，
+	// 同义词切分为多个关键词时作为短语（Slop为0）扩展。以"="开头时不分词，去掉"="后原样使用，比如 =category:x。
+	// 同义词是单向的，需要双向扩展时另写一行。修改文件后调用Engine.ReloadSynonyms重新读入
+	SynonymFile string
+
 	// 分词器线程数
 	NumSegmenterThreads int
 
@@ -60,6 +77,10 @@ type EngineInitOptions struct {
 	// 排序器每个shard分配的线程数
 	NumRankerThreadsPerShard int
 
+	// 每个shard中被删除但尚未压缩的文档数达到此值时，
+	// 后台将内存中的反向索引合并为一个段
+	NumRemovedDocsToCompact int
+
 	// 索引器初始化选项
 	IndexerInitOptions *IndexerInitOptions
 
@@ -69,16 +90,30 @@ type EngineInitOptions struct {
 	// 是否使用持久数据库，以及数据库文件保存的目录
 	UsePersistentStorage    bool
 	PersistentStorageFolder string
+
+	// 自定义评分字段的类型，设为该类型的一个值，比如MyScoringFields{}
+	// 持久存储按这个类型编码和解码评分字段，该类型不需要在gob中注册
+	// 为nil或者评分字段是其他类型时，评分字段作为接口值用gob编码，其类型必须在gob中注册
+	ScoringFieldsType interface{}
 }
 
 // 初始化EngineInitOptions，当用户未设定某个选项的值时用默认值取代
-func (options *EngineInitOptions) Init() {
-	if !options.NotUsingSegmenter {
+// 选项不合法时返回错误
+func (options *EngineInitOptions) Init() error {
+	if !options.NotUsingSegmenter && options.Analyzer == nil {
 		if options.SegmenterDictionaries == "" {
-			log.Fatal("字典文件不能为空")
+			return errors.New("字典文件不能为空")
 		}
 	}
 
+	if options.NumShards < 0 {
+		return errors.New("NumShards不能为负数")
+	}
+
+	if options.UsePersistentStorage && options.PersistentStorageFolder == "" {
+		return errors.New("使用持久存储时必须指定PersistentStorageFolder")
+	}
+
 	if options.NumSegmenterThreads == 0 {
 		options.NumSegmenterThreads = defaultNumSegmenterThreads
 	}
@@ -103,6 +138,10 @@ func (options *EngineInitOptions) Init() {
 		options.NumRankerThreadsPerShard = defaultNumRankerThreadsPerShard
 	}
 
+	if options.NumRemovedDocsToCompact == 0 {
+		options.NumRemovedDocsToCompact = defaultNumRemovedDocsToCompact
+	}
+
 	if options.IndexerInitOptions == nil {
 		options.IndexerInitOptions = &defaultIndexerInitOptions
 	}
@@ -118,4 +157,5 @@ func (options *EngineInitOptions) Init() {
 	if options.DefaultRankOptions.ScoringCriteria == nil {
 		options.DefaultRankOptions.ScoringCriteria = defaultDefaultRankOptions.ScoringCriteria
 	}
+	return nil
 }
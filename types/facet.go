@@ -0,0 +1,42 @@
+package types
+
+// 分面统计请求：统计满足搜索条件的全部文档（不只是返回的一页）中包含各标签的文档数
+type FacetRequest struct {
+	// 只统计以Prefix开头的文档标签（见DocumentIndexData.Labels），比如"category:"，通常标签都带有这样的前缀。
+	// 正文和具名字段中的关键词不统计。不能为空
+	Prefix string
+
+	// 最多返回的标签数，小于等于零时不限制
+	TopN int
+}
+
+// 一个分面请求的统计结果
+type Facet struct {
+	Prefix string
+
+	// 各标签的文档数，先按文档数从大到小、再按字节序排列，不包含文档数为零的标签
+	Counts []FacetCount
+}
+
+type FacetCount struct {
+	// 标签原文，不带LabelPrefix
+	Label   string
+	NumDocs int
+}
+
+// 为了方便排序：先按文档数从大到小，再按字节序
+
+type FacetCounts []FacetCount
+
+func (counts FacetCounts) Len() int {
+	return len(counts)
+}
+func (counts FacetCounts) Swap(i, j int) {
+	counts[i], counts[j] = counts[j], counts[i]
+}
+func (counts FacetCounts) Less(i, j int) bool {
+	if counts[i].NumDocs != counts[j].NumDocs {
+		return counts[i].NumDocs > counts[j].NumDocs
+	}
+	return counts[i].Label < counts[j].Label
+}
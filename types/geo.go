@@ -0,0 +1,57 @@
+package types
+
+import (
+	"math"
+)
+
+// 地球的平均半径，单位为米
+const EarthRadius = 6371008.8
+
+// 地理坐标，单位为度。作为DocumentIndexData.Attributes的值时为地理坐标属性
+type GeoPoint struct {
+	Lat, Lon float64
+}
+
+// 纬度在[-90, 90]、经度在[-180, 180]之间时返回true
+func (point GeoPoint) Valid() bool {
+	return point.Lat >= -90 && point.Lat <= 90 && point.Lon >= -180 && point.Lon <= 180
+}
+
+// 两点之间的大圆距离（haversine公式），单位为米
+func (point GeoPoint) Distance(other GeoPoint) float64 {
+	lat1, lat2 := point.Lat*math.Pi/180, other.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (other.Lon - point.Lon) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// 经纬度矩形，Min为西南角，Max为东北角，不支持跨越180度经线的矩形
+type GeoBox struct {
+	Min, Max GeoPoint
+}
+
+// 点是否在矩形内（包含边界）
+func (box GeoBox) Contains(point GeoPoint) bool {
+	return point.Lat >= box.Min.Lat && point.Lat <= box.Max.Lat &&
+		point.Lon >= box.Min.Lon && point.Lon <= box.Max.Lon
+}
+
+// 地理坐标属性的范围条件：在矩形内，或者到Center的距离不超过Radius米，两者都设置时要求同时满足
+type GeoFilter struct {
+	// 属性名，没有该属性的文档不满足条件
+	Attribute string
+
+	// 矩形范围，为nil时不限
+	Box *GeoBox
+
+	// 圆形范围的圆心和半径（米），Center为nil时不限
+	Center *GeoPoint
+	Radius float64
+}
+
+// 按地理坐标属性到Center的距离从近到远排序，见RankOptions.SortByDistance
+type DistanceSort struct {
+	Attribute string
+	Center    GeoPoint
+}
@@ -7,8 +7,17 @@ type DocumentIndex struct {
 	// 文本的关键词长
 	TokenLength float32
 
+	// 各具名字段的关键词长，已计入TokenLength
+	FieldTokenLengths map[string]float32
+
 	// 加入的索引键
 	Keywords []KeywordIndex
+
+	// 数值属性
+	Attributes map[string]AttributeValue
+
+	// 地理坐标属性
+	GeoPoints map[string]GeoPoint
 }
 
 // 反向索引项，这实际上标注了一个（搜索键，文档）对。
@@ -35,10 +44,15 @@ type IndexedDocument struct {
 	TokenProximity int32
 
 	// 紧邻距离计算得到的关键词位置，和Lookup函数输入tokens的长度一样且一一对应。
-	// 仅当索引类型为LocationsIndex时返回有效值。
+	// 仅当索引类型为LocationsIndex时返回有效值。位置在具名字段中时为-1，见TokenLocations
 	TokenSnippetLocations []int
 
 	// 关键词在文本中的具体位置。
 	// 仅当索引类型为LocationsIndex时返回有效值。
+	// 不限字段的关键词只返回在Content中的字节位置，在具名字段中的出现不返回位置；
+	// 只在一个字段中查找的关键词（types.FieldToken）返回在该字段文本中的字节位置
 	TokenLocations [][]int
+
+	// 到距离排序中心的距离（米），见RankOptions.SortByDistance
+	Distance float64
 }
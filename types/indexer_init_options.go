@@ -20,6 +20,10 @@ type IndexerInitOptions struct {
 
 	// BM25参数
 	BM25Parameters *BM25Parameters
+
+	// 具名字段（见DocumentIndexData.TextFields）在BM25F中的权重，键为空字符串时为Content的权重
+	// 没有设置的字段权重为1。索引中没有具名字段时BM25F等同于BM25
+	FieldBoosts map[string]float32
 }
 
 // 见http://en.wikipedia.org/wiki/Okapi_BM25
@@ -4,17 +4,61 @@ import (
 	"sync"
 )
 
-// 反向索引表([关键词]反向索引表)
+// 反向索引表的统计和锁。反向索引本身由索引器中的缓冲区和若干不可修改的索引段组成，见core/segments.go
 type InvertedIndexShard struct {
-	InvertedIndex    map[string]*KeywordIndices
 	TotalTokenLength float32 //总关键词数
+	// 各具名字段的总关键词数，没有文档包含的字段不出现
+	FieldTokenLengths map[string]float32
 	sync.RWMutex
 }
 
 // 反向索引表的一行，收集了一个搜索键出现的所有文档，按照DocId从小到大排序。
+// 索引器的缓冲区使用这个未压缩的形式，索引段中保存压缩后的PostingList
 type KeywordIndices struct {
 	// 下面的切片是否为空，取决于初始化时IndexType的值
 	DocIds      []uint64  // 全部类型都有
 	Frequencies []float32 // IndexType == FrequenciesIndex
 	Locations   [][]int   // IndexType == LocationsIndex
+	// IndexType == LocationsIndex，和Locations一一对应的关键词序号，见core/indexer.go中的keywordPositions。
+	// 旧版本持久存储中载入的文档没有序号，为nil
+	Positions [][]int
+}
+
+// 压缩后的反向索引行
+//
+// 文档按照DocId从小到大分成若干块，FirstDocIds为各块第一个文档的DocId，
+// 查找文档时先在FirstDocIds中二分查找所在的块（跳过其他块），只需解压这一块
+type PostingList struct {
+	// 文档总数
+	NumDocs int
+
+	// 全部块中MaxFrequency的最大值和MinTokenLength的最小值，用于估计BM25的上界
+	MaxFrequency   float32
+	MinTokenLength float32
+
+	FirstDocIds []uint64
+	Blocks      []PostingBlock
+}
+
+// 压缩后的一块，编码方式见core/postings.go
+type PostingBlock struct {
+	// 块中的文档数
+	NumDocs int
+
+	// 块中最大的词频（LocationsIndex时为位置个数）和最短的文档长度，用于估计块中文档BM25的上界。
+	// 文档长度未知时MinTokenLength为0
+	MaxFrequency   float32
+	MinTokenLength float32
+
+	// 除第一个文档外，每个DocId和前一个DocId之差的uvarint编码
+	DocIds []byte
+
+	// IndexType == FrequenciesIndex时的词频
+	Frequencies []float32
+
+	// IndexType == LocationsIndex时每个文档的位置个数（uvarint）和各位置与前一个位置之差（varint）
+	Locations []byte
+
+	// IndexType == LocationsIndex时每个文档的序号个数（uvarint，没有序号时为0）和各序号与前一个序号之差（varint）
+	Positions []byte
 }
@@ -0,0 +1,18 @@
+package types
+
+// 索引器查找的附加条件、统计和排序需要的数据，见core.Indexer.LookupContext
+type LookupOptions struct {
+	// 数值属性和地理坐标属性的范围条件，在计算BM25和紧邻距离之前检查
+	Filters    []RangeFilter
+	GeoFilters []GeoFilter
+
+	// 分面统计和数值属性的聚合，对满足条件的全部文档进行，结果分别和Facets、Aggregations一一对应
+	Facets       []FacetRequest
+	Aggregations []AggregationRequest
+
+	// 不为nil时计算返回文档到DistanceSort.Center的距离，见IndexedDocument.Distance
+	DistanceSort *DistanceSort
+
+	// 为true时只统计文档数，不返回文档
+	CountDocsOnly bool
+}
@@ -0,0 +1,130 @@
+package types
+
+// 这些常数定义了布尔查询树节点的类型
+const (
+	// 叶子节点，对应一个搜索键或者一段待分词的文本
+	QueryTerm = 0
+
+	// 所有子节点的交集
+	QueryAnd = 1
+
+	// 所有子节点的并集
+	QueryOr = 2
+
+	// 从父节点（必须是QueryAnd）的结果中排除子节点匹配的文档
+	// 单独使用或者出现在QueryOr中时不匹配任何文档
+	QueryNot = 3
+
+	// 短语：子节点（必须是叶子节点）按顺序在文档中相邻出现
+	// 仅当索引类型为LocationsIndex时检查相邻关系，否则等同于QueryAnd
+	QueryPhrase = 4
+)
+
+// 布尔查询树
+type Query struct {
+	// 节点类型，见上面的常数
+	Operator int
+
+	// 搜索键（必须是UTF-8格式），可以是关键词也可以是标签，仅当Operator == QueryTerm时有效
+	Token string
+
+	// 字段名，仅当Operator == QueryTerm时有效。不为空时Token和Text中的关键词只在该具名字段中查找
+	Field string
+
+	// 待分词的文本（必须是UTF-8格式），仅当Operator == QueryTerm且Token为空时有效
+	// 分词后得到多个关键词时视为这些关键词的交集
+	Text string
+
+	// 子节点，仅当Operator不为QueryTerm时有效
+	Children []Query
+
+	// 仅当Operator == QueryPhrase时有效，短语中相邻关键词之间允许间隔的关键词个数之和
+	// 为0时要求关键词严格相邻。停用词不进入索引，不计入间隔
+	Slop int
+
+	// 仅当Operator == QueryTerm时有效，该搜索键的BM25乘以这个权重，为0时权重为1
+	// 同义词扩展出的搜索键使用同义词文件中的权重，见EngineInitOptions.SynonymFile
+	Weight float32
+}
+
+// 生成一个搜索键叶子节点
+func TermQuery(token string) Query {
+	return Query{Operator: QueryTerm, Token: token}
+}
+
+// 生成一个待分词的文本叶子节点
+func TextQuery(text string) Query {
+	return Query{Operator: QueryTerm, Text: text}
+}
+
+// 生成只在字段field中查找的搜索键叶子节点
+func FieldTermQuery(field, token string) Query {
+	return Query{Operator: QueryTerm, Token: token, Field: field}
+}
+
+// 生成只在字段field中查找的待分词文本叶子节点
+func FieldTextQuery(field, text string) Query {
+	return Query{Operator: QueryTerm, Text: text, Field: field}
+}
+
+// 叶子节点在反向索引中的搜索键，Field不为空时为FieldToken(Field, Token)
+func (query *Query) Key() string {
+	if query.Field != "" && query.Token != "" {
+		return FieldToken(query.Field, query.Token)
+	}
+	return query.Token
+}
+
+// 生成交集节点
+func AndQuery(children ...Query) Query {
+	return Query{Operator: QueryAnd, Children: children}
+}
+
+// 生成并集节点
+func OrQuery(children ...Query) Query {
+	return Query{Operator: QueryOr, Children: children}
+}
+
+// 生成排除节点，通常作为AndQuery的参数使用
+func NotQuery(children ...Query) Query {
+	return Query{Operator: QueryNot, Children: children}
+}
+
+// 生成短语节点，slop见Query.Slop的注释
+func PhraseQuery(slop int, children ...Query) Query {
+	return Query{Operator: QueryPhrase, Children: children, Slop: slop}
+}
+
+// 和Tokens一一对应的权重，见Query.Weight
+func (query *Query) TokenWeights() (weights []float32) {
+	switch query.Operator {
+	case QueryTerm:
+		if query.Token != "" {
+			weight := query.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			weights = append(weights, weight)
+		}
+	case QueryAnd, QueryOr, QueryPhrase:
+		for i := range query.Children {
+			weights = append(weights, query.Children[i].TokenWeights()...)
+		}
+	}
+	return
+}
+
+// 按出现顺序返回查询树中所有参与打分的搜索键（见Key），QueryNot下的搜索键不会返回
+func (query *Query) Tokens() (tokens []string) {
+	switch query.Operator {
+	case QueryTerm:
+		if query.Token != "" {
+			tokens = append(tokens, query.Key())
+		}
+	case QueryAnd, QueryOr, QueryPhrase:
+		for i := range query.Children {
+			tokens = append(tokens, query.Children[i].Tokens()...)
+		}
+	}
+	return
+}
@@ -9,12 +9,44 @@ type SearchRequest struct {
 	// 通常你不需要自己指定关键词，除非你运行自己的分词程序
 	Tokens []string
 
+	// 字段名，不为空时Text或Tokens中的关键词只在该具名字段中查找，见DocumentIndexData.TextFields
+	// 此时SearchResponse.Tokens为types.FieldToken得到的搜索键。查询树中的字段见Query.Field
+	Field string
+
+	// 布尔查询树，不为nil时忽略Text和Tokens，按照查询树求交集、并集和排除
+	// 查询树中Text不为空的叶子节点会被分词
+	Query *Query
+
+	// 设为true时要求Text或Tokens中的关键词按顺序相邻出现（短语查询），仅当Query为nil时有效
+	// PhraseSlop为相邻关键词之间允许间隔的关键词个数之和，见Query.Slop的注释
+	Phrase     bool
+	PhraseSlop int
+
+	// 设为true时在按BM25排序时跳过不可能进入前OutputOffset+MaxOutputs名的文档（WAND），只是优化，不改变查找的文档集合。
+	// 仅当Query为若干搜索键（QueryTerm，Weight为0或1）的并集，ScoringCriteria为RankByBM25，MaxOutputs不为0，
+	// 且ReverseOrder、CountDocsOnly和Orderless都为false时跳过文档，其它情况下忽略。
+	// 排序结果和NumDocs都和不跳过时相同：被跳过的文档不评分，但仍只解压DocId计入NumDocs；
+	// 关键词有同义词时查询树不再是搜索键的并集，不跳过文档
+	Pruning bool
+
 	// 文档标签（必须是UTF-8格式），标签不存在文档文本中，但也属于搜索键的一种
 	Labels []string
 
 	// 当不为nil时，仅从这些DocIds包含的键中搜索（忽略值）
 	DocIds map[uint64]bool
 
+	// 数值属性的范围条件，文档必须满足全部条件。在索引器中计算BM25和紧邻距离之前检查
+	Filters []RangeFilter
+
+	// 地理坐标属性的范围条件，文档必须满足全部条件。索引器先用网格找出候选文档再精确计算，设置后不跳过文档
+	GeoFilters []GeoFilter
+
+	// 分面统计，结果按顺序放在SearchResponse.Facets中。设置后不跳过文档（见Pruning）
+	Facets []FacetRequest
+
+	// 数值属性的聚合，结果按顺序放在SearchResponse.Aggregations中。设置后不跳过文档（见Pruning）
+	Aggregations []AggregationRequest
+
 	// 排序选项
 	RankOptions *RankOptions
 
@@ -42,4 +74,8 @@ type RankOptions struct {
 
 	// 最大输出的搜索结果数，为0时无限制
 	MaxOutputs int
+
+	// 不为nil时先按文档到SortByDistance.Center的距离从近到远排序（ReverseOrder为true时从远到近），
+	// 距离相同时再按ScoringCriteria的分数排序。没有该属性的文档距离为正无穷，距离见ScoredDocument.Distance
+	SortByDistance *DistanceSort
 }
@@ -5,7 +5,7 @@ import (
 )
 
 type SearchResponse struct {
-	// 搜索用到的关键词
+	// 搜索用到的关键词，扩展同义词时仍为原来的关键词
 	Tokens []string
 
 	// 搜索到的文档，已排序
@@ -14,8 +14,17 @@ type SearchResponse struct {
 	// 搜索是否超时。超时的情况下也可能会返回部分结果
 	Timeout bool
 
+	// 完成查找和排序的shard，从小到大排列。超时的情况下返回的部分结果仅来自这些shard
+	FinishedShards []int
+
 	// 搜索到的文档个数。注意这是全部文档中满足条件的个数，可能比返回的文档数要大
 	NumDocs int
+
+	// 分面统计的结果，和SearchRequest.Facets一一对应，各标签的文档数为全部shard之和
+	Facets []Facet
+
+	// 数值属性的聚合结果，和SearchRequest.Aggregations一一对应，由全部shard的结果合并得到
+	Aggregations []Aggregation
 }
 
 type ScoredDocument struct {
@@ -31,7 +40,13 @@ type ScoredDocument struct {
 
 	// 关键词出现的位置
 	// 只有当IndexType == LocationsIndex时不为空
+	// 位置的含义见IndexedDocument.TokenLocations：不限字段的关键词为Content中的位置，
+	// 只在一个字段中查找的关键词为该字段中的位置
 	TokenLocations [][]int
+
+	// 到RankOptions.SortByDistance.Center的距离（米），没有设置SortByDistance时为0，
+	// 文档没有该属性时为正无穷
+	Distance float64
 }
 
 // 为了方便排序
@@ -46,12 +61,17 @@ func (docs ScoredDocuments) Swap(i, j int) {
 }
 func (docs ScoredDocuments) Less(i, j int) bool {
 	// 为了从大到小排序，这实际上实现的是More的功能
-	for iScore := 0; iScore < utils.MinInt(len(docs[i].Scores), len(docs[j].Scores)); iScore++ {
-		if docs[i].Scores[iScore] > docs[j].Scores[iScore] {
+	return MoreScores(docs[i].Scores, docs[j].Scores)
+}
+
+// 按字典序比较两组分数，a大于b时返回true
+func MoreScores(a, b []float32) bool {
+	for iScore := 0; iScore < utils.MinInt(len(a), len(b)); iScore++ {
+		if a[iScore] > b[iScore] {
 			return true
-		} else if docs[i].Scores[iScore] < docs[j].Scores[iScore] {
+		} else if a[iScore] < b[iScore] {
 			return false
 		}
 	}
-	return len(docs[i].Scores) > len(docs[j].Scores)
+	return len(a) > len(b)
 }
@@ -0,0 +1,27 @@
+package types
+
+// 搜索提示
+type Suggestion struct {
+	// 搜索键的UTF-8文本
+	Text string
+
+	// 包含该搜索键的文档数，用于给搜索提示排序
+	NumDocs int
+}
+
+// 为了方便排序：先按文档数从大到小，再按字节序
+
+type Suggestions []Suggestion
+
+func (ss Suggestions) Len() int {
+	return len(ss)
+}
+func (ss Suggestions) Swap(i, j int) {
+	ss[i], ss[j] = ss[j], ss[i]
+}
+func (ss Suggestions) Less(i, j int) bool {
+	if ss[i].NumDocs != ss[j].NumDocs {
+		return ss[i].NumDocs > ss[j].NumDocs
+	}
+	return ss[i].Text < ss[j].Text
+}